@@ -0,0 +1,195 @@
+package vfd
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+const (
+	// DiscountAdjustment takes an amount off the whole receipt, such as a
+	// promotion on the basket.
+	DiscountAdjustment AdjustmentType = "DISCOUNT"
+
+	// SurchargeAdjustment adds an amount to the whole receipt, such as a service
+	// charge.
+	SurchargeAdjustment AdjustmentType = "SURCHARGE"
+)
+
+type (
+	// Adjustment is a discount or a surcharge on the whole receipt rather than on
+	// an item. It is shared out between the items in proportion to their tax
+	// inclusive amounts after their own discounts, first between the tax codes and
+	// then between the items of each code, and the VAT of every item is computed
+	// on what it comes to.
+	//
+	// Amount is tax inclusive. When Percentage is set instead, the amount is that
+	// percentage of the total of the items after their own discounts, before any
+	// other adjustment. Description is printed on the receipt.
+	//
+	// Discounts add up with the item discounts in the DISCOUNT of the receipt.
+	// Surcharges are added to the AMT of the items, the payload has no field for
+	// them, and to the SURCHARGES of the Z report.
+	Adjustment struct {
+		Type        AdjustmentType
+		Description string
+		Amount      float64
+		Percentage  float64
+	}
+
+	// AdjustmentType is either DiscountAdjustment or SurchargeAdjustment.
+	AdjustmentType string
+)
+
+// amount returns the tax inclusive amount of the adjustment on items worth base.
+func (a Adjustment) amount(base money.Money) money.Money {
+	if a.Percentage != 0 {
+		return base.MulDiv(int64(math.Round(a.Percentage*100)), basisPointsBase)
+	}
+	return money.FromFloat(a.Amount)
+}
+
+// label returns the text printed for the adjustment.
+func (a Adjustment) label() string {
+	if a.Description != "" {
+		return a.Description
+	}
+	return string(a.Type)
+}
+
+// signed returns amount negated for discounts.
+func (a Adjustment) signed(amount money.Money) money.Money {
+	if a.Type == SurchargeAdjustment {
+		return amount
+	}
+	return -amount
+}
+
+// applyAdjustments shares the adjustments out between the lines and returns the
+// amount of each adjustment. The Net and Tax of every line that got a share are
+// computed again from its tax inclusive amount.
+func applyAdjustments(lines []ItemLine, adjustments []Adjustment) []money.Money {
+	if len(adjustments) == 0 {
+		return nil
+	}
+
+	var base money.Money
+	weights := make([]money.Money, len(lines))
+	for i, line := range lines {
+		weights[i] = line.Amount - line.Discount
+		base += weights[i]
+	}
+
+	amounts := make([]money.Money, len(adjustments))
+	for k, adjustment := range adjustments {
+		amounts[k] = adjustment.amount(base)
+		for i, share := range allocateByRate(lines, weights, amounts[k]) {
+			line := &lines[i]
+			if adjustment.Type == SurchargeAdjustment {
+				line.Surcharge += share
+				line.Amount += share
+			} else {
+				line.BasketDiscount += share
+				line.Discount += share
+			}
+		}
+	}
+
+	for i := range lines {
+		line := &lines[i]
+		if line.adjusted() {
+			gross := line.Amount - line.Discount
+			line.Net = line.VAT.Net(gross)
+			line.Tax = gross - line.Net
+		}
+	}
+
+	return amounts
+}
+
+// allocateByRate shares amount out between the lines in proportion to weights,
+// first between the VAT rates of the lines and then between the lines of each
+// rate.
+func allocateByRate(lines []ItemLine, weights []money.Money, amount money.Money) []money.Money {
+	var ids []string
+	members := make(map[string][]int)
+	for i, line := range lines {
+		id := line.VAT.ID
+		if _, ok := members[id]; !ok {
+			ids = append(ids, id)
+		}
+		members[id] = append(members[id], i)
+	}
+
+	rateWeights := make([]money.Money, len(ids))
+	for r, id := range ids {
+		for _, i := range members[id] {
+			rateWeights[r] += weights[i]
+		}
+	}
+
+	shares := make([]money.Money, len(lines))
+	for r, rateShare := range allocate(amount, rateWeights) {
+		indexes := members[ids[r]]
+		lineWeights := make([]money.Money, len(indexes))
+		for j, i := range indexes {
+			lineWeights[j] = weights[i]
+		}
+		for j, share := range allocate(rateShare, lineWeights) {
+			shares[indexes[j]] = share
+		}
+	}
+
+	return shares
+}
+
+// allocate shares amount out in proportion to the positive weights with the
+// largest remainder method: every weight gets its share rounded down and the
+// cents left go one each to the largest remainders, the first weight winning a
+// tie. The shares always add up to amount, which goes to the first weight when
+// none is positive.
+func allocate(amount money.Money, weights []money.Money) []money.Money {
+	shares := make([]money.Money, len(weights))
+	if len(weights) == 0 {
+		return shares
+	}
+
+	var total money.Money
+	for _, w := range weights {
+		if w > 0 {
+			total += w
+		}
+	}
+	if total == 0 || amount < 0 {
+		shares[0] = amount
+		return shares
+	}
+
+	left := amount
+	remainders := make([]uint64, len(weights))
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		hi, lo := bits.Mul64(uint64(amount), uint64(w))
+		q, r := bits.Div64(hi, lo, uint64(total))
+		shares[i], remainders[i] = money.Money(q), r
+		left -= shares[i]
+	}
+
+	ranked := make([]int, len(weights))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		return remainders[ranked[a]] > remainders[ranked[b]]
+	})
+	for k := 0; left > 0; k++ {
+		shares[ranked[k%len(ranked)]]++
+		left--
+	}
+
+	return shares
+}
@@ -0,0 +1,78 @@
+package vfd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount  money.Money
+		weights []money.Money
+		want    []money.Money
+	}{
+		{100, []money.Money{1, 1, 1}, []money.Money{34, 33, 33}},
+		{100, []money.Money{1, 2, 1}, []money.Money{25, 50, 25}},
+		{5, []money.Money{300, 0, 700}, []money.Money{2, 0, 3}},
+		{7, []money.Money{0, 0}, []money.Money{7, 0}},
+		{1 << 40, []money.Money{1 << 40, 1 << 41}, []money.Money{366503875925, 733007751851}},
+	}
+	for _, tt := range tests {
+		if got := allocate(tt.amount, tt.weights); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("allocate(%d, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestProcessItemsAdjustments(t *testing.T) {
+	items := []Item{
+		{ID: "1", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 1180},
+		{ID: "2", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 2360},
+		{ID: "3", TaxCode: ZeroVATCODE, Quantity: 1, UnitPrice: 1000},
+	}
+	got := ProcessItems(items,
+		Adjustment{Type: DiscountAdjustment, Description: "10% OFF", Percentage: 10},
+		Adjustment{Type: SurchargeAdjustment, Description: "SERVICE", Amount: 227},
+	)
+
+	if want := []money.Money{45400, 22700}; !reflect.DeepEqual(got.Adjustments, want) {
+		t.Errorf("Adjustments = %v, want %v", got.Adjustments, want)
+	}
+
+	wantLines := []ItemLine{
+		{ID: "1", VAT: standardVAT, Amount: 123900, Discount: 11800, Surcharge: 5900, BasketDiscount: 11800, Net: 95000, Tax: 17100},
+		{ID: "2", VAT: standardVAT, Amount: 247800, Discount: 23600, Surcharge: 11800, BasketDiscount: 23600, Net: 190000, Tax: 34200},
+		{ID: "3", VAT: zeroVAT, Amount: 105000, Discount: 10000, Surcharge: 5000, BasketDiscount: 10000, Net: 95000},
+	}
+	if !reflect.DeepEqual(got.Lines, wantLines) {
+		t.Errorf("Lines = %+v\nwant %+v", got.Lines, wantLines)
+	}
+
+	wantTotals := models.TOTALS{
+		TOTALTAXEXCL: money.MustParse("3800.00"),
+		TOTALTAXINCL: money.MustParse("4313.00"),
+		DISCOUNT:     money.MustParse("454.00"),
+	}
+	if got.TOTALS != wantTotals {
+		t.Errorf("TOTALS = %+v, want %+v", got.TOTALS, wantTotals)
+	}
+
+	wantVATs := []*models.VATTOTAL{
+		{VATRATE: "A", NETTAMOUNT: money.MustParse("2850.00"), TAXAMOUNT: money.MustParse("513.00")},
+		{VATRATE: "C", NETTAMOUNT: money.MustParse("950.00")},
+	}
+	if !reflect.DeepEqual(got.VATTOTALS, wantVATs) {
+		t.Errorf("VATTOTALS = %+v, want %+v", got.VATTOTALS, wantVATs)
+	}
+
+	var amounts money.Money
+	for _, item := range got.ITEMS {
+		amounts += item.AMT
+	}
+	if amounts-got.TOTALS.DISCOUNT != got.TOTALS.TOTALTAXINCL {
+		t.Errorf("items %s less discount %s != TOTALTAXINCL %s", amounts, got.TOTALS.DISCOUNT, got.TOTALS.TOTALTAXINCL)
+	}
+}
@@ -2,16 +2,29 @@ package vfd
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
 )
 
 type (
 	Client struct {
-		http *http.Client
+		http           *http.Client
+		tokens         *TokenSource
+		onReauth       OnReauthenticate
+		ackCert        *x509.Certificate
+		skipValidation bool
+		sign           PayloadSigner
+		taxes          *TaxSchedule
 	}
 
 	Option func(*Client)
+
+	// OnReauthenticate is called every time a submission is rejected with an
+	// *AuthError and the Client is about to fetch a new token and replay it.
+	OnReauthenticate func(ctx context.Context, err *AuthError)
 )
 
 func WithHttpClient(http *http.Client) Option {
@@ -20,6 +33,81 @@ func WithHttpClient(http *http.Client) Option {
 	}
 }
 
+// WithTokenSource sets the TokenSource used to obtain bearer tokens when
+// SubmitReceipt or SubmitReport are called without one.
+func WithTokenSource(tokens *TokenSource) Option {
+	return func(c *Client) {
+		c.tokens = tokens
+	}
+}
+
+// WithTokenRequest creates a TokenSource that fetches tokens from url using the
+// Client's own http client and the credentials in request.
+func WithTokenRequest(url string, request *TokenRequest, options ...TokenSourceOption) Option {
+	return func(c *Client) {
+		c.tokens = NewTokenSource(c.FetchToken, url, request, options...)
+	}
+}
+
+// WithReauthenticateHook sets the callback that is invoked before a rejected
+// submission is replayed with a fresh token.
+func WithReauthenticateHook(hook OnReauthenticate) Option {
+	return func(c *Client) {
+		c.onReauth = hook
+	}
+}
+
+// WithAckCertificate makes the Client verify the EFDMSSIGNATURE of every
+// acknowledgement received after registration, receipt and Z report submission
+// against cert, the certificate the VFD server signs its responses with.
+// Acknowledgements that do not verify are returned as errors wrapping
+// ErrInvalidAckSignature.
+func WithAckCertificate(cert *x509.Certificate) Option {
+	return func(c *Client) {
+		c.ackCert = cert
+	}
+}
+
+// WithoutReceiptValidation makes SubmitReceipt sign and send receipts without
+// checking them with ReceiptRequest.Validate first.
+func WithoutReceiptValidation() Option {
+	return func(c *Client) {
+		c.skipValidation = true
+	}
+}
+
+// WithPayloadSigner replaces Sign as the function registrations, receipts and
+// Z reports are signed with, for example to log or time every signature made by
+// a remote signer.
+func WithPayloadSigner(sign PayloadSigner) Option {
+	return func(c *Client) {
+		if sign != nil {
+			c.sign = sign
+		}
+	}
+}
+
+// WithTaxTable sets the rates receipts and Z reports are computed with. The
+// default is the DefaultTaxTable.
+func WithTaxTable(table *TaxTable) Option {
+	return func(c *Client) {
+		c.taxes = &TaxSchedule{table: table}
+	}
+}
+
+// WithTaxSchedule sets the history of the rates receipts and Z reports are
+// computed with, for a device whose rates changed or are about to change.
+func WithTaxSchedule(taxes *TaxSchedule) Option {
+	return func(c *Client) {
+		c.taxes = taxes
+	}
+}
+
+// TokenSource returns the TokenSource used by the Client or nil if none was set.
+func (c *Client) TokenSource() *TokenSource {
+	return c.tokens
+}
+
 // SetHttpClient sets the http client
 func (c *Client) SetHttpClient(http *http.Client) {
 	if http != nil {
@@ -30,6 +118,7 @@ func (c *Client) SetHttpClient(http *http.Client) {
 func NewClient(options ...Option) *Client {
 	client := &Client{
 		http: http.DefaultClient,
+		sign: Sign,
 	}
 	for _, option := range options {
 		option(client)
@@ -38,10 +127,10 @@ func NewClient(options ...Option) *Client {
 }
 
 func (c *Client) Register(ctx context.Context,
-	url string, privateKey *rsa.PrivateKey,
+	url string, signer crypto.Signer,
 	request *RegistrationRequest,
 ) (*RegistrationResponse, error) {
-	response, err := register(ctx, c.http, url, privateKey, request)
+	response, err := register(ctx, c.http, url, c.sign, signer, request, c.ackCert)
 	if err != nil {
 		return nil, err
 	}
@@ -71,22 +160,108 @@ func (c *Client) FetchTokenWithMw(ctx context.Context, url string,
 	return response, nil
 }
 
+// SubmitReceipt validates, signs and submits a receipt. The signer is usually the
+// *rsa.PrivateKey returned by LoadCert but can be any crypto.Signer holding an
+// RSA key. Validation can be turned off
+// with WithoutReceiptValidation. When headers carry no bearer token the
+// Client's TokenSource is used. If the VFD server rejects the token with HTTP 401 or
+// 403 and the Client has a TokenSource, a new token is fetched and the same signed
+// payload is submitted once more.
 func (c *Client) SubmitReceipt(
 	ctx context.Context,
 	url string,
 	headers *RequestHeaders,
-	privateKey *rsa.PrivateKey,
+	signer crypto.Signer,
 	receipt *ReceiptRequest,
 ) (*Response, error) {
-	return submitReceipt(ctx, c.http, url, headers, privateKey, receipt)
+	payload, err := c.ReceiptBytes(signer, receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.submitReceiptPayload(ctx, url, headers, payload)
+}
+
+// ReceiptBytes returns the signed EFDMS envelope of a receipt, validated and
+// signed exactly as SubmitReceipt would before sending it: with the Client's
+// PayloadSigner and tax rates, and adjustments included.
+func (c *Client) ReceiptBytes(signer crypto.Signer, receipt *ReceiptRequest) ([]byte, error) {
+	return receiptPayload(c.sign, signer, c.taxes, receipt, !c.skipValidation)
+}
+
+// submitReceiptPayload submits a receipt signed by ReceiptBytes.
+func (c *Client) submitReceiptPayload(ctx context.Context, url string, headers *RequestHeaders,
+	payload []byte,
+) (*Response, error) {
+	return c.submit(ctx, headers, func(headers *RequestHeaders) (*Response, error) {
+		return submitReceiptPayload(ctx, c.http, url, headers, payload, c.ackCert)
+	})
 }
 
+// SubmitReport signs and submits a Z report. Tokens are handled the same way
+// as in SubmitReceipt.
 func (c *Client) SubmitReport(
 	ctx context.Context,
 	url string,
 	headers *RequestHeaders,
-	privateKey *rsa.PrivateKey,
+	signer crypto.Signer,
 	report *ReportRequest,
 ) (*Response, error) {
-	return submitReport(ctx, c.http, url, headers, privateKey, report)
+	payload, err := reportBytes(c.sign, signer, c.taxes, report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the report payload: %w", err)
+	}
+
+	return c.submit(ctx, headers, func(headers *RequestHeaders) (*Response, error) {
+		return submitReportPayload(ctx, c.http, url, headers, payload, c.ackCert)
+	})
+}
+
+// submit calls send with authorized headers. When send fails with an *AuthError
+// and the Client owns a TokenSource, the rejected token is dropped, a new one is
+// fetched and send is called one more time.
+func (c *Client) submit(ctx context.Context, headers *RequestHeaders,
+	send func(headers *RequestHeaders) (*Response, error),
+) (*Response, error) {
+	authorized, err := c.authorize(ctx, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := send(authorized)
+	authErr := &AuthError{}
+	if c.tokens == nil || !errors.As(err, &authErr) {
+		return response, err
+	}
+
+	c.tokens.invalidate(authorized.BearerToken)
+	if c.onReauth != nil {
+		c.onReauth(ctx, authErr)
+	}
+
+	authorized, err = c.authorize(ctx, &RequestHeaders{CertSerial: headers.CertSerial})
+	if err != nil {
+		return nil, err
+	}
+
+	return send(authorized)
+}
+
+// authorize returns headers with the bearer token filled in from the Client's
+// TokenSource when the caller did not supply one. The caller's headers are
+// never modified.
+func (c *Client) authorize(ctx context.Context, headers *RequestHeaders) (*RequestHeaders, error) {
+	if headers.BearerToken != "" || c.tokens == nil {
+		return headers, nil
+	}
+
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestHeaders{
+		CertSerial:  headers.CertSerial,
+		BearerToken: token,
+	}, nil
 }
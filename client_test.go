@@ -0,0 +1,89 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+const receiptAckBody = `<?xml version="1.0" encoding="UTF-8"?><EFDMS><RCTACK><RCTNUM>1</RCTNUM>` +
+	`<DATE>2023-01-01</DATE><TIME>10:00:00</TIME><ACKCODE>0</ACKCODE><ACKMSG>Success</ACKMSG></RCTACK>` +
+	`<EFDMSSIGNATURE>sig</EFDMSSIGNATURE></EFDMS>`
+
+func TestClientReauthenticatesOnExpiredToken(t *testing.T) {
+	t.Parallel()
+	var (
+		tokenCalls int32
+		payloads   [][]byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vfdtoken":
+			n := atomic.AddInt32(&tokenCalls, 1)
+			_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, n)
+		case "/api/efdmsRctInfo":
+			body, _ := io.ReadAll(r.Body)
+			payloads = append(payloads, body)
+			if r.Header.Get("Authorization") != "bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprint(w, receiptAckBody)
+		}
+	}))
+	defer server.Close()
+
+	var hooks int32
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithTokenRequest(server.URL+"/vfdtoken", &vfd.TokenRequest{}),
+		vfd.WithReauthenticateHook(func(ctx context.Context, err *vfd.AuthError) {
+			atomic.AddInt32(&hooks, 1)
+			if err.StatusCode != http.StatusUnauthorized || err.Action != vfd.SubmitReceiptAction {
+				t.Errorf("unexpected AuthError %+v", err)
+			}
+		}),
+	)
+
+	resp, err := client.SubmitReceipt(context.Background(), server.URL+"/api/efdmsRctInfo",
+		&vfd.RequestHeaders{CertSerial: "serial"}, testPrivateKey(t), testReceipt())
+	if err != nil {
+		t.Fatalf("SubmitReceipt() error = %v", err)
+	}
+	if resp.Number != 1 {
+		t.Errorf("SubmitReceipt() number = %d, want 1", resp.Number)
+	}
+	if hooks != 1 || tokenCalls != 2 {
+		t.Errorf("hooks = %d, token calls = %d, want 1 and 2", hooks, tokenCalls)
+	}
+	if len(payloads) != 2 || string(payloads[0]) != string(payloads[1]) {
+		t.Errorf("expected the same signed payload to be replayed once, got %d payloads", len(payloads))
+	}
+}
+
+func TestClientAuthErrorWithoutTokenSource(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := vfd.NewClient(vfd.WithHttpClient(server.Client()))
+	_, err := client.SubmitReceipt(context.Background(), server.URL,
+		&vfd.RequestHeaders{CertSerial: "serial", BearerToken: "expired"}, testPrivateKey(t), testReceipt())
+
+	if !errors.Is(err, vfd.ErrUnauthorized) {
+		t.Fatalf("SubmitReceipt() error = %v, want %v", err, vfd.ErrUnauthorized)
+	}
+	var authErr *vfd.AuthError
+	if !errors.As(err, &authErr) || authErr.StatusCode != http.StatusForbidden {
+		t.Errorf("SubmitReceipt() error = %#v, want *AuthError with status 403", err)
+	}
+}
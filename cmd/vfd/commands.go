@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func runRegister(ctx context.Context, c *cli, args []string) error {
+	var (
+		common  commonFlags
+		cert    certFlags
+		request vfd.RegistrationRequest
+	)
+	fs := newFlagSet(c, "register", "")
+	common.register(fs)
+	cert.register(fs)
+	fs.StringVar(&request.CertSerial, "cert-serial", "", "certificate serial sent in the Cert-Serial header")
+	fs.StringVar(&request.Tin, "tin", "", "taxpayer identification number, 9 digits without dashes")
+	fs.StringVar(&request.CertKey, "cert-key", "", "certificate key issued by TRA")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	privateKey, _, err := cert.load()
+	if err != nil {
+		return err
+	}
+	request.ContentType = vfd.ContentTypeXML
+
+	response, err := vfd.Register(ctx, common.endpoint(vfd.RegisterClientAction), privateKey, &request)
+	if err != nil {
+		return err
+	}
+
+	return c.print(common.format, response, registrationText(response))
+}
+
+func runToken(ctx context.Context, c *cli, args []string) error {
+	var (
+		common  commonFlags
+		request vfd.TokenRequest
+	)
+	fs := newFlagSet(c, "token", "")
+	common.register(fs)
+	fs.StringVar(&request.Username, "username", "", "username from the registration response")
+	fs.StringVar(&request.Password, "password", "", "password from the registration response")
+	fs.StringVar(&request.GrantType, "grant-type", "password", "grant type of the token request")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	response, err := vfd.FetchToken(ctx, common.endpoint(vfd.FetchTokenAction), &request)
+	if err != nil {
+		return err
+	}
+
+	return c.print(common.format, response, response.AccessToken)
+}
+
+func runReceiptSubmit(ctx context.Context, c *cli, args []string) error {
+	var (
+		common     commonFlags
+		cert       certFlags
+		auth       authFlags
+		dryRun     bool
+		noValidate bool
+	)
+	fs := newFlagSet(c, "receipt submit", "receipt.json")
+	common.register(fs)
+	cert.register(fs)
+	auth.register(fs)
+	fs.BoolVar(&dryRun, "dry-run", false, "print the signed EFDMS envelope instead of submitting it")
+	fs.BoolVar(&noValidate, "no-validate", false, "sign the receipt without validating it first")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	receipt := &vfd.ReceiptRequest{}
+	if err := decodeFile(fs.Arg(0), receipt); err != nil {
+		return err
+	}
+	if !noValidate {
+		if err := receipt.Validate(); err != nil {
+			return err
+		}
+	}
+
+	privateKey, _, err := cert.load()
+	if err != nil {
+		return err
+	}
+
+	// the receipt has been validated above
+	if dryRun {
+		payload, err := vfd.NewClient(vfd.WithoutReceiptValidation()).ReceiptBytes(privateKey, receipt)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.stdout, string(payload))
+		return err
+	}
+
+	client, headers, err := auth.client(&common, vfd.WithoutReceiptValidation())
+	if err != nil {
+		return err
+	}
+
+	response, err := client.SubmitReceipt(ctx, common.endpoint(vfd.SubmitReceiptAction), headers, privateKey, receipt)
+
+	return c.printResponse(common.format, response, err)
+}
+
+func runReportSubmit(ctx context.Context, c *cli, args []string) error {
+	var (
+		common commonFlags
+		cert   certFlags
+		auth   authFlags
+		dryRun bool
+	)
+	fs := newFlagSet(c, "report submit", "report.json")
+	common.register(fs)
+	cert.register(fs)
+	auth.register(fs)
+	fs.BoolVar(&dryRun, "dry-run", false, "print the signed EFDMS envelope instead of submitting it")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	report := &vfd.ReportRequest{}
+	if err := decodeFile(fs.Arg(0), report); err != nil {
+		return err
+	}
+	if report.Params == nil || report.Address == nil || report.Totals == nil {
+		return fmt.Errorf("%s: Params, Address and Totals are required", fs.Arg(0))
+	}
+
+	privateKey, _, err := cert.load()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		payload, err := vfd.ReportBytes(privateKey, report.Params, *report.Address, report.VATS,
+			report.Payment, *report.Totals)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.stdout, string(payload))
+		return err
+	}
+
+	client, headers, err := auth.client(&common)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.SubmitReport(ctx, common.endpoint(vfd.SubmitReportAction), headers, privateKey, report)
+
+	return c.printResponse(common.format, response, err)
+}
+
+func runRawSubmit(ctx context.Context, c *cli, args []string) error {
+	var (
+		common commonFlags
+		auth   authFlags
+		action string
+	)
+	fs := newFlagSet(c, "raw submit", "file.xml")
+	common.register(fs)
+	auth.register(fs)
+	fs.StringVar(&action, "action", string(vfd.SubmitReceiptAction), "what the file contains: receipt or report")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	raw := &vfd.RawRequest{
+		Env:      common.environment(),
+		Action:   vfd.Action(action),
+		FilePath: fs.Arg(0),
+		URL:      common.url,
+	}
+	if raw.Action != vfd.SubmitReceiptAction && raw.Action != vfd.SubmitReportAction {
+		return fmt.Errorf("-action must be %s or %s", vfd.SubmitReceiptAction, vfd.SubmitReportAction)
+	}
+
+	client, headers, err := auth.client(&common)
+	if err != nil {
+		return err
+	}
+	if headers.BearerToken == "" {
+		token, err := client.TokenSource().Token(ctx)
+		if err != nil {
+			return err
+		}
+		headers.BearerToken = token
+	}
+
+	response, err := vfd.SubmitRawRequest(ctx, headers, raw)
+
+	return c.printResponse(common.format, response, err)
+}
+
+func runSign(ctx context.Context, c *cli, args []string) error {
+	var cert certFlags
+	fs := newFlagSet(c, "sign", "file")
+	cert.register(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	privateKey, _, err := cert.load()
+	if err != nil {
+		return err
+	}
+
+	payload, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	signature, err := vfd.Sign(privateKey, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(c.stdout, base64.StdEncoding.EncodeToString(signature))
+	return err
+}
+
+func runVerifySignature(ctx context.Context, c *cli, args []string) error {
+	var (
+		cert      certFlags
+		pemPath   string
+		signature string
+	)
+	fs := newFlagSet(c, "verify-signature", "file")
+	cert.register(fs)
+	fs.StringVar(&pemPath, "pem", "", "`path` of a PEM certificate, used instead of -cert")
+	fs.StringVar(&signature, "signature", "",
+		"base64 signature of the whole file; when empty the file is an acknowledgement and its EFDMSSIGNATURE is checked")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	certificate, err := verificationCertificate(&cert, pemPath)
+	if err != nil {
+		return err
+	}
+
+	payload, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if signature == "" {
+		err = vfd.VerifyAckSignature(certificate, payload)
+	} else {
+		publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("certificate public key is not an RSA key")
+		}
+		err = vfd.VerifySignature(publicKey, payload, strings.TrimSpace(signature))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(c.stdout, "signature OK")
+	return err
+}
+
+func runLink(ctx context.Context, c *cli, args []string) error {
+	var (
+		common      commonFlags
+		receiptCode string
+		gc          int64
+		receiptTime string
+	)
+	fs := newFlagSet(c, "link", "")
+	common.register(fs)
+	fs.StringVar(&receiptCode, "code", "", "RECEIPTCODE from the registration response")
+	fs.Int64Var(&gc, "gc", 0, "global counter of the receipt")
+	fs.StringVar(&receiptTime, "time", "", "time of the receipt as HH:MM:SS")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if receiptCode == "" || receiptTime == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	_, err := fmt.Fprintln(c.stdout, vfd.ReceiptLink(common.environment(), receiptCode, gc, receiptTime))
+	return err
+}
+
+func verificationCertificate(cert *certFlags, pemPath string) (*x509.Certificate, error) {
+	if pemPath != "" {
+		return loadPEMCertificate(pemPath)
+	}
+
+	_, certificate, err := cert.load()
+	return certificate, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+)
+
+const (
+	formatJSON = "json"
+	formatText = "text"
+)
+
+type (
+	// commonFlags are shared by every command that talks to the VFD server.
+	commonFlags struct {
+		env    string
+		url    string
+		format string
+	}
+
+	// certFlags locate the PFX certificate issued by TRA.
+	certFlags struct {
+		path     string
+		password string
+	}
+
+	// authFlags carry what is needed to fill vfd.RequestHeaders. When token is
+	// empty a token is fetched with username and password.
+	authFlags struct {
+		certSerial string
+		token      string
+		username   string
+		password   string
+		grantType  string
+		tokenURL   string
+	}
+)
+
+func newFlagSet(c *cli, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(c.stderr, "Usage: vfd %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func (f *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.env, "env", "production", "environment: production or testing")
+	fs.StringVar(&f.url, "url", "", "endpoint `URL`, overrides the one derived from -env")
+	f.format = formatText
+	fs.Func("format", "output format: text or json (default text)", func(format string) error {
+		if format != formatText && format != formatJSON {
+			return fmt.Errorf("unknown output format %q", format)
+		}
+		f.format = format
+		return nil
+	})
+}
+
+// endpoint returns -url if set or the TRA endpoint of action for -env.
+func (f *commonFlags) endpoint(action vfd.Action) string {
+	if f.url != "" {
+		return f.url
+	}
+	return vfd.RequestURL(f.environment(), action)
+}
+
+func (f *commonFlags) environment() env.Env {
+	return env.Parse(f.env)
+}
+
+func (f *certFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.path, "cert", "", "`path` of the PFX certificate")
+	fs.StringVar(&f.password, "cert-password", "", "password of the PFX certificate")
+}
+
+func (f *certFlags) load() (*rsa.PrivateKey, *x509.Certificate, error) {
+	if f.path == "" {
+		return nil, nil, errors.New("-cert is required")
+	}
+
+	privateKey, cert, err := vfd.LoadCert(f.path, f.password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load certificate: %w", err)
+	}
+
+	return privateKey, cert, nil
+}
+
+func (f *authFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.certSerial, "cert-serial", "", "certificate serial sent in the Cert-Serial header")
+	fs.StringVar(&f.token, "token", "", "bearer token, fetched with -username and -password when empty")
+	fs.StringVar(&f.username, "username", "", "username from the registration response")
+	fs.StringVar(&f.password, "password", "", "password from the registration response")
+	fs.StringVar(&f.grantType, "grant-type", "password", "grant type of the token request")
+	fs.StringVar(&f.tokenURL, "token-url", "", "token endpoint `URL`, overrides the one derived from -env")
+}
+
+// client returns a vfd.Client and the headers to use with it. A TokenSource is
+// attached when no token was given on the command line.
+func (f *authFlags) client(common *commonFlags, options ...vfd.Option) (*vfd.Client, *vfd.RequestHeaders, error) {
+	if f.certSerial == "" {
+		return nil, nil, errors.New("-cert-serial is required")
+	}
+
+	headers := &vfd.RequestHeaders{CertSerial: f.certSerial, BearerToken: f.token}
+	if f.token != "" {
+		return vfd.NewClient(options...), headers, nil
+	}
+
+	if f.username == "" || f.password == "" {
+		return nil, nil, errors.New("either -token or -username and -password are required")
+	}
+
+	tokenURL := f.tokenURL
+	if tokenURL == "" {
+		tokenURL = vfd.RequestURL(common.environment(), vfd.FetchTokenAction)
+	}
+
+	options = append(options, vfd.WithTokenRequest(tokenURL, &vfd.TokenRequest{
+		Username:  f.username,
+		Password:  f.password,
+		GrantType: f.grantType,
+	}))
+
+	return vfd.NewClient(options...), headers, nil
+}
+
+// decodeFile decodes a receipt or a Z report into v, a *vfd.ReceiptRequest or a
+// *vfd.ReportRequest, from a .json file or from the signed EFDMS envelope of a
+// .xml file, decoded with vfd.DecodeReceipt or vfd.DecodeReport and signed again.
+func decodeFile(path string, v any) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".json" && ext != ".xml" {
+		return fmt.Errorf("%s: unsupported file type, use a .json or .xml file", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if ext == ".json" {
+		err = json.Unmarshal(data, v)
+	} else {
+		err = decodeEnvelope(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("could not decode %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// decodeEnvelope decodes the request of a signed EFDMS envelope into v.
+func decodeEnvelope(data []byte, v any) error {
+	switch v := v.(type) {
+	case *vfd.ReceiptRequest:
+		signed, err := vfd.DecodeReceipt(data)
+		if err != nil {
+			return err
+		}
+		*v = *signed.Request
+	case *vfd.ReportRequest:
+		signed, err := vfd.DecodeReport(data)
+		if err != nil {
+			return err
+		}
+		*v = *signed.Request
+	default:
+		return fmt.Errorf("can not decode an envelope into %T", v)
+	}
+	return nil
+}
+
+// loadPEMCertificate reads the first certificate of a PEM file.
+func loadPEMCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no certificate found", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// parse parses args with fs and checks that exactly n positional arguments remain.
+// Invalid flags have already been reported by fs and are returned as errUsage.
+func parse(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return err
+	} else if err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() != n {
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
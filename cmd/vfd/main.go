@@ -0,0 +1,132 @@
+// Command vfd drives the whole lifecycle of a Virtual Fiscal Device from the command
+// line: registration, token fetching, receipt and Z report submission, submission of
+// raw XML files, signing and signature verification and receipt verification links.
+//
+// Usage:
+//
+//	vfd <command> [flags] [args]
+//
+// Run "vfd help" for the list of commands and "vfd <command> -h" for their flags.
+//
+// Receipts and Z reports are read from JSON files holding a vfd.ReceiptRequest or a
+// vfd.ReportRequest, with the Go field names as keys:
+//
+//	{
+//	  "Params": {"Date": "2023-01-01", "Time": "10:00:00", "TIN": "123456789", ...},
+//	  "Customer": {"Type": 6},
+//	  "Items": [{"ID": "1", "Description": "Soap", "TaxCode": 1, "Quantity": 2, "UnitPrice": 1500}],
+//	  "Payments": [{"Type": "CASH", "Amount": 3000}]
+//	}
+//
+// They can also be read from .xml files holding a signed EFDMS envelope, whose receipt
+// or report is decoded and signed again. Signed envelopes are submitted unchanged with
+// raw submit.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+type (
+	// command is a subcommand of the CLI. run receives the arguments that follow
+	// the command name.
+	command struct {
+		usage string
+		run   func(ctx context.Context, cli *cli, args []string) error
+	}
+
+	cli struct {
+		stdout io.Writer
+		stderr io.Writer
+	}
+)
+
+// errUsage is returned by commands when they were invoked incorrectly. The usage
+// of the command has already been printed.
+var errUsage = errors.New("usage error")
+
+var commands = map[string]command{
+	"register":         {"register a VFD and print the registration response", runRegister},
+	"token":            {"fetch an access token", runToken},
+	"receipt submit":   {"sign and submit a receipt read from a JSON or XML file", runReceiptSubmit},
+	"report submit":    {"sign and submit a Z report read from a JSON or XML file", runReportSubmit},
+	"raw submit":       {"submit a signed EFDMS XML file as is", runRawSubmit},
+	"sign":             {"sign a file and print the base64 signature", runSign},
+	"verify-signature": {"verify a signature or the EFDMSSIGNATURE of an acknowledgement", runVerifySignature},
+	"link":             {"print the receipt verification link", runLink},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run executes the command in args and returns the process exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage()
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+
+	name, rest := args[0], args[1:]
+	cmd, ok := commands[name]
+	if !ok && len(rest) > 0 {
+		name = args[0] + " " + args[1]
+		cmd, ok = commands[name]
+		rest = args[2:]
+	}
+	if !ok {
+		_, _ = fmt.Fprintf(stderr, "vfd: unknown command %q\n\n", strings.Join(args[:minInt(len(args), 2)], " "))
+		c.usage()
+		return 2
+	}
+
+	if err := cmd.run(ctx, c, rest); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		_, _ = fmt.Fprintf(stderr, "vfd %s: %v\n", name, err)
+		return 1
+	}
+
+	return 0
+}
+
+func (c *cli) usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, _ = fmt.Fprintln(c.stderr, "Usage: vfd <command> [flags] [args]")
+	_, _ = fmt.Fprintln(c.stderr)
+	_, _ = fmt.Fprintln(c.stderr, "Commands:")
+	for _, name := range names {
+		_, _ = fmt.Fprintf(c.stderr, "  %-18s %s\n", name, commands[name].usage)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
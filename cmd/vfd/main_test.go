@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func runCLI(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return stdout.String(), stderr.String(), code
+}
+
+func writePFX(t *testing.T, dir, password string) string {
+	t.Helper()
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := pkcs12.Encode(rand.Reader, key, cert, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "cert.pfx")
+	if err := os.WriteFile(path, pfx, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	pfx := writePFX(t, dir, "secret")
+	key, cert, err := vfd.LoadCert(pfx, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vfdtest.NewServer()
+	defer server.Close()
+	server.AddDevice(vfdtest.Device{
+		TIN:         "123456789",
+		CertKey:     "10TZ101234",
+		CertSerial:  "4bd3a9c1",
+		Certificate: cert,
+	})
+
+	stdout, stderr, code := runCLI(t, "register", "-format", "json",
+		"-url", server.RequestURL(env.PROD, vfd.RegisterClientAction),
+		"-cert", pfx, "-cert-password", "secret",
+		"-cert-serial", "4bd3a9c1", "-tin", "123456789", "-cert-key", "10TZ101234")
+	if code != 0 {
+		t.Fatalf("register exit code = %d, stderr = %s", code, stderr)
+	}
+	var reg vfd.RegistrationResponse
+	if err := json.Unmarshal([]byte(stdout), &reg); err != nil {
+		t.Fatalf("register output: %v\n%s", err, stdout)
+	}
+
+	stdout, stderr, code = runCLI(t, "token",
+		"-url", server.RequestURL(env.PROD, vfd.FetchTokenAction),
+		"-username", reg.USERNAME, "-password", reg.PASSWORD)
+	if code != 0 || strings.TrimSpace(stdout) == "" {
+		t.Fatalf("token exit code = %d, stdout = %q, stderr = %s", code, stdout, stderr)
+	}
+
+	receipt := vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date: "2023-01-01", Time: "10:00:00", TIN: reg.TIN, RegistrationID: reg.REGID,
+			EFDSerial: reg.SERIAL, ReceiptNum: "1", DailyCounter: 1, GlobalCounter: 1,
+			ZNum: "20230101", ReceiptVNum: reg.RECEIPTCODE + "1",
+		},
+		Customer: vfd.Customer{Type: vfd.NonCustomerID},
+		Items:    []vfd.Item{{ID: "1", Description: "Soap", TaxCode: 1, Quantity: 2, UnitPrice: 1500}},
+		Payments: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 3000}},
+	}
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptPath := filepath.Join(dir, "receipt.json")
+	if err := os.WriteFile(receiptPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code = runCLI(t, "receipt", "submit", "-format", "json",
+		"-url", server.RequestURL(env.PROD, vfd.SubmitReceiptAction),
+		"-token-url", server.RequestURL(env.PROD, vfd.FetchTokenAction),
+		"-cert", pfx, "-cert-password", "secret", "-cert-serial", "4bd3a9c1",
+		"-username", reg.USERNAME, "-password", reg.PASSWORD, receiptPath)
+	if code != 0 {
+		t.Fatalf("receipt submit exit code = %d, stderr = %s", code, stderr)
+	}
+	var ack vfd.Response
+	if err := json.Unmarshal([]byte(stdout), &ack); err != nil {
+		t.Fatalf("receipt submit output: %v\n%s", err, stdout)
+	}
+	if !vfd.IsSuccess(ack.Code) || ack.Number != 1 {
+		t.Errorf("receipt submit ack = %+v", ack)
+	}
+	if got := len(server.Receipts()); got != 1 {
+		t.Errorf("server received %d receipts, want 1", got)
+	}
+
+	receipt.Params.ReceiptNum, receipt.Params.DailyCounter, receipt.Params.GlobalCounter = "2", 2, 2
+	receipt.Params.ReceiptVNum = reg.RECEIPTCODE + "2"
+	envelope, err := vfd.NewClient().ReceiptBytes(key, &receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopePath := filepath.Join(dir, "receipt.xml")
+	if err := os.WriteFile(envelopePath, envelope, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code = runCLI(t, "receipt", "submit", "-format", "json",
+		"-url", server.RequestURL(env.PROD, vfd.SubmitReceiptAction),
+		"-token-url", server.RequestURL(env.PROD, vfd.FetchTokenAction),
+		"-cert", pfx, "-cert-password", "secret", "-cert-serial", "4bd3a9c1",
+		"-username", reg.USERNAME, "-password", reg.PASSWORD, envelopePath)
+	if code != 0 {
+		t.Fatalf("receipt submit of an .xml file exit code = %d, stderr = %s", code, stderr)
+	}
+	if err := json.Unmarshal([]byte(stdout), &ack); err != nil {
+		t.Fatalf("receipt submit output: %v\n%s", err, stdout)
+	}
+	if !vfd.IsSuccess(ack.Code) || ack.Number != 2 {
+		t.Errorf("receipt submit of an .xml file ack = %+v", ack)
+	}
+	receipts := server.Receipts()
+	if len(receipts) != 2 || !bytes.Equal(receipts[1].Envelope, envelope) {
+		t.Errorf("server received %d receipts, want 2 with the .xml envelope signed again as is", len(receipts))
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	pfx := writePFX(t, dir, "")
+	file := filepath.Join(dir, "payload.txt")
+	if err := os.WriteFile(file, []byte("<RCT>payload</RCT>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, stderr, code := runCLI(t, "sign", "-cert", pfx, file)
+	if code != 0 {
+		t.Fatalf("sign exit code = %d, stderr = %s", code, stderr)
+	}
+
+	stdout, stderr, code := runCLI(t, "verify-signature", "-cert", pfx, "-signature", signature, file)
+	if code != 0 || !strings.Contains(stdout, "OK") {
+		t.Fatalf("verify-signature exit code = %d, stdout = %q, stderr = %s", code, stdout, stderr)
+	}
+
+	if err := os.WriteFile(file, []byte("<RCT>tampered</RCT>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, code = runCLI(t, "verify-signature", "-cert", pfx, "-signature", signature, file); code != 1 {
+		t.Errorf("verify-signature of a tampered file exit code = %d, want 1", code)
+	}
+}
+
+func TestLink(t *testing.T) {
+	stdout, _, code := runCLI(t, "link", "-env", "testing", "-code", "9FA1E5", "-gc", "1", "-time", "10:00:00")
+	want := vfd.ReceiptLink(env.TEST, "9FA1E5", 1, "10:00:00")
+	if code != 0 || strings.TrimSpace(stdout) != want {
+		t.Errorf("link = %q (exit code %d), want %q", stdout, code, want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, 2},
+		{[]string{"help"}, 0},
+		{[]string{"unknown"}, 2},
+		{[]string{"receipt"}, 2},
+		{[]string{"link", "-h"}, 0},
+		{[]string{"sign"}, 2},
+	}
+	for _, tt := range tests {
+		if _, _, code := runCLI(t, tt.args...); code != tt.code {
+			t.Errorf("vfd %v exit code = %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}
+
+func TestReceiptSubmitChecksInputFirst(t *testing.T) {
+	dir := t.TempDir()
+	pfx := writePFX(t, dir, "secret")
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	receiptPath := filepath.Join(dir, "receipt.json")
+	if err := os.WriteFile(receiptPath, []byte(`{"Params": {"GlobalCounter": 1}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	envelopePath := filepath.Join(dir, "receipt.xml")
+	if err := os.WriteFile(envelopePath, []byte(`<EFDMS><RCT/></EFDMS>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	csvPath := filepath.Join(dir, "receipt.csv")
+	if err := os.WriteFile(csvPath, []byte("1,Soap,3000"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(format, path string) (string, int) {
+		_, stderr, code := runCLI(t, "receipt", "submit", "-format", format, "-url", server.URL,
+			"-cert", pfx, "-cert-password", "secret", "-cert-serial", "4bd3a9c1", "-token", "token",
+			"-no-validate", path)
+		return stderr, code
+	}
+
+	if stderr, code := submit("jsno", receiptPath); code != 2 || !strings.Contains(stderr, `unknown output format "jsno"`) {
+		t.Errorf("receipt submit -format jsno exit code = %d, stderr = %s, want 2", code, stderr)
+	}
+	if stderr, code := submit(formatJSON, envelopePath); code != 1 || !strings.Contains(stderr, "could not decode") {
+		t.Errorf("receipt submit of an unsigned .xml file exit code = %d, stderr = %s, want 1", code, stderr)
+	}
+	if stderr, code := submit(formatJSON, csvPath); code != 1 || !strings.Contains(stderr, "unsupported file type") {
+		t.Errorf("receipt submit of a .csv file exit code = %d, stderr = %s, want 1", code, stderr)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("server received %d requests, want none", n)
+	}
+}
+
+func TestReceiptSubmitDryRunKeepsAdjustments(t *testing.T) {
+	dir := t.TempDir()
+	pfx := writePFX(t, dir, "secret")
+
+	receipt := vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date: "2023-01-01", Time: "10:00:00", TIN: "123456789", DailyCounter: 1, GlobalCounter: 1,
+		},
+		Customer:    vfd.Customer{Type: vfd.NonCustomerID},
+		Items:       []vfd.Item{{ID: "1", Description: "Soap", TaxCode: 1, Quantity: 2, UnitPrice: 1500}},
+		Payments:    []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 2700}},
+		Adjustments: []vfd.Adjustment{{Type: vfd.DiscountAdjustment, Description: "10% OFF", Percentage: 10}},
+	}
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptPath := filepath.Join(dir, "receipt.json")
+	if err := os.WriteFile(receiptPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runCLI(t, "receipt", "submit", "-dry-run",
+		"-cert", pfx, "-cert-password", "secret", receiptPath)
+	if code != 0 {
+		t.Fatalf("receipt submit -dry-run exit code = %d, stderr = %s", code, stderr)
+	}
+	signed, err := vfd.DecodeReceipt([]byte(stdout))
+	if err != nil {
+		t.Fatalf("receipt submit -dry-run output: %v\n%s", err, stdout)
+	}
+	if !bytes.Contains(signed.Payload, []byte("<DISCOUNT>300.00</DISCOUNT>")) {
+		t.Errorf("receipt submit -dry-run payload %s does not carry the discount of the adjustment", signed.Payload)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vfdcloud/vfd"
+)
+
+// print writes v as indented JSON when format is json and text otherwise. The
+// format was checked when the flags were parsed.
+func (c *cli) print(format string, v any, text string) error {
+	if format == formatJSON {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	_, err := fmt.Fprintln(c.stdout, text)
+	return err
+}
+
+// printResponse prints the acknowledgement of a receipt or Z report submission
+// and returns err, which is an *vfd.AckError when the submission was rejected.
+func (c *cli) printResponse(format string, response *vfd.Response, err error) error {
+	if response == nil {
+		return err
+	}
+
+	text := fmt.Sprintf("number:  %d\ndate:    %s\ntime:    %s\ncode:    %d\nmessage: %s",
+		response.Number, response.Date, response.Time, response.Code, response.Message)
+	if perr := c.print(format, response, text); perr != nil {
+		return perr
+	}
+
+	return err
+}
+
+func registrationText(r *vfd.RegistrationResponse) string {
+	return fmt.Sprintf(`ack code:     %s
+ack message:  %s
+reg id:       %s
+serial:       %s
+uin:          %s
+tin:          %s
+vrn:          %s
+name:         %s
+receipt code: %s
+gc:           %d
+username:     %s
+password:     %s
+token path:   %s
+tax codes:    A=%s B=%s C=%s D=%s`,
+		r.ACKCODE, r.ACKMSG, r.REGID, r.SERIAL, r.UIN, r.TIN, r.VRN, r.NAME, r.RECEIPTCODE, r.GC,
+		r.USERNAME, r.PASSWORD, r.TOKENPATH, r.TAXCODES.CODEA, r.TAXCODES.CODEB, r.TAXCODES.CODEC, r.TAXCODES.CODED)
+}
@@ -0,0 +1,173 @@
+package vfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ZNumLayout is the layout of the ZNUM, the date of the Z report a receipt belongs to.
+const ZNumLayout = "20060102"
+
+// ErrCountersNotSeeded is returned when counters are allocated before Seed was
+// called with the registration response.
+var ErrCountersNotSeeded = errors.New("counters not seeded with registration response")
+
+type (
+	// CounterState is the persisted state of the fiscal counters of a single VFD.
+	// GC and DC are the last allocated global and daily counters and ZNum is the
+	// day (YYYYMMDD) the last receipt was issued.
+	CounterState struct {
+		ReceiptCode string `json:"receipt_code"`
+		GC          int64  `json:"gc"`
+		DC          int64  `json:"dc"`
+		ZNum        string `json:"znum"`
+	}
+
+	// CounterStore persists CounterState. Update must load the current state, call fn
+	// with it and save the state if fn returns nil, all while holding a lock so that
+	// no two updates interleave. A Device signs its receipts in fn, which can take a
+	// while with a remote signer, so the lock must not expire while fn runs.
+	CounterStore interface {
+		Update(ctx context.Context, fn func(state *CounterState) error) error
+	}
+
+	// ReceiptCounters are the counters allocated to a single receipt.
+	ReceiptCounters struct {
+		GlobalCounter int64
+		DailyCounter  int64
+		ZNum          string
+		ReceiptNum    string
+		ReceiptVNum   string
+	}
+
+	// Counters allocates the GC, DC, ZNUM, RCTNUM and RCTVNUM of receipts. The global
+	// counter continues from RegistrationResponse.GC and never repeats, the daily
+	// counter restarts at 1 on the first receipt of every day.
+	Counters struct {
+		store CounterStore
+	}
+
+	// MemoryCounterStore keeps CounterState in memory. It is safe for concurrent
+	// use but the state is lost when the process exits.
+	MemoryCounterStore struct {
+		mu    sync.Mutex
+		state CounterState
+	}
+)
+
+// NewCounters creates Counters backed by store.
+func NewCounters(store CounterStore) *Counters {
+	return &Counters{store: store}
+}
+
+// Seed initializes the counters from the registration response. The global counter
+// is only moved forward so that seeding an already used store with an older
+// registration response does not reissue counters.
+func (c *Counters) Seed(ctx context.Context, registration *RegistrationResponse) error {
+	return c.store.Update(ctx, func(state *CounterState) error {
+		state.ReceiptCode = registration.RECEIPTCODE
+		if registration.GC > state.GC {
+			state.GC = registration.GC
+		}
+		return nil
+	})
+}
+
+// Next allocates the counters of a receipt issued at t. When t falls on a later day
+// than the previous receipt the daily counter restarts at 1.
+func (c *Counters) Next(ctx context.Context, t time.Time) (*ReceiptCounters, error) {
+	return c.next(ctx, t, nil)
+}
+
+// next allocates the counters of a receipt issued at t and calls use with them
+// before they are saved. When use returns an error the counters are not used
+// up and the error is returned as is.
+func (c *Counters) next(ctx context.Context, t time.Time, use func(counters *ReceiptCounters) error) (
+	*ReceiptCounters, error,
+) {
+	var (
+		counters *ReceiptCounters
+		useErr   error
+	)
+	err := c.store.Update(ctx, func(state *CounterState) error {
+		if state.ReceiptCode == "" {
+			return ErrCountersNotSeeded
+		}
+
+		day := t.Format(ZNumLayout)
+		if day > state.ZNum {
+			state.ZNum = day
+			state.DC = 0
+		}
+		state.GC++
+		state.DC++
+		counters = &ReceiptCounters{
+			GlobalCounter: state.GC,
+			DailyCounter:  state.DC,
+			ZNum:          state.ZNum,
+			ReceiptNum:    strconv.FormatInt(state.GC, 10),
+			ReceiptVNum:   fmt.Sprintf("%s%d", state.ReceiptCode, state.GC),
+		}
+		if use != nil {
+			useErr = use(counters)
+		}
+		return useErr
+	})
+	if useErr != nil {
+		return nil, useErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate counters: %w", err)
+	}
+
+	return counters, nil
+}
+
+// State returns a copy of the current counter state.
+func (c *Counters) State(ctx context.Context) (*CounterState, error) {
+	var current CounterState
+	err := c.store.Update(ctx, func(state *CounterState) error {
+		current = *state
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &current, nil
+}
+
+// Apply copies the counters into params.
+func (rc *ReceiptCounters) Apply(params *ReceiptParams) {
+	params.GlobalCounter = rc.GlobalCounter
+	params.DailyCounter = rc.DailyCounter
+	params.ZNum = rc.ZNum
+	params.ReceiptNum = rc.ReceiptNum
+	params.ReceiptVNum = rc.ReceiptVNum
+}
+
+// NewMemoryCounterStore creates an empty MemoryCounterStore.
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{}
+}
+
+func (s *MemoryCounterStore) Update(ctx context.Context, fn func(state *CounterState) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.state
+	if err := fn(&state); err != nil {
+		return err
+	}
+	s.state = state
+
+	return nil
+}
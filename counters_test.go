@@ -0,0 +1,172 @@
+package vfd_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestCountersNext(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	counters := vfd.NewCounters(vfd.NewMemoryCounterStore())
+
+	if _, err := counters.Next(ctx, time.Now()); !errors.Is(err, vfd.ErrCountersNotSeeded) {
+		t.Fatalf("Next() before Seed error = %v, want %v", err, vfd.ErrCountersNotSeeded)
+	}
+
+	err := counters.Seed(ctx, &vfd.RegistrationResponse{RECEIPTCODE: "ABC123", GC: 41})
+	if err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+
+	day1 := time.Date(2023, 3, 14, 23, 59, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Minute)
+	tests := []struct {
+		at   time.Time
+		want vfd.ReceiptCounters
+	}{
+		{day1, vfd.ReceiptCounters{GlobalCounter: 42, DailyCounter: 1, ZNum: "20230314", ReceiptNum: "42", ReceiptVNum: "ABC12342"}},
+		{day1, vfd.ReceiptCounters{GlobalCounter: 43, DailyCounter: 2, ZNum: "20230314", ReceiptNum: "43", ReceiptVNum: "ABC12343"}},
+		{day2, vfd.ReceiptCounters{GlobalCounter: 44, DailyCounter: 1, ZNum: "20230315", ReceiptNum: "44", ReceiptVNum: "ABC12344"}},
+		{day1, vfd.ReceiptCounters{GlobalCounter: 45, DailyCounter: 2, ZNum: "20230315", ReceiptNum: "45", ReceiptVNum: "ABC12345"}},
+	}
+	for i, tt := range tests {
+		got, err := counters.Next(ctx, tt.at)
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if *got != tt.want {
+			t.Errorf("Next() #%d = %+v, want %+v", i, *got, tt.want)
+		}
+	}
+
+	// seeding again with the stale registration response must not move GC back
+	if err := counters.Seed(ctx, &vfd.RegistrationResponse{RECEIPTCODE: "ABC123", GC: 41}); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+	state, _ := counters.State(ctx)
+	if state.GC != 45 {
+		t.Errorf("State().GC = %d, want 45", state.GC)
+	}
+}
+
+func TestFileCounterStoreConcurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "counters.json")
+
+	seed := vfd.NewCounters(vfd.NewFileCounterStore(path))
+	if err := seed.Seed(ctx, &vfd.RegistrationResponse{RECEIPTCODE: "X", GC: 0}); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = map[int64]bool{}
+	)
+	for i := 0; i < 4; i++ {
+		// every goroutine uses its own store to mimic separate devices sharing a file
+		counters := vfd.NewCounters(vfd.NewFileCounterStore(path))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				next, err := counters.Next(ctx, time.Now())
+				if err != nil {
+					t.Errorf("Next() error = %v", err)
+					return
+				}
+				mu.Lock()
+				if seen[next.GlobalCounter] {
+					t.Errorf("GC %d allocated twice", next.GlobalCounter)
+				}
+				seen[next.GlobalCounter] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := vfd.NewCounters(vfd.NewFileCounterStore(path)).State(ctx)
+	if err != nil {
+		t.Fatalf("State() error = %v", err)
+	}
+	if state.GC != 100 || len(seen) != 100 {
+		t.Errorf("GC = %d, unique = %d, want 100", state.GC, len(seen))
+	}
+}
+
+func TestFileCounterStoreAcrossProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns helper processes")
+	}
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "counters.json")
+	if err := vfd.NewCounters(vfd.NewFileCounterStore(path)).Seed(ctx, &vfd.RegistrationResponse{RECEIPTCODE: "X"}); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+
+	const processes, perProcess = 3, 20
+	outputs := make([]*bytes.Buffer, processes)
+	commands := make([]*exec.Cmd, processes)
+	for i := range commands {
+		outputs[i] = new(bytes.Buffer)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCountersHelperProcess$")
+		cmd.Env = append(os.Environ(), "VFD_COUNTERS_HELPER="+path, fmt.Sprintf("VFD_COUNTERS_N=%d", perProcess))
+		cmd.Stdout = outputs[i]
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("could not start helper: %v", err)
+		}
+		commands[i] = cmd
+	}
+
+	seen := map[int64]bool{}
+	for i, cmd := range commands {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("helper failed: %v", err)
+		}
+		scanner := bufio.NewScanner(outputs[i])
+		for scanner.Scan() {
+			gc, err := strconv.ParseInt(scanner.Text(), 10, 64)
+			if err != nil {
+				continue
+			}
+			if seen[gc] {
+				t.Errorf("GC %d allocated twice", gc)
+			}
+			seen[gc] = true
+		}
+	}
+	if len(seen) != processes*perProcess {
+		t.Errorf("allocated %d unique counters, want %d", len(seen), processes*perProcess)
+	}
+}
+
+func TestCountersHelperProcess(t *testing.T) {
+	path := os.Getenv("VFD_COUNTERS_HELPER")
+	if path == "" {
+		t.Skip("helper process")
+	}
+	n, _ := strconv.Atoi(os.Getenv("VFD_COUNTERS_N"))
+	counters := vfd.NewCounters(vfd.NewFileCounterStore(path))
+	for i := 0; i < n; i++ {
+		next, err := counters.Next(context.Background(), time.Now())
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		fmt.Println(next.GlobalCounter)
+	}
+}
@@ -0,0 +1,93 @@
+package vfd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileCounterStore keeps CounterState as JSON in a file. Updates hold an exclusive
+// lock on a sibling ".lock" file, which makes the store safe to share between
+// goroutines and between processes on the same host.
+type FileCounterStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileCounterStore creates a FileCounterStore that persists the state in path.
+// The file is created on the first update.
+func NewFileCounterStore(path string) *FileCounterStore {
+	return &FileCounterStore{path: path}
+}
+
+func (s *FileCounterStore) Update(ctx context.Context, fn func(state *CounterState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockPath(ctx, s.path+".lock")
+	if err != nil {
+		return fmt.Errorf("could not lock counters: %w", err)
+	}
+	defer unlock()
+
+	state := CounterState{}
+	data, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("could not decode counters %s: %w", s.path, err)
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("could not read counters: %w", err)
+	}
+
+	if err := fn(&state); err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(&state)
+	if err != nil {
+		return fmt.Errorf("could not encode counters: %w", err)
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames
+// it over path so that readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileWith(path, data, os.Rename)
+}
+
+// writeFileExclusive is like writeFileAtomic but fails with an error matching
+// os.ErrExist when path already exists.
+func writeFileExclusive(path string, data []byte) error {
+	return writeFileWith(path, data, os.Link)
+}
+
+// writeFileWith writes data to a temporary file next to path and moves it in
+// place with commit.
+func writeFileWith(path string, data []byte, commit func(tmp, path string) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return commit(tmp.Name(), path)
+}
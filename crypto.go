@@ -7,12 +7,20 @@ import (
 	"crypto/sha1" //nolint:gosec
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/vfdcloud/vfd/internal/element"
 	"software.sslmate.com/src/go-pkcs12"
 )
 
+// ErrInvalidAckSignature is returned when the EFDMSSIGNATURE of an acknowledgement
+// from the VFD server does not verify against the configured certificate.
+var ErrInvalidAckSignature = errors.New("invalid acknowledgement signature")
+
 type (
 	// CertLoader loads a certificate from a file and returns the private key and the certificate
 	CertLoader func(certPath string, certPassword string) (*rsa.PrivateKey, *x509.Certificate, error)
@@ -22,8 +30,9 @@ type (
 	SignatureVerifier func(publicKey *rsa.PublicKey, payload []byte, signature string) error
 
 	// PayloadSigner signs a payload using the private key of the signing certificate
-	// all requests to the VFD API must be signed.
-	PayloadSigner func(privateKey *rsa.PrivateKey, payload []byte) ([]byte, error)
+	// all requests to the VFD API must be signed. Sign and SignPayload are
+	// PayloadSigners, a Client uses another one given with WithPayloadSigner.
+	PayloadSigner func(signer crypto.Signer, payload []byte) ([]byte, error)
 )
 
 func LoadCertChain(certPath string, certPassword string) (*rsa.PrivateKey, *x509.Certificate, []*x509.Certificate, error) {
@@ -71,14 +80,23 @@ func LoadCert(path, password string) (*rsa.PrivateKey, *x509.Certificate, error)
 	return privateKey, cert, nil
 }
 
-func Sign(privateKey *rsa.PrivateKey, payload []byte) ([]byte, error) {
-	signature, err := signPayload(privateKey, payload)
+// Sign signs the SHA1 digest of payload with PKCS #1 v1.5 and checks the
+// signature against the public key of signer. signer is usually the
+// *rsa.PrivateKey returned by LoadCert, but can be any crypto.Signer with an
+// RSA key, for example one backed by a PKCS #11 module or a signing service.
+func Sign(signer crypto.Signer, payload []byte) ([]byte, error) {
+	publicKey, err := signerPublicKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signPayload(signer, payload)
 	if err != nil {
 		return nil, fmt.Errorf("unable to sign the payload: %w", err)
 	}
 
 	hash := sha1.Sum(payload) //nolint:gosec
-	err = verifySignature(&privateKey.PublicKey, hash[:], signature)
+	err = verifySignature(publicKey, hash[:], signature)
 	if err != nil {
 		return nil, fmt.Errorf("could not verify signature %w", err)
 	}
@@ -101,13 +119,18 @@ func VerifySignature(publicKey *rsa.PublicKey, payload []byte, signature string)
 	return nil
 }
 
-func SignPayload(privateKey *rsa.PrivateKey, payload []byte) ([]byte, error) {
-	out, err := signPayload(privateKey, payload)
+func SignPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	publicKey, err := signerPublicKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := signPayload(signer, payload)
 	if err != nil {
 		return nil, fmt.Errorf("unable to sign the payload: %w", err)
 	}
 
-	err = VerifySignature(&privateKey.PublicKey, payload, base64.StdEncoding.EncodeToString(out))
+	err = VerifySignature(publicKey, payload, base64.StdEncoding.EncodeToString(out))
 	if err != nil {
 		return nil, fmt.Errorf("invalid signature %w", err)
 	}
@@ -115,11 +138,12 @@ func SignPayload(privateKey *rsa.PrivateKey, payload []byte) ([]byte, error) {
 	return out, nil
 }
 
-func signPayload(pub *rsa.PrivateKey, payload []byte) ([]byte, error) {
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
 	hasher := crypto.SHA1.New()
 	hasher.Write(payload)
 
-	out, err := rsa.SignPKCS1v15(rand.Reader, pub, crypto.SHA1, hasher.Sum(nil))
+	// crypto.SHA1 as SignerOpts selects PKCS #1 v1.5 for RSA signers.
+	out, err := signer.Sign(rand.Reader, hasher.Sum(nil), crypto.SHA1)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +151,19 @@ func signPayload(pub *rsa.PrivateKey, payload []byte) ([]byte, error) {
 	return out, nil
 }
 
+// signerPublicKey returns the RSA public key of signer, the VFD server only
+// accepts RSA signatures.
+func signerPublicKey(signer crypto.Signer) (*rsa.PublicKey, error) {
+	if signer == nil {
+		return nil, errors.New("no signer to sign the payload with")
+	}
+	publicKey, ok := signer.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signer public key is of type %T, not *rsa.PublicKey", signer.Public())
+	}
+	return publicKey, nil
+}
+
 func ParsePfxCertificate(certPath string, password string) (*rsa.PrivateKey, *x509.Certificate, error) {
 	buf, err := os.ReadFile(certPath)
 	if err != nil {
@@ -149,3 +186,76 @@ func ParsePfxCertificate(certPath string, password string) (*rsa.PrivateKey, *x5
 func verifySignature(pub *rsa.PublicKey, hash []byte, sig []byte) error {
 	return rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash, sig)
 }
+
+// ackElements are the names of the signed elements of the acknowledgements sent
+// by the VFD server after registration, receipt and Z report submission.
+var ackElements = []string{"RCTACK", "ZACK", "EFDMSRESP"}
+
+// VerifyAckSignature verifies the EFDMSSIGNATURE of an acknowledgement sent by the
+// VFD server. The signature is checked over the exact bytes of the RCTACK, ZACK or
+// EFDMSRESP element in body using the public key of cert, which is the certificate
+// TRA signs acknowledgements with. A body with more than one of these elements is
+// rejected. The returned error wraps ErrInvalidAckSignature.
+func VerifyAckSignature(cert *x509.Certificate, body []byte) error {
+	var names []string
+	for _, name := range ackElements {
+		_, err := element.Bytes(body, name)
+		if !errors.Is(err, element.ErrNotFound) {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 {
+		return fmt.Errorf("%w: found %d signed elements, want 1", ErrInvalidAckSignature, len(names))
+	}
+
+	_, err := verifiedAck(cert, body, names[0])
+	return err
+}
+
+// verifiedAck returns the bytes of the element name of an acknowledgement after
+// checking its EFDMSSIGNATURE with the public key of cert.
+func verifiedAck(cert *x509.Certificate, body []byte, name string) ([]byte, error) {
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: certificate public key is not of type *rsa.PublicKey", ErrInvalidAckSignature)
+	}
+
+	payload, err := element.Bytes(body, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAckSignature, err)
+	}
+	signature, err := element.Bytes(body, "EFDMSSIGNATURE")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAckSignature, err)
+	}
+	var value string
+	if err := xml.Unmarshal(signature, &value); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAckSignature, err)
+	}
+
+	if err := VerifySignature(publicKey, payload, strings.TrimSpace(value)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAckSignature, err)
+	}
+
+	return payload, nil
+}
+
+// decodeAck decodes the element name of an acknowledgement into v. When cert is
+// not nil the element is verified with verifiedAck first, and only the bytes that
+// were verified are decoded.
+func decodeAck(cert *x509.Certificate, body []byte, name string, v any) error {
+	var (
+		payload []byte
+		err     error
+	)
+	if cert != nil {
+		payload, err = verifiedAck(cert, body, name)
+	} else {
+		payload, err = element.Bytes(body, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return xml.Unmarshal(payload, v)
+}
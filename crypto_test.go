@@ -0,0 +1,176 @@
+package vfd_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+// remoteSigner stands in for a key held by a PKCS #11 module or a signing
+// service: it only exposes the public key and counts the signatures it makes.
+type remoteSigner struct {
+	key   *rsa.PrivateKey
+	signs int32
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *remoteSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	atomic.AddInt32(&s.signs, 1)
+	return s.key.Sign(rand, digest, opts)
+}
+
+func TestClientVerifiesAckSignature(t *testing.T) {
+	t.Parallel()
+	traKey, traCert := testCertificate(t)
+	_, otherCert := testCertificate(t)
+
+	const ack = `<RCTACK><RCTNUM>1</RCTNUM><DATE>2023-01-01</DATE><TIME>10:00:00</TIME>` +
+		`<ACKCODE>0</ACKCODE><ACKMSG>Success</ACKMSG></RCTACK>`
+	signature, err := vfd.Sign(traKey, []byte(ack))
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>`,
+		ack, base64.StdEncoding.EncodeToString(signature))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tampered":
+			_, _ = fmt.Fprint(w, strings.Replace(body, "<RCTNUM>1<", "<RCTNUM>2<", 1))
+			return
+		case "/forged":
+			// The signed ack is kept and a forged one is appended after it.
+			forged := strings.Replace(ack, "<RCTNUM>1<", "<RCTNUM>2<", 1)
+			_, _ = fmt.Fprint(w, strings.Replace(body, "</EFDMS>", forged+"</EFDMS>", 1))
+			return
+		}
+		_, _ = fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		client  *vfd.Client
+		wantErr error
+	}{
+		{"valid signature", "/", vfd.NewClient(vfd.WithAckCertificate(traCert)), nil},
+		{"tampered ack", "/tampered", vfd.NewClient(vfd.WithAckCertificate(traCert)), vfd.ErrInvalidAckSignature},
+		{"forged ack after the signed one", "/forged", vfd.NewClient(vfd.WithAckCertificate(traCert)), vfd.ErrInvalidAckSignature},
+		{"wrong certificate", "/", vfd.NewClient(vfd.WithAckCertificate(otherCert)), vfd.ErrInvalidAckSignature},
+		{"verification disabled", "/tampered", vfd.NewClient(), nil},
+	}
+	privateKey := testPrivateKey(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := &vfd.RequestHeaders{CertSerial: "serial", BearerToken: "token"}
+			_, err := tt.client.SubmitReceipt(context.Background(), server.URL+tt.path, headers, privateKey, testReceipt())
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("SubmitReceipt() error = %v, want %v", err, tt.wantErr)
+			}
+			unreadable := &vfd.UnreadableAckError{}
+			if tt.wantErr != nil && (!errors.As(err, &unreadable) || len(unreadable.Body) == 0) {
+				t.Errorf("SubmitReceipt() error = %#v, want an *UnreadableAckError with the answer", err)
+			}
+		})
+	}
+}
+
+func TestSignWithCryptoSigner(t *testing.T) {
+	t.Parallel()
+	key := testPrivateKey(t)
+	signer := &remoteSigner{key: key}
+
+	receipt := testReceipt()
+	payload, err := vfd.ReceiptBytes(signer, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+	if err != nil {
+		t.Fatalf("ReceiptBytes() error = %v", err)
+	}
+	want, err := vfd.ReceiptBytes(key, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != string(want) {
+		t.Errorf("ReceiptBytes() with a crypto.Signer differs from the one with the private key")
+	}
+
+	signature, err := vfd.SignPayload(signer, []byte("<ZREPORT/>"))
+	if err != nil {
+		t.Fatalf("SignPayload() error = %v", err)
+	}
+	if err := vfd.VerifySignature(&key.PublicKey, []byte("<ZREPORT/>"), base64.StdEncoding.EncodeToString(signature)); err != nil {
+		t.Errorf("VerifySignature() error = %v", err)
+	}
+	if signer.signs != 2 {
+		t.Errorf("signer was used %d times, want 2", signer.signs)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfd.Sign(ecKey, []byte("payload")); err == nil {
+		t.Errorf("Sign() with an ECDSA key succeeded")
+	}
+}
+
+func TestClientPayloadSigner(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{TIN: "123456789", CertKey: "KEY", CertSerial: "serial", Certificate: cert})
+	signer := &remoteSigner{key: key}
+
+	var hooks int32
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithPayloadSigner(func(signer crypto.Signer, payload []byte) ([]byte, error) {
+			atomic.AddInt32(&hooks, 1)
+			return vfd.Sign(signer, payload)
+		}),
+	)
+	if _, err := client.Register(ctx, server.RequestURL(env.PROD, vfd.RegisterClientAction), signer,
+		&vfd.RegistrationRequest{ContentType: vfd.ContentTypeXML, CertSerial: "serial", Tin: "123456789", CertKey: "KEY"},
+	); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	device := vfd.NewDevice(signer, cert, env.PROD, &reg,
+		vfd.WithDeviceCertSerial("serial"),
+		vfd.WithDeviceRequestURL(server.RequestURL),
+		vfd.WithDeviceClientOptions(vfd.WithHttpClient(server.Client())),
+	)
+	receipt := testReceipt()
+	issued, err := device.Issue(ctx, receipt.Customer, receipt.Items, receipt.Payments)
+	if err != nil || !vfd.IsSuccess(issued.Ack.Code) {
+		t.Fatalf("Issue() with a crypto.Signer = %+v, %v", issued, err)
+	}
+	if hooks != 1 || signer.signs != 2 {
+		t.Errorf("payload signer called %d times and signer %d times, want 1 and 2", hooks, signer.signs)
+	}
+}
@@ -0,0 +1,415 @@
+package vfd
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+// ErrDayClosed is returned by Device.CloseDay when the Z report of the current
+// day was already submitted and no receipt was issued since.
+var ErrDayClosed = errors.New("day already closed")
+
+// eastAfricaTime is the time zone receipts and Z reports are stamped in.
+var eastAfricaTime = time.FixedZone("EAT", 3*60*60)
+
+type (
+	// Device issues receipts and Z reports for a single registered VFD. It
+	// allocates counters, stamps the date and time, signs, fetches tokens and
+	// submits, so that a sale is a single call to Issue and the end of the day a
+	// single call to CloseDay.
+	//
+	// The receipts of every day are aggregated in memory for the Z report, a
+	// Device that is restarted during the day reports only the receipts issued
+	// since. Counters are kept in memory unless WithDeviceCounters is given,
+	// production devices should use a FileCounterStore or another durable
+	// CounterStore.
+	//
+	// A Device is safe for concurrent use. Calls to Issue and CloseDay are
+	// serialized so that receipts reach the VFD server in counter order.
+	Device struct {
+		signer           crypto.Signer
+		registration     *RegistrationResponse
+		env              env.Env
+		certSerial       string
+		registrationDate string
+		clientOptions    []Option
+		client           *Client
+		counters         *Counters
+		requestURL       func(env.Env, Action) string
+		now              func() time.Time
+		taxes            *TaxSchedule
+		taxesErr         error
+
+		mu         sync.Mutex
+		seeded     bool
+		days       []*ZReportAggregator
+		gross      money.Money
+		lastClosed string
+	}
+
+	// DeviceOption configures a Device.
+	DeviceOption func(*Device)
+
+	// IssuedReceipt is a receipt issued by a Device. Ack is the acknowledgement
+	// of the VFD server, nil when the submission failed.
+	IssuedReceipt struct {
+		Receipt *ReceiptRequest
+		Ack     *Response
+		Link    string
+	}
+)
+
+// WithDeviceCertSerial sets the Cert-Serial header of submissions. The default
+// is the serial number of the certificate in hexadecimal.
+func WithDeviceCertSerial(serial string) DeviceOption {
+	return func(d *Device) {
+		d.certSerial = serial
+	}
+}
+
+// WithDeviceCounters sets the Counters receipts are numbered with. They are
+// seeded with the registration response before the first receipt.
+func WithDeviceCounters(counters *Counters) DeviceOption {
+	return func(d *Device) {
+		d.counters = counters
+	}
+}
+
+// WithDeviceClientOptions passes options to the Client the Device submits with,
+// for example WithHttpClient or WithAckCertificate. The Client always fetches
+// tokens with the USERNAME and PASSWORD of the registration response.
+func WithDeviceClientOptions(options ...Option) DeviceOption {
+	return func(d *Device) {
+		d.clientOptions = append(d.clientOptions, options...)
+	}
+}
+
+// WithDeviceRequestURL replaces RequestURL, for example with the RequestURL
+// method of a vfdtest.Server.
+func WithDeviceRequestURL(fn func(env.Env, Action) string) DeviceOption {
+	return func(d *Device) {
+		if fn != nil {
+			d.requestURL = fn
+		}
+	}
+}
+
+// WithDeviceClock replaces time.Now. Receipts and Z reports are stamped in East
+// Africa Time whatever the location of the returned time.
+func WithDeviceClock(now func() time.Time) DeviceOption {
+	return func(d *Device) {
+		if now != nil {
+			d.now = now
+		}
+	}
+}
+
+// WithDeviceRegistrationDate sets the REGISTRATIONDATE of the Z reports, the
+// date the device was registered formatted with DateLayout.
+func WithDeviceRegistrationDate(date string) DeviceOption {
+	return func(d *Device) {
+		d.registrationDate = date
+	}
+}
+
+// WithDeviceOpeningGross sets the GROSS of the last Z report submitted before the
+// Device was created, the cumulative sales the next report starts from.
+func WithDeviceOpeningGross(gross float64) DeviceOption {
+	return func(d *Device) {
+		d.gross = money.FromFloat(gross)
+	}
+}
+
+// WithDeviceTaxTable sets the rates receipts and Z reports are taxed at. The
+// default is the table of the TAXCODES of the registration response, or
+// DefaultTaxTable when it has none.
+func WithDeviceTaxTable(table *TaxTable) DeviceOption {
+	return func(d *Device) {
+		d.taxes = &TaxSchedule{table: table}
+	}
+}
+
+// WithDeviceTaxSchedule sets the history of the rates receipts and Z reports are
+// taxed at, so that a rate change takes effect at its time rather than when the
+// Device is next created.
+func WithDeviceTaxSchedule(taxes *TaxSchedule) DeviceOption {
+	return func(d *Device) {
+		d.taxes = taxes
+	}
+}
+
+// NewDevice creates a Device for the VFD registered with registration, signing
+// with signer and submitting to the servers of e. The certificate is the one
+// returned by LoadCert along with the private key, signer is that key or any
+// crypto.Signer holding it.
+func NewDevice(signer crypto.Signer, cert *x509.Certificate, e env.Env,
+	registration *RegistrationResponse, options ...DeviceOption,
+) *Device {
+	d := &Device{
+		signer:       signer,
+		registration: registration,
+		env:          e,
+		requestURL:   RequestURL,
+		now:          time.Now,
+	}
+	if cert != nil {
+		d.certSerial = fmt.Sprintf("%x", cert.SerialNumber)
+	}
+	for _, option := range options {
+		option(d)
+	}
+	if d.counters == nil {
+		d.counters = NewCounters(NewMemoryCounterStore())
+	}
+	if d.taxes == nil {
+		table, err := registrationTaxTable(registration)
+		d.taxes, d.taxesErr = &TaxSchedule{table: table}, err
+	}
+
+	tokenRequest := &TokenRequest{
+		Username:  registration.USERNAME,
+		Password:  registration.PASSWORD,
+		GrantType: "password",
+	}
+	d.client = NewClient(append([]Option{
+		WithTokenRequest(d.requestURL(e, FetchTokenAction), tokenRequest),
+		WithTaxSchedule(d.taxes),
+	}, d.clientOptions...)...)
+
+	return d
+}
+
+// Registration returns the registration response the Device was created with.
+func (d *Device) Registration() *RegistrationResponse {
+	return d.registration
+}
+
+// Issue issues a receipt for the sale of items to customer paid with payments,
+// with the discounts and surcharges on the whole receipt given as adjustments.
+// The receipt is stamped with the current time and checked at the rates in
+// effect then, a receipt with mistakes is returned as a *ValidationError
+// without using up a counter. Otherwise the counters are allocated and the
+// receipt is signed, the counters are only used up once it is signed. The
+// signed receipt is then submitted.
+//
+// Once signed the receipt counts toward the Z report of the day, even when the
+// submission fails. In that case the IssuedReceipt is returned along with the
+// error and its Receipt must still be delivered, for example with an Outbox.
+// When the receipt can not be counted it is still submitted, and the
+// IssuedReceipt is returned along with the error, with its Ack when the
+// submission succeeded.
+func (d *Device) Issue(ctx context.Context, customer Customer, items []Item, payments []Payment,
+	adjustments ...Adjustment,
+) (*IssuedReceipt, error) {
+	if d.taxesErr != nil {
+		return nil, d.taxesErr
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now().In(eastAfricaTime)
+	receipt := &ReceiptRequest{Customer: customer, Items: items, Payments: payments, Adjustments: adjustments}
+	table := d.taxes.At(now)
+	v := &ValidationError{}
+	receipt.validateCustomer(v)
+	receipt.validateItems(v)
+	receipt.validateAdjustments(v, table)
+	receipt.validatePayments(v, table)
+	if len(v.Problems) > 0 {
+		return nil, v
+	}
+
+	if err := d.seed(ctx); err != nil {
+		return nil, err
+	}
+
+	// The receipt is signed while the counter store is locked, so that a signing
+	// failure does not use up a counter. A CounterStore holds the lock for as
+	// long as the update runs, however slow the signer is.
+	reg := d.registration
+	var payload []byte
+	counters, err := d.counters.next(ctx, now, func(counters *ReceiptCounters) error {
+		receipt.Params = ReceiptParams{
+			Date:           now.Format(DateLayout),
+			Time:           now.Format(TimeLayout),
+			TIN:            reg.TIN,
+			RegistrationID: reg.REGID,
+			EFDSerial:      reg.SERIAL,
+		}
+		counters.Apply(&receipt.Params)
+
+		var err error
+		payload, err = d.client.ReceiptBytes(d.signer, receipt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issued := &IssuedReceipt{
+		Receipt: receipt,
+		Link:    ReceiptLink(d.env, reg.RECEIPTCODE, counters.GlobalCounter, receipt.Params.Time),
+	}
+	// The counters are used up, so the receipt is submitted even when it can
+	// not be counted, leaving it to the caller to add it to the Z report.
+	addErr := d.day(counters.ZNum).Add(receipt)
+	if addErr != nil {
+		addErr = fmt.Errorf("receipt not counted in Z report %s: %w", counters.ZNum, addErr)
+	}
+
+	ack, err := d.client.submitReceiptPayload(ctx, d.requestURL(d.env, SubmitReceiptAction),
+		&RequestHeaders{CertSerial: d.certSerial}, payload)
+	if err != nil {
+		return issued, err
+	}
+	issued.Ack = ack
+
+	return issued, addErr
+}
+
+// CloseDay submits the Z report of the current day, with the totals of the
+// receipts issued since the previous report. Days left open, because CloseDay
+// was not called on them, are reported first, oldest first, each stamped with
+// the last second of its own day. The acknowledgement of the current day's
+// report is returned.
+//
+// ErrDayClosed is returned when there is nothing to report: the current day was
+// already closed and no receipt was issued since.
+func (d *Device) CloseDay(ctx context.Context) (*Response, error) {
+	if d.taxesErr != nil {
+		return nil, d.taxesErr
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now().In(eastAfricaTime)
+	today := now.Format(ZNumLayout)
+	if today > d.lastClosed {
+		d.day(today)
+	}
+	if len(d.days) == 0 {
+		return nil, fmt.Errorf("%w: Z report %s", ErrDayClosed, today)
+	}
+
+	var ack *Response
+	for len(d.days) > 0 {
+		day := d.days[0]
+		report := day.Report(d.reportParams(reportTime(day.ZNum(), now)), d.address())
+		d.gross += money.FromFloat(report.Totals.DailyTotalAmount)
+		report.Totals.Gross = d.gross.Float64()
+
+		response, err := d.client.SubmitReport(ctx, d.requestURL(d.env, SubmitReportAction),
+			&RequestHeaders{CertSerial: d.certSerial}, d.signer, report)
+		if err != nil {
+			d.gross -= money.FromFloat(report.Totals.DailyTotalAmount)
+			return nil, err
+		}
+
+		ack = response
+		d.lastClosed = day.ZNum()
+		d.days = d.days[1:]
+	}
+
+	return ack, nil
+}
+
+// SubmitReceipt signs and submits a receipt whose parameters were filled by the
+// caller, for example one taken from an Outbox. The receipt is not added to the
+// Z report of the Device.
+func (d *Device) SubmitReceipt(ctx context.Context, receipt *ReceiptRequest) (*Response, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.client.SubmitReceipt(ctx, d.requestURL(d.env, SubmitReceiptAction),
+		&RequestHeaders{CertSerial: d.certSerial}, d.signer, receipt)
+}
+
+// SubmitReport signs and submits a Z report built by the caller.
+func (d *Device) SubmitReport(ctx context.Context, report *ReportRequest) (*Response, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.client.SubmitReport(ctx, d.requestURL(d.env, SubmitReportAction),
+		&RequestHeaders{CertSerial: d.certSerial}, d.signer, report)
+}
+
+// Document returns the ReceiptDocument of a receipt issued by the Device, to
+// print it or write it as HTML or PDF.
+func (d *Device) Document(issued *IssuedReceipt) *ReceiptDocument {
+	return &ReceiptDocument{
+		Receipt: issued.Receipt, Registration: d.registration, Ack: issued.Ack, Env: d.env, Taxes: d.taxes,
+	}
+}
+
+// seed seeds the counters with the registration response once.
+func (d *Device) seed(ctx context.Context) error {
+	if d.seeded {
+		return nil
+	}
+	if err := d.counters.Seed(ctx, d.registration); err != nil {
+		return fmt.Errorf("could not seed counters: %w", err)
+	}
+	d.seeded = true
+	return nil
+}
+
+// day returns the aggregator of the receipts of zNum, opening the day when it
+// is not open yet.
+func (d *Device) day(zNum string) *ZReportAggregator {
+	for _, day := range d.days {
+		if day.ZNum() == zNum {
+			return day
+		}
+	}
+	day := NewZReportAggregator(zNum, 0, WithZReportTaxSchedule(d.taxes))
+	d.days = append(d.days, day)
+	sortDays(d.days)
+	return day
+}
+
+func (d *Device) reportParams(now time.Time) ReportParams {
+	reg := d.registration
+	return ReportParams{
+		Date:             now.Format(DateLayout),
+		Time:             now.Format(TimeLayout),
+		VRN:              reg.VRN,
+		TIN:              reg.TIN,
+		UIN:              reg.UIN,
+		TaxOffice:        reg.TAXOFFICE,
+		RegistrationID:   reg.REGID,
+		EFDSerial:        reg.SERIAL,
+		RegistrationDate: d.registrationDate,
+	}
+}
+
+// reportTime returns the time to stamp the Z report of zNum with when it is
+// closed at now: now for the current day and the end of the day for a day left
+// open.
+func reportTime(zNum string, now time.Time) time.Time {
+	day, err := time.ParseInLocation(ZNumLayout, zNum, eastAfricaTime)
+	if err != nil || zNum >= now.Format(ZNumLayout) {
+		return now
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Second)
+}
+
+func (d *Device) address() Address {
+	reg := d.registration
+	return Address{Name: reg.NAME, Street: reg.STREET, Mobile: reg.MOBILE, City: reg.CITY, Country: reg.COUNTRY}
+}
+
+func sortDays(days []*ZReportAggregator) {
+	for i := len(days) - 1; i > 0 && days[i].ZNum() < days[i-1].ZNum(); i-- {
+		days[i], days[i-1] = days[i-1], days[i]
+	}
+}
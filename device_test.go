@@ -0,0 +1,215 @@
+package vfd_test
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+func TestDeviceIssueAndCloseDay(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{
+		TIN: "123456789", CertKey: "10TZ101234", CertSerial: "4bd3a9c1", Certificate: cert,
+		Registration: vfd.RegistrationResponse{GC: 41},
+	})
+
+	// 22:30 UTC is already the next day in Dar es Salaam.
+	now := time.Date(2023, 3, 13, 22, 30, 0, 0, time.UTC)
+	device := vfd.NewDevice(key, cert, env.PROD, &reg,
+		vfd.WithDeviceCertSerial("4bd3a9c1"),
+		vfd.WithDeviceRequestURL(server.RequestURL),
+		vfd.WithDeviceClientOptions(vfd.WithHttpClient(server.Client()), vfd.WithAckCertificate(server.Certificate())),
+		vfd.WithDeviceClock(func() time.Time { return now }),
+		vfd.WithDeviceRegistrationDate("2022-10-01"),
+		vfd.WithDeviceOpeningGross(1000),
+	)
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 2, UnitPrice: 1500}}
+	cash := []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 3000}}
+	issued, err := device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	p := issued.Receipt.Params
+	if p.GlobalCounter != 42 || p.DailyCounter != 1 || p.Date != "2023-03-14" || p.Time != "01:30:00" || p.ZNum != "20230314" {
+		t.Errorf("Issue() params = %+v", p)
+	}
+	if issued.Ack == nil || issued.Ack.Number != 42 {
+		t.Errorf("Issue() ack = %+v", issued.Ack)
+	}
+	if want := vfd.ReceiptLink(env.PROD, reg.RECEIPTCODE, 42, "01:30:00"); issued.Link != want {
+		t.Errorf("Issue() link = %q, want %q", issued.Link, want)
+	}
+	if doc := device.Document(issued); doc.Link() != issued.Link {
+		t.Errorf("Document() link = %q", doc.Link())
+	}
+
+	_, err = device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1}})
+	if !errors.Is(err, vfd.ErrInvalidReceipt) {
+		t.Errorf("Issue() of an invalid receipt error = %v, want %v", err, vfd.ErrInvalidReceipt)
+	}
+
+	now = now.Add(time.Hour)
+	issued, err = device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if p := issued.Receipt.Params; p.GlobalCounter != 43 || p.DailyCounter != 2 {
+		t.Errorf("Issue() after an invalid receipt params = %+v, want GC 43 and DC 2", p)
+	}
+
+	ack, err := device.CloseDay(ctx)
+	if err != nil {
+		t.Fatalf("CloseDay() error = %v", err)
+	}
+	if ack.Number != 20230314 {
+		t.Errorf("CloseDay() ack = %+v", ack)
+	}
+	if _, err := device.CloseDay(ctx); !errors.Is(err, vfd.ErrDayClosed) {
+		t.Errorf("second CloseDay() error = %v, want %v", err, vfd.ErrDayClosed)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if ack, err = device.CloseDay(ctx); err != nil || ack.Number != 20230315 {
+		t.Fatalf("CloseDay() of a day without sales = %+v, %v", ack, err)
+	}
+
+	reports := server.Reports()
+	if len(reports) != 2 || len(server.Receipts()) != 2 {
+		t.Fatalf("server has %d receipts and %d reports, want 2 and 2", len(server.Receipts()), len(reports))
+	}
+	for i, want := range []vfd.ReportTotals{
+		{DailyTotalAmount: 6000, Gross: 7000, TicketsFiscal: 2},
+		{Gross: 7000},
+	} {
+		report, err := vfd.DecodeReport(reports[i].Envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := *report.Request.Totals; got != want {
+			t.Errorf("report %s totals = %+v, want %+v", reports[i].ZNumber, got, want)
+		}
+		if report.Request.Params.RegistrationDate != "2022-10-01" || report.Request.Params.TIN != reg.TIN {
+			t.Errorf("report %s params = %+v", reports[i].ZNumber, report.Request.Params)
+		}
+	}
+}
+
+func TestDeviceCloseDayStampsBacklogDays(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{TIN: "123456789", CertKey: "10TZ101234", CertSerial: "4bd3a9c1", Certificate: cert})
+
+	now := time.Date(2023, 3, 14, 9, 0, 0, 0, time.UTC)
+	device := vfd.NewDevice(key, cert, env.PROD, &reg,
+		vfd.WithDeviceCertSerial("4bd3a9c1"),
+		vfd.WithDeviceRequestURL(server.RequestURL),
+		vfd.WithDeviceClientOptions(vfd.WithHttpClient(server.Client())),
+		vfd.WithDeviceClock(func() time.Time { return now }),
+	)
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 2, UnitPrice: 1500}}
+	cash := []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 3000}}
+	if _, err := device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash); err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	now = now.Add(48 * time.Hour)
+	if _, err := device.CloseDay(ctx); err != nil {
+		t.Fatalf("CloseDay() error = %v", err)
+	}
+
+	reports := server.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("server has %d reports, want 2", len(reports))
+	}
+	for i, want := range []string{"2023-03-14 23:59:59", "2023-03-16 12:00:00"} {
+		report, err := vfd.DecodeReport(reports[i].Envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := report.Request.Params; p.Date+" "+p.Time != want {
+			t.Errorf("report %s stamped %s %s, want %s", reports[i].ZNumber, p.Date, p.Time, want)
+		}
+	}
+}
+
+func TestDeviceIssueSigningFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{
+		TIN: "123456789", CertKey: "10TZ101234", CertSerial: "4bd3a9c1", Certificate: cert,
+		Registration: vfd.RegistrationResponse{GC: 41},
+	})
+
+	errSigner := errors.New("signer unavailable")
+	fail := true
+	device := vfd.NewDevice(key, cert, env.PROD, &reg,
+		vfd.WithDeviceCertSerial("4bd3a9c1"),
+		vfd.WithDeviceRequestURL(server.RequestURL),
+		vfd.WithDeviceClientOptions(
+			vfd.WithHttpClient(server.Client()),
+			vfd.WithPayloadSigner(func(signer crypto.Signer, payload []byte) ([]byte, error) {
+				if fail {
+					return nil, errSigner
+				}
+				return vfd.Sign(signer, payload)
+			}),
+		),
+		vfd.WithDeviceClock(func() time.Time { return time.Date(2023, 3, 14, 9, 0, 0, 0, time.UTC) }),
+	)
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 2, UnitPrice: 1500}}
+	cash := []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 3000}}
+	if _, err := device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash); !errors.Is(err, errSigner) {
+		t.Fatalf("Issue() with a failing signer error = %v, want %v", err, errSigner)
+	}
+
+	fail = false
+	issued, err := device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if p := issued.Receipt.Params; p.GlobalCounter != 42 || p.DailyCounter != 1 {
+		t.Errorf("Issue() after a signing failure params = %+v, want GC 42 and DC 1", p)
+	}
+
+	if _, err := device.CloseDay(ctx); err != nil {
+		t.Fatalf("CloseDay() error = %v", err)
+	}
+	report, err := vfd.DecodeReport(server.Reports()[0].Envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Request.Totals; got.TicketsFiscal != 1 || got.DailyTotalAmount != 3000 {
+		t.Errorf("report totals = %+v, want 1 ticket of 3000", got)
+	}
+}
@@ -0,0 +1,434 @@
+package vfd
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
+	"github.com/vfdcloud/vfd/pkg/pdf"
+	"github.com/vfdcloud/vfd/pkg/qrcode"
+)
+
+//go:embed templates/receipt.html templates/report.html
+var templateFS embed.FS
+
+// PDF layout of documents, in points.
+const (
+	pdfFontSize   = 8.0
+	pdfLeading    = 10.0
+	pdfMargin     = 14.0
+	pdfModuleSize = 2.4
+)
+
+type (
+	// ReceiptView is the data given to the receipt HTML template. Amounts are
+	// those of the signed payload, as computed by generateReceipt.
+	ReceiptView struct {
+		Registration     *RegistrationResponse
+		Params           ReceiptParams
+		Customer         Customer
+		Items            []ItemView
+		TotalTaxExcl     money.Money
+		TotalTax         money.Money
+		TotalTaxIncl     money.Money
+		Discount         money.Money
+		Adjustments      []AdjustmentView
+		VATTotals        []VATView
+		Payments         []PaymentView
+		VerificationCode string
+		Link             string
+
+		// QRCode is a data URL of a PNG image of the QR code of Link.
+		QRCode template.URL
+	}
+
+	// ItemView is an item of a ReceiptView. UnitPrice is the price of the item,
+	// net of VAT when Pricing is TaxExclusivePricing. Amount is the tax
+	// inclusive line amount before the discount, and Discount is tax inclusive.
+	// Neither includes the share of the adjustments of the receipt.
+	ItemView struct {
+		ID          string
+		Description string
+		TaxID       string
+		Quantity    float64
+		UnitPrice   money.Money
+		Pricing     Pricing
+		Discount    money.Money
+		Amount      money.Money
+	}
+
+	// AdjustmentView is a discount or surcharge on the whole receipt. Amount is
+	// negative for discounts.
+	AdjustmentView struct {
+		Description string
+		Amount      money.Money
+	}
+
+	// VATView is the net and tax amount of a VAT rate.
+	VATView struct {
+		ID        string
+		Rate      float64
+		NetAmount money.Money
+		TaxAmount money.Money
+	}
+
+	// PaymentView is the amount paid with a PaymentType.
+	PaymentView struct {
+		Type   PaymentType
+		Amount money.Money
+	}
+
+	// ReportDocument is a Z report to be sent or archived as HTML or PDF.
+	// Template replaces the HTML template of WriteHTML, see ReportTemplate.
+	ReportDocument struct {
+		Report   *ReportRequest
+		Template *template.Template
+	}
+
+	// ReportView is the data given to the Z report HTML template, as computed
+	// by generateZReport. Header holds the address lines of the report.
+	ReportView struct {
+		Header    []string
+		Params    ReportParams
+		Totals    ReportTotalsView
+		VATTotals []VATView
+		Payments  []PaymentView
+	}
+
+	// ReportTotalsView is the TOTALS element of a Z report.
+	ReportTotalsView struct {
+		DailyTotalAmount money.Money
+		Gross            money.Money
+		Corrections      money.Money
+		Discounts        money.Money
+		Surcharges       money.Money
+		TicketsVoid      int64
+		TicketsVoidTotal money.Money
+		TicketsFiscal    int64
+		TicketsNonFiscal int64
+	}
+)
+
+// Label returns the rate as printed on receipts and reports, A-18.00%.
+func (v VATView) Label() string {
+	return fmt.Sprintf("%s-%.2f%%", v.ID, v.Rate)
+}
+
+// ReceiptTemplate returns a new copy of the default receipt HTML template. Its
+// "style", "header" and "footer" blocks can be redefined to brand the receipt:
+//
+//	t := template.Must(vfd.ReceiptTemplate().Parse(`{{define "header"}}...{{end}}`))
+func ReceiptTemplate() *template.Template {
+	return template.Must(template.ParseFS(templateFS, "templates/receipt.html"))
+}
+
+// ReportTemplate returns a new copy of the default Z report HTML template, with
+// the same blocks as ReceiptTemplate.
+func ReportTemplate() *template.Template {
+	return template.Must(template.ParseFS(templateFS, "templates/report.html"))
+}
+
+// View returns the data the receipt HTML template is executed with.
+func (d *ReceiptDocument) View() (*ReceiptView, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+
+	table, err := d.taxTable()
+	if err != nil {
+		return nil, err
+	}
+
+	r := d.Receipt
+	result := table.ProcessItems(r.Items, r.Adjustments...)
+	rct := receiptFromItems(r, result)
+	lines := result.Lines
+	view := &ReceiptView{
+		Registration:     d.Registration,
+		Params:           r.Params,
+		Customer:         r.Customer,
+		TotalTaxExcl:     rct.TOTALS.TOTALTAXEXCL,
+		TotalTaxIncl:     rct.TOTALS.TOTALTAXINCL,
+		Discount:         rct.TOTALS.DISCOUNT,
+		VerificationCode: d.VerificationCode(),
+		Link:             d.Link(),
+	}
+
+	for i, item := range rct.ITEMS.ITEM {
+		view.Items = append(view.Items, ItemView{
+			ID:          item.ID,
+			Description: item.DESC,
+			TaxID:       lines[i].VAT.ID,
+			Quantity:    item.QTY,
+			UnitPrice:   money.FromFloat(r.Items[i].UnitPrice),
+			Pricing:     r.Items[i].Pricing,
+			Discount:    lines[i].Discount - lines[i].BasketDiscount,
+			Amount:      item.AMT - lines[i].Surcharge,
+		})
+	}
+	for i, adjustment := range r.Adjustments {
+		view.Adjustments = append(view.Adjustments, AdjustmentView{
+			Description: adjustment.label(),
+			Amount:      adjustment.signed(result.Adjustments[i]),
+		})
+	}
+	for _, v := range rct.VATTOTALS.VATTOTAL {
+		view.VATTotals = append(view.VATTotals, vatView(table, v))
+		view.TotalTax += v.TAXAMOUNT
+	}
+	view.Payments = paymentViews(rct.PAYMENTS.PAYMENT)
+
+	code, err := qrcode.Encode([]byte(view.Link), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, code.Image(4, 4)); err != nil {
+		return nil, err
+	}
+	view.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(img.Bytes()))
+
+	return view, nil
+}
+
+// WriteHTML writes the receipt as an HTML page, for example to be emailed.
+func (d *ReceiptDocument) WriteHTML(w io.Writer) error {
+	view, err := d.View()
+	if err != nil {
+		return err
+	}
+	return executeTemplate(w, d.Template, ReceiptTemplate, view)
+}
+
+// WritePDF writes the receipt as a single page PDF laid out like the 80mm
+// printed receipt.
+func (d *ReceiptDocument) WritePDF(w io.Writer) error {
+	lines, err := d.layout(PaperWidth80mm)
+	if err != nil {
+		return err
+	}
+	code, err := qrcode.Encode([]byte(d.Link()), qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	return writeLinesPDF(w, lines, PaperWidth80mm, code)
+}
+
+// View returns the data the Z report HTML template is executed with.
+func (d *ReportDocument) View() (*ReportView, error) {
+	r := d.Report
+	if r == nil || r.Params == nil || r.Address == nil || r.Totals == nil {
+		return nil, fmt.Errorf("report document needs a report with Params, Address and Totals")
+	}
+
+	z, err := generateZReport(nil, r.Params, *r.Address, r.VATS, r.Payment, *r.Totals)
+	if err != nil {
+		return nil, err
+	}
+	t := z.TOTALS
+	view := &ReportView{
+		Header: z.HEADER.LINE,
+		Params: *r.Params,
+		Totals: ReportTotalsView{
+			DailyTotalAmount: t.DAILYTOTALAMOUNT,
+			Gross:            t.GROSS,
+			Corrections:      t.CORRECTIONS,
+			Discounts:        t.DISCOUNTS,
+			Surcharges:       t.SURCHARGES,
+			TicketsVoid:      t.TICKETSVOID,
+			TicketsVoidTotal: t.TICKETSVOIDTOTAL,
+			TicketsFiscal:    t.TICKETSFISCAL,
+			TicketsNonFiscal: t.TICKETSNONFISCAL,
+		},
+		Payments: paymentViews(z.PAYMENTS.PAYMENT),
+	}
+	for _, v := range z.VATTOTALS.VATTOTAL {
+		view.VATTotals = append(view.VATTotals, vatView(nil, v))
+	}
+
+	return view, nil
+}
+
+// WriteHTML writes the Z report as an HTML page.
+func (d *ReportDocument) WriteHTML(w io.Writer) error {
+	view, err := d.View()
+	if err != nil {
+		return err
+	}
+	return executeTemplate(w, d.Template, ReportTemplate, view)
+}
+
+// WritePDF writes the Z report as a single page PDF.
+func (d *ReportDocument) WritePDF(w io.Writer) error {
+	view, err := d.View()
+	if err != nil {
+		return err
+	}
+	return writeLinesPDF(w, view.layout(PaperWidth80mm), PaperWidth80mm, nil)
+}
+
+// layout lays the Z report out in lines of width characters, like a receipt.
+func (v *ReportView) layout(width int) []printLine {
+	var lines []printLine
+	center := func(text string, bold bool) {
+		for _, l := range wrap(text, width) {
+			lines = append(lines, printLine{text: l, align: alignCenter, bold: bold})
+		}
+	}
+	pair := func(label, value string) {
+		for _, l := range columns(label, value, width) {
+			lines = append(lines, printLine{text: l})
+		}
+	}
+	rule := func() {
+		lines = append(lines, printLine{text: strings.Repeat("-", width)})
+	}
+
+	p, t := v.Params, v.Totals
+	center("*** Z REPORT ***", false)
+	for i, l := range v.Header {
+		center(l, i == 0)
+	}
+	center("VRN: "+p.VRN, false)
+	center("TIN: "+p.TIN, false)
+	center("TAX OFFICE: "+p.TaxOffice, false)
+	center("UIN: "+p.UIN, false)
+	center("SERIAL NO: "+p.EFDSerial, false)
+	center("REGISTRATION DATE: "+p.RegistrationDate, false)
+	rule()
+
+	pair("Z NUMBER:", p.ZNumber)
+	pair("REPORT DATE:", p.Date)
+	pair("REPORT TIME:", p.Time)
+	rule()
+
+	pair("DAILY TOTAL AMOUNT:", t.DailyTotalAmount.String())
+	pair("GROSS:", t.Gross.String())
+	pair("CORRECTIONS:", t.Corrections.String())
+	pair("DISCOUNTS:", t.Discounts.String())
+	pair("SURCHARGES:", t.Surcharges.String())
+	pair("TICKETS VOID:", fmt.Sprint(t.TicketsVoid))
+	pair("TICKETS VOID TOTAL:", t.TicketsVoidTotal.String())
+	pair("TICKETS FISCAL:", fmt.Sprint(t.TicketsFiscal))
+	pair("TICKETS NON FISCAL:", fmt.Sprint(t.TicketsNonFiscal))
+	rule()
+
+	for _, vat := range v.VATTotals {
+		pair("NET "+vat.Label()+":", vat.NetAmount.String())
+		pair("TAX "+vat.Label()+":", vat.TaxAmount.String())
+	}
+	rule()
+
+	for _, payment := range v.Payments {
+		pair(string(payment.Type), payment.Amount.String())
+	}
+	rule()
+	center("*** END OF Z REPORT ***", false)
+
+	return lines
+}
+
+func executeTemplate(w io.Writer, t *template.Template, fallback func() *template.Template, data any) error {
+	if t == nil {
+		t = fallback()
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeLinesPDF draws the lines in Courier on a page width characters wide
+// and as long as needed, with the QR code in place of the qr line.
+func writeLinesPDF(w io.Writer, lines []printLine, width int, code *qrcode.Code) error {
+	const quiet = 2
+	charWidth := pdf.TextWidth(pdf.Courier, pdfFontSize, "M")
+
+	height := 2 * pdfMargin
+	for _, line := range lines {
+		if line.qr && code != nil {
+			height += float64(code.Size+2*quiet) * pdfModuleSize
+			continue
+		}
+		height += pdfLeading
+	}
+
+	doc := pdf.New()
+	page := doc.AddPage(2*pdfMargin+float64(width)*charWidth, height)
+	y := height - pdfMargin
+	for _, line := range lines {
+		if line.qr {
+			if code == nil {
+				continue
+			}
+			side := float64(code.Size+2*quiet) * pdfModuleSize
+			left := (page.Width-side)/2 + quiet*pdfModuleSize
+			top := y - quiet*pdfModuleSize
+			drawQR(page, code, left, top)
+			y -= side
+			continue
+		}
+
+		y -= pdfLeading
+		font := pdf.Courier
+		if line.bold {
+			font = pdf.CourierBold
+		}
+		text := strings.TrimRight(align(line.text, line.align, width), " ")
+		page.Text(pdfMargin, y+(pdfLeading-pdfFontSize)/2, font, pdfFontSize, text)
+	}
+
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// drawQR draws the dark modules of code, one rectangle per horizontal run,
+// with the top left corner of the symbol at left, top.
+func drawQR(page *pdf.Page, code *qrcode.Code, left, top float64) {
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Black(x, y) {
+				continue
+			}
+			run := 1
+			for code.Black(x+run, y) {
+				run++
+			}
+			page.Rect(left+float64(x)*pdfModuleSize, top-float64(y+1)*pdfModuleSize,
+				float64(run)*pdfModuleSize, pdfModuleSize)
+			x += run - 1
+		}
+	}
+}
+
+// vatView converts a VATTOTAL whose VATRATE is either the ID of the rate, as in
+// receipts, or the ID and the percentage, as in Z reports. The percentage of
+// receipts is taken from table.
+func vatView(table *TaxTable, v *models.VATTOTAL) VATView {
+	id, rate, found := strings.Cut(v.VATRATE, "-")
+	view := VATView{ID: id, NetAmount: v.NETTAMOUNT, TaxAmount: v.TAXAMOUNT}
+	if vat, ok := table.vat(id); ok {
+		view.Rate = vat.Percentage
+	}
+	if found {
+		_, _ = fmt.Sscan(rate, &view.Rate)
+	}
+	return view
+}
+
+func paymentViews(payments []*models.PAYMENT) []PaymentView {
+	views := make([]PaymentView, len(payments))
+	for i, p := range payments {
+		views[i] = PaymentView{Type: PaymentType(p.PMTTYPE), Amount: p.PMTAMOUNT}
+	}
+	return views
+}
@@ -0,0 +1,117 @@
+package vfd_test
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func testReportDocument() *vfd.ReportDocument {
+	return &vfd.ReportDocument{
+		Report: &vfd.ReportRequest{
+			Params: &vfd.ReportParams{
+				Date:             "2023-03-14",
+				Time:             "23:59:59",
+				VRN:              "40-012345-A",
+				TIN:              "123456789",
+				UIN:              "09VFDWEBAPI-123456789",
+				TaxOffice:        "Kinondoni",
+				RegistrationID:   "TZ0100089",
+				ZNumber:          "20230314",
+				EFDSerial:        "10TZ100089",
+				RegistrationDate: "2022-10-01",
+			},
+			Address: &vfd.Address{Name: "Acme Traders Ltd", Street: "Morogoro Road", Mobile: "0713000000", City: "Dar es Salaam", Country: "Tanzania"},
+			Totals: &vfd.ReportTotals{
+				DailyTotalAmount: 6099,
+				Gross:            1006099,
+				Discounts:        0.97,
+				TicketsFiscal:    1,
+			},
+			VATS: []vfd.VATTOTAL{
+				{ID: "A", Rate: 18, NetAmount: 3810.16, TaxAmount: 685.84},
+				{ID: "C", Rate: 0, NetAmount: 1600},
+			},
+			Payment: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 5000}, {Type: vfd.ElectronicPaymentType, Amount: 1099}},
+		},
+	}
+}
+
+func TestReceiptDocumentHTML(t *testing.T) {
+	doc := testReceiptDocument()
+	var buf bytes.Buffer
+	if err := doc.WriteHTML(&buf); err != nil {
+		t.Fatalf("WriteHTML() error = %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"<h1>Acme Traders Ltd</h1>",
+		"Mama Ntilie &amp; Sons",
+		`<a href="https://verify.tra.go.tz/6C72A51042_080509">`,
+		`src="data:image/png;base64,`,
+		"TAX A-18.00%:",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("WriteHTML() has no %q", want)
+		}
+	}
+	golden(t, "receipt.html", buf.Bytes())
+
+	buf.Reset()
+	if err := doc.WritePDF(&buf); err != nil {
+		t.Fatalf("WritePDF() error = %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("RECEIPT VERIFICATION CODE) Tj")) {
+		t.Errorf("WritePDF() does not show the verification code")
+	}
+	golden(t, "receipt.pdf", buf.Bytes())
+}
+
+func TestReportDocumentHTML(t *testing.T) {
+	doc := testReportDocument()
+	var buf bytes.Buffer
+	if err := doc.WriteHTML(&buf); err != nil {
+		t.Fatalf("WriteHTML() error = %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "<h1>ACME TRADERS LTD</h1>") || !strings.Contains(out, "NET A-18.00%:") {
+		t.Errorf("WriteHTML() = %s", out)
+	}
+	golden(t, "zreport.html", buf.Bytes())
+
+	buf.Reset()
+	if err := doc.WritePDF(&buf); err != nil {
+		t.Fatalf("WritePDF() error = %v", err)
+	}
+	golden(t, "zreport.pdf", buf.Bytes())
+}
+
+func TestDocumentTemplateOverride(t *testing.T) {
+	receipt := testReceiptDocument()
+	receipt.Template = template.Must(vfd.ReceiptTemplate().Parse(
+		`{{define "header"}}<img src="logo.png" alt="{{.Registration.NAME}}">{{end}}{{define "footer"}}<p>Karibu tena</p>{{end}}`))
+	report := testReportDocument()
+	report.Template = template.Must(vfd.ReportTemplate().Parse(`{{define "style"}}body { color: navy; }{{end}}`))
+
+	var buf bytes.Buffer
+	if err := receipt.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `<img src="logo.png" alt="Acme Traders Ltd">`) || !strings.Contains(out, "<p>Karibu tena</p>") {
+		t.Errorf("receipt header and footer were not replaced:\n%s", out)
+	}
+	if strings.Contains(out, "<h1>") || !strings.Contains(out, "TIN: 123456789") {
+		t.Errorf("receipt header block replaced too much or too little:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := report.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "body { color: navy; }") || strings.Contains(out, "monospace") {
+		t.Errorf("report style was not replaced:\n%s", out)
+	}
+}
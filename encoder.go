@@ -0,0 +1,173 @@
+package vfd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+// payloadEncoder writes the signed part of an EFDMS envelope. The elements are
+// written in the order EFDMS expects them, amounts always have 2 decimals, text
+// is escaped like encoding/xml does and the <PAYMENT> and <VATTOTAL> wrappers
+// are never written, so the bytes can be signed as they are.
+type payloadEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *payloadEncoder) open(name string) {
+	e.buf.WriteByte('<')
+	e.buf.WriteString(name)
+	e.buf.WriteByte('>')
+}
+
+func (e *payloadEncoder) close(name string) {
+	e.buf.WriteString("</")
+	e.buf.WriteString(name)
+	e.buf.WriteByte('>')
+}
+
+func (e *payloadEncoder) text(name, value string) {
+	e.open(name)
+	// writing to a bytes.Buffer does not fail
+	_ = xml.EscapeText(&e.buf, []byte(value))
+	e.close(name)
+}
+
+func (e *payloadEncoder) int(name string, value int64) {
+	e.text(name, strconv.FormatInt(value, 10))
+}
+
+func (e *payloadEncoder) money(name string, value money.Money) {
+	e.text(name, value.String())
+}
+
+// quantity formats value with the fewest digits needed, 2 and not 2.00.
+func (e *payloadEncoder) quantity(name string, value float64) {
+	e.text(name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (e *payloadEncoder) payments(payments []*models.PAYMENT) {
+	e.open("PAYMENTS")
+	for _, p := range payments {
+		e.text("PMTTYPE", p.PMTTYPE)
+		e.money("PMTAMOUNT", p.PMTAMOUNT)
+	}
+	e.close("PAYMENTS")
+}
+
+func (e *payloadEncoder) vatTotals(totals []*models.VATTOTAL) {
+	e.open("VATTOTALS")
+	for _, v := range totals {
+		e.text("VATRATE", v.VATRATE)
+		e.money("NETTAMOUNT", v.NETTAMOUNT)
+		e.money("TAXAMOUNT", v.TAXAMOUNT)
+	}
+	e.close("VATTOTALS")
+}
+
+// encodeReceipt returns the <RCT> element of rct as it is signed.
+func encodeReceipt(rct *models.RCT) []byte {
+	e := &payloadEncoder{}
+	e.open("RCT")
+	e.text("DATE", rct.DATE)
+	e.text("TIME", rct.TIME)
+	e.text("TIN", rct.TIN)
+	e.text("REGID", rct.REGID)
+	e.text("EFDSERIAL", rct.EFDSERIAL)
+	e.int("CUSTIDTYPE", rct.CUSTIDTYPE)
+	e.text("CUSTID", rct.CUSTID)
+	e.text("CUSTNAME", rct.CUSTNAME)
+	e.text("MOBILENUM", rct.MOBILENUM)
+	e.text("RCTNUM", rct.RCTNUM)
+	e.int("DC", rct.DC)
+	e.int("GC", rct.GC)
+	e.text("ZNUM", rct.ZNUM)
+	e.text("RCTVNUM", rct.RCTVNUM)
+
+	e.open("ITEMS")
+	for _, item := range rct.ITEMS.ITEM {
+		e.open("ITEM")
+		e.text("ID", item.ID)
+		e.text("DESC", item.DESC)
+		e.quantity("QTY", item.QTY)
+		e.int("TAXCODE", item.TAXCODE)
+		e.money("AMT", item.AMT)
+		e.close("ITEM")
+	}
+	e.close("ITEMS")
+
+	e.open("TOTALS")
+	e.money("TOTALTAXEXCL", rct.TOTALS.TOTALTAXEXCL)
+	e.money("TOTALTAXINCL", rct.TOTALS.TOTALTAXINCL)
+	e.money("DISCOUNT", rct.TOTALS.DISCOUNT)
+	e.close("TOTALS")
+
+	e.payments(rct.PAYMENTS.PAYMENT)
+	e.vatTotals(rct.VATTOTALS.VATTOTAL)
+	e.close("RCT")
+
+	return e.buf.Bytes()
+}
+
+// encodeZReport returns the <ZREPORT> element of report as it is signed.
+func encodeZReport(report *models.ZREPORT) []byte {
+	e := &payloadEncoder{}
+	e.open("ZREPORT")
+	e.text("DATE", report.DATE)
+	e.text("TIME", report.TIME)
+
+	e.open("HEADER")
+	for _, line := range report.HEADER.LINE {
+		e.text("LINE", line)
+	}
+	e.close("HEADER")
+
+	e.text("VRN", report.VRN)
+	e.text("TIN", report.TIN)
+	e.text("TAXOFFICE", report.TAXOFFICE)
+	e.text("REGID", report.REGID)
+	e.text("ZNUMBER", report.ZNUMBER)
+	e.text("EFDSERIAL", report.EFDSERIAL)
+	e.text("REGISTRATIONDATE", report.REGISTRATIONDATE)
+	e.text("USER", report.USER)
+	e.text("SIMIMSI", report.SIMIMSI)
+
+	t := report.TOTALS
+	e.open("TOTALS")
+	e.money("DAILYTOTALAMOUNT", t.DAILYTOTALAMOUNT)
+	e.money("GROSS", t.GROSS)
+	e.money("CORRECTIONS", t.CORRECTIONS)
+	e.money("DISCOUNTS", t.DISCOUNTS)
+	e.money("SURCHARGES", t.SURCHARGES)
+	e.int("TICKETSVOID", t.TICKETSVOID)
+	e.money("TICKETSVOIDTOTAL", t.TICKETSVOIDTOTAL)
+	e.int("TICKETSFISCAL", t.TICKETSFISCAL)
+	e.int("TICKETSNONFISCAL", t.TICKETSNONFISCAL)
+	e.close("TOTALS")
+
+	e.vatTotals(report.VATTOTALS.VATTOTAL)
+	e.payments(report.PAYMENTS.PAYMENT)
+
+	e.open("CHANGES")
+	e.text("VATCHANGENUM", report.CHANGES.VATCHANGENUM)
+	e.text("HEADCHANGENUM", report.CHANGES.HEADCHANGENUM)
+	e.close("CHANGES")
+
+	e.text("ERRORS", report.ERRORS)
+	e.text("FWVERSION", report.FWVERSION)
+	e.text("FWCHECKSUM", report.FWCHECKSUM)
+	e.close("ZREPORT")
+
+	return e.buf.Bytes()
+}
+
+// envelope wraps a signed payload and its base64 encoded signature in the
+// EFDMS element, preceded by xml.Header.
+func envelope(payload []byte, signature string) []byte {
+	return []byte(fmt.Sprintf("%s<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>",
+		xml.Header, payload, signature))
+}
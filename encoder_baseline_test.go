@@ -0,0 +1,72 @@
+package vfd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselinePayload encodes v the way ReceiptBytes and ReportBytes did before
+// payloadEncoder: xml.Marshal with the <PAYMENT> and <VATTOTAL> wrappers
+// removed afterwards.
+func baselinePayload(t *testing.T, v any) []byte {
+	t.Helper()
+	payload, err := xml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacer := strings.NewReplacer(
+		"<PAYMENT>", "",
+		"</PAYMENT>", "",
+		"<VATTOTAL>", "",
+		"</VATTOTAL>", "")
+	return []byte(replacer.Replace(string(payload)))
+}
+
+// TestPayloadEncoderMatchesBaseline checks that the golden payloads, written by
+// payloadEncoder from the fixtures of TestReceiptPayloadGolden and
+// TestReportPayloadGolden, are byte for byte what the xml.Marshal pipeline
+// produces for the same receipts and report.
+func TestPayloadEncoderMatchesBaseline(t *testing.T) {
+	for _, name := range []string{"receipt_basic.xml", "receipt_mixed.xml"} {
+		want, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rct, err := decodeReceiptElement(want)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if got := baselinePayload(t, rct); !bytes.Equal(got, want) {
+			t.Errorf("%s: xml.Marshal pipeline differs:\ngot  %s\nwant %s", name, got, want)
+		}
+		if got := encodeReceipt(rct); !bytes.Equal(got, want) {
+			t.Errorf("%s: encodeReceipt differs:\ngot  %s\nwant %s", name, got, want)
+		}
+	}
+
+	want, err := os.ReadFile(filepath.Join("testdata", "zreport.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := DecodeReport(envelope(want, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := signed.Request
+	report, err := generateZReport(nil, r.Params, *r.Address, r.VATS, r.Payment, *r.Totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := baselinePayload(t, report); !bytes.Equal(got, want) {
+		t.Errorf("zreport.xml: xml.Marshal pipeline differs:\ngot  %s\nwant %s", got, want)
+	}
+	if got := encodeZReport(report); !bytes.Equal(got, want) {
+		t.Errorf("zreport.xml: encodeZReport differs:\ngot  %s\nwant %s", got, want)
+	}
+}
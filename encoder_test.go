@@ -0,0 +1,129 @@
+package vfd_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden compares got with the file testdata/name, or rewrites the file when
+// the tests run with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\ngot  %s\nwant %s", name, got, want)
+	}
+}
+
+func TestReceiptPayloadGolden(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	mixed := &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date:           "2023-03-14",
+			Time:           "08:05:09",
+			TIN:            "123456789",
+			RegistrationID: "TZ0100089",
+			EFDSerial:      "10TZ100089",
+			ReceiptNum:     "1042",
+			DailyCounter:   7,
+			GlobalCounter:  1042,
+			ZNum:           "20230314",
+			ReceiptVNum:    "6C72A51042",
+		},
+		Customer: vfd.Customer{Type: vfd.TINCustomerID, ID: "987654321", Name: `Mama "Ntilie" & Sons <Ltd>`, Mobile: "0713000000"},
+		Items: []vfd.Item{
+			{ID: "SKU-1", Description: "Sugar 'brown'", TaxCode: vfd.NonTaxableItemCode, Quantity: 0.5, UnitPrice: 3200},
+			{ID: "SKU-2", Description: "Soap & Water", TaxCode: vfd.TaxableItemCode, Quantity: 3, UnitPrice: 1499.99, Discount: 0.97},
+			{ID: "SKU-3", Description: "Exempt\tbook\r\n", TaxCode: vfd.ExemptedVATCODE, Quantity: 1, UnitPrice: 12000},
+			{ID: "SKU-4", Description: "Oil", TaxCode: vfd.TaxableItemCode, Quantity: 2, UnitPrice: 0.05},
+		},
+		Payments: []vfd.Payment{
+			{Type: vfd.CashPaymentType, Amount: 10000},
+			{Type: vfd.ElectronicPaymentType, Amount: 8099.1},
+		},
+	}
+
+	for name, receipt := range map[string]*vfd.ReceiptRequest{
+		"receipt_basic.xml": testReceipt(),
+		"receipt_mixed.xml": mixed,
+	} {
+		payload, err := vfd.ReceiptBytes(privateKey, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := vfd.DecodeReceipt(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signed.Verify(&privateKey.PublicKey); err != nil {
+			t.Errorf("%s: Verify() error = %v", name, err)
+		}
+		golden(t, name, signed.Payload)
+	}
+}
+
+func TestReportPayloadGolden(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	params := &vfd.ReportParams{
+		Date:             "2023-03-14",
+		Time:             "23:59:59",
+		VRN:              "40-012345-A",
+		TIN:              "123456789",
+		UIN:              "09VFDWEBAPI-123456789",
+		TaxOffice:        "Kinondoni & Ilala",
+		RegistrationID:   "TZ0100089",
+		ZNumber:          "20230314",
+		EFDSerial:        "10TZ100089",
+		RegistrationDate: "2022-10-01",
+	}
+	address := vfd.Address{Name: "Mama <Ntilie>", Street: "Morogoro Rd", Mobile: "0713000000", City: "Dar es Salaam", Country: "Tanzania"}
+	totals := vfd.ReportTotals{
+		DailyTotalAmount: 18099.1,
+		Gross:            1018099.1,
+		Discounts:        0.97,
+		TicketsFiscal:    2,
+		TicketsVoid:      1,
+		TicketsVoidTotal: 100,
+	}
+	vats := []vfd.VATTOTAL{
+		{ID: "A", Rate: 18, NetAmount: 3812.72, TaxAmount: 686.31},
+		{ID: "C", Rate: 0, NetAmount: 1600},
+		{ID: "E", Rate: 0, NetAmount: 12000},
+		{ID: "A", Rate: 18, NetAmount: 0.07, TaxAmount: 0.01},
+	}
+	payments := []vfd.Payment{
+		{Type: vfd.ElectronicPaymentType, Amount: 8099.1},
+		{Type: vfd.CashPaymentType, Amount: 10000},
+	}
+
+	payload, err := vfd.ReportBytes(privateKey, params, address, vats, payments, totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := vfd.DecodeReport(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.Verify(&privateKey.PublicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	golden(t, "zreport.xml", signed.Payload)
+}
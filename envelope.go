@@ -0,0 +1,444 @@
+package vfd
+
+import (
+	"crypto/rsa"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vfdcloud/vfd/internal/element"
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+// ErrInvalidEnvelope is returned when a signed receipt or Z report can not be
+// decoded.
+var ErrInvalidEnvelope = errors.New("invalid EFDMS envelope")
+
+type (
+	// SignedReceipt is a receipt decoded from its EFDMS envelope. Payload is the
+	// <RCT> element exactly as it was signed and Signature the base64 encoded
+	// EFDMSSIGNATURE, so the receipt can be verified without re-encoding it.
+	SignedReceipt struct {
+		Request   *ReceiptRequest
+		Payload   []byte
+		Signature string
+	}
+
+	// SignedReport is a Z report decoded from its EFDMS envelope. Payload is the
+	// <ZREPORT> element exactly as it was signed and Signature the base64 encoded
+	// EFDMSSIGNATURE.
+	SignedReport struct {
+		Request   *ReportRequest
+		Payload   []byte
+		Signature string
+	}
+
+	// flatPayments is the <PAYMENTS> element of a signed receipt, where
+	// the <PAYMENT> wrappers have been removed and only the alternating
+	// PMTTYPE and PMTAMOUNT elements remain.
+	flatPayments struct {
+		PMTTYPE   []string      `xml:"PMTTYPE"`
+		PMTAMOUNT []money.Money `xml:"PMTAMOUNT"`
+	}
+
+	// flatVATTotals is the <VATTOTALS> element of a signed receipt or
+	// Z report without the <VATTOTAL> wrappers.
+	flatVATTotals struct {
+		VATRATE    []string      `xml:"VATRATE"`
+		NETTAMOUNT []money.Money `xml:"NETTAMOUNT"`
+		TAXAMOUNT  []money.Money `xml:"TAXAMOUNT"`
+	}
+
+	// receiptElement is the signed <RCT> element of a receipt envelope.
+	receiptElement struct {
+		XMLName    xml.Name      `xml:"RCT"`
+		DATE       string        `xml:"DATE"`
+		TIME       string        `xml:"TIME"`
+		TIN        string        `xml:"TIN"`
+		REGID      string        `xml:"REGID"`
+		EFDSERIAL  string        `xml:"EFDSERIAL"`
+		CUSTIDTYPE int64         `xml:"CUSTIDTYPE"`
+		CUSTID     string        `xml:"CUSTID"`
+		CUSTNAME   string        `xml:"CUSTNAME"`
+		MOBILENUM  string        `xml:"MOBILENUM"`
+		RCTNUM     string        `xml:"RCTNUM"`
+		DC         int64         `xml:"DC"`
+		GC         int64         `xml:"GC"`
+		ZNUM       string        `xml:"ZNUM"`
+		RCTVNUM    string        `xml:"RCTVNUM"`
+		ITEMS      models.ITEMS  `xml:"ITEMS"`
+		TOTALS     models.TOTALS `xml:"TOTALS"`
+		PAYMENTS   flatPayments  `xml:"PAYMENTS"`
+		VATTOTALS  flatVATTotals `xml:"VATTOTALS"`
+	}
+
+	// reportElement is the signed <ZREPORT> element of a Z report envelope.
+	reportElement struct {
+		XMLName xml.Name `xml:"ZREPORT"`
+		DATE    string   `xml:"DATE"`
+		TIME    string   `xml:"TIME"`
+		HEADER  struct {
+			LINE []string `xml:"LINE"`
+		} `xml:"HEADER"`
+		VRN              string              `xml:"VRN"`
+		TIN              string              `xml:"TIN"`
+		TAXOFFICE        string              `xml:"TAXOFFICE"`
+		REGID            string              `xml:"REGID"`
+		ZNUMBER          string              `xml:"ZNUMBER"`
+		EFDSERIAL        string              `xml:"EFDSERIAL"`
+		REGISTRATIONDATE string              `xml:"REGISTRATIONDATE"`
+		USER             string              `xml:"USER"`
+		TOTALS           models.REPORTTOTALS `xml:"TOTALS"`
+		VATTOTALS        flatVATTotals       `xml:"VATTOTALS"`
+		PAYMENTS         flatPayments        `xml:"PAYMENTS"`
+	}
+)
+
+// DecodeReceipt decodes a signed receipt as produced by ReceiptBytes, read from
+// disk, an OutboxEntry or a RawRequest file. The signature is not verified, use
+// SignedReceipt.Verify for that.
+//
+// The payload carries the amount of every item but only the total discount, so
+// the discount of each VAT rate, its items amount less its NETTAMOUNT and
+// TAXAMOUNT, is given to the items of that rate in order, each taking at most
+// its own amount. UnitPrice is AMT divided by QTY rounded to the cent, items
+// priced with TaxExclusivePricing come back tax inclusive and the shares of the
+// Adjustments of the receipt come back in the items. When a rate has
+// several items the net amounts computed from the returned request can differ
+// from the payload by a cent, Payload remains the fiscal record.
+//
+// Request is decoded from the bytes of Payload, so it is what Verify checks.
+// Envelopes with more than one RCT or EFDMSSIGNATURE are rejected.
+func DecodeReceipt(data []byte) (*SignedReceipt, error) {
+	payload, signature, err := signedElement(data, "RCT")
+	if err != nil {
+		return nil, err
+	}
+	rct, err := decodeReceiptElement(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedReceipt{
+		Request:   receiptRequest(rct),
+		Payload:   payload,
+		Signature: signature,
+	}, nil
+}
+
+// DecodeReceiptFile reads the file at path and decodes it with DecodeReceipt.
+func DecodeReceiptFile(path string) (*SignedReceipt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReceipt(data)
+}
+
+// Verify checks the signature of the receipt against the public key of the
+// certificate it was signed with.
+func (r *SignedReceipt) Verify(publicKey *rsa.PublicKey) error {
+	return VerifySignature(publicKey, r.Payload, r.Signature)
+}
+
+// DecodeReport decodes a signed Z report as produced by ReportBytes. The
+// signature is not verified, use SignedReport.Verify for that.
+//
+// The Address is recovered from the HEADER lines, which ReportBytes writes in
+// upper case. Every VAT rate and payment type of the payload is returned,
+// including those with zero amounts.
+//
+// Request is decoded from the bytes of Payload, so it is what Verify checks.
+// Envelopes with more than one ZREPORT or EFDMSSIGNATURE are rejected.
+func DecodeReport(data []byte) (*SignedReport, error) {
+	payload, signature, err := signedElement(data, "ZREPORT")
+	if err != nil {
+		return nil, err
+	}
+
+	var z reportElement
+	if err := xml.Unmarshal(payload, &z); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	payments, err := z.PAYMENTS.payments()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	vatTotals, err := z.VATTOTALS.vatTotals()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	vats := make([]VATTOTAL, len(vatTotals))
+	for i, v := range vatTotals {
+		id, rate, found := strings.Cut(v.VATRATE, "-")
+		percentage, err := strconv.ParseFloat(rate, 64)
+		if !found || err != nil {
+			return nil, fmt.Errorf("%w: invalid vat rate %q", ErrInvalidEnvelope, v.VATRATE)
+		}
+		vats[i] = VATTOTAL{
+			ID:        id,
+			Rate:      percentage,
+			NetAmount: v.NETTAMOUNT.Float64(),
+			TaxAmount: v.TAXAMOUNT.Float64(),
+		}
+	}
+
+	address := parseAddress(z.HEADER.LINE)
+	t := z.TOTALS
+	return &SignedReport{
+		Request: &ReportRequest{
+			Params: &ReportParams{
+				Date:             z.DATE,
+				Time:             z.TIME,
+				VRN:              z.VRN,
+				TIN:              z.TIN,
+				UIN:              z.USER,
+				TaxOffice:        z.TAXOFFICE,
+				RegistrationID:   z.REGID,
+				ZNumber:          z.ZNUMBER,
+				EFDSerial:        z.EFDSERIAL,
+				RegistrationDate: z.REGISTRATIONDATE,
+			},
+			Address: &address,
+			Totals: &ReportTotals{
+				DailyTotalAmount: t.DAILYTOTALAMOUNT.Float64(),
+				Gross:            t.GROSS.Float64(),
+				Corrections:      t.CORRECTIONS.Float64(),
+				Discounts:        t.DISCOUNTS.Float64(),
+				Surcharges:       t.SURCHARGES.Float64(),
+				TicketsVoid:      t.TICKETSVOID,
+				TicketsVoidTotal: t.TICKETSVOIDTOTAL.Float64(),
+				TicketsFiscal:    t.TICKETSFISCAL,
+				TicketsNonFiscal: t.TICKETSNONFISCAL,
+			},
+			VATS:    vats,
+			Payment: paymentsFromModels(payments),
+		},
+		Payload:   payload,
+		Signature: signature,
+	}, nil
+}
+
+// DecodeReportFile reads the file at path and decodes it with DecodeReport.
+func DecodeReportFile(path string) (*SignedReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReport(data)
+}
+
+// Verify checks the signature of the Z report against the public key of the
+// certificate it was signed with.
+func (r *SignedReport) Verify(publicKey *rsa.PublicKey) error {
+	return VerifySignature(publicKey, r.Payload, r.Signature)
+}
+
+// signedElement returns the bytes of the element name, as they were signed, and
+// the EFDMSSIGNATURE of the envelope.
+func signedElement(data []byte, name string) ([]byte, string, error) {
+	payload, err := element.Bytes(data, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	signature, err := element.Bytes(data, "EFDMSSIGNATURE")
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	var value string
+	if err := xml.Unmarshal(signature, &value); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	return payload, strings.TrimSpace(value), nil
+}
+
+// parseAddress reverses Address.AsList.
+func parseAddress(lines []string) Address {
+	line := func(i int) string {
+		if i < len(lines) {
+			return strings.TrimSpace(lines[i])
+		}
+		return ""
+	}
+
+	address := Address{
+		Name:   line(0),
+		Street: line(1),
+		Mobile: strings.TrimSpace(strings.TrimPrefix(line(2), "MOBILE:")),
+	}
+	place := line(3)
+	if i := strings.LastIndex(place, ","); i >= 0 {
+		address.City, address.Country = place[:i], place[i+1:]
+	} else {
+		address.City = place
+	}
+
+	return address
+}
+
+func paymentsFromModels(payments []*models.PAYMENT) []Payment {
+	out := make([]Payment, len(payments))
+	for i, p := range payments {
+		out[i] = Payment{Type: PaymentType(p.PMTTYPE), Amount: p.PMTAMOUNT.Float64()}
+	}
+	return out
+}
+
+// receiptRequest converts a decoded RCT back into the ReceiptRequest it was
+// generated from, see DecodeReceipt for what can not be recovered exactly.
+func receiptRequest(rct *models.RCT) *ReceiptRequest {
+	discounts := itemDiscounts(rct)
+	items := make([]Item, len(rct.ITEMS.ITEM))
+	for i, item := range rct.ITEMS.ITEM {
+		var unitPrice money.Money
+		if item.QTY != 0 {
+			unitPrice = money.FromFloat(item.AMT.Float64() / item.QTY)
+		}
+		items[i] = Item{
+			ID:          item.ID,
+			Description: item.DESC,
+			TaxCode:     item.TAXCODE,
+			Quantity:    item.QTY,
+			UnitPrice:   unitPrice.Float64(),
+			Discount:    discounts[i].Float64(),
+		}
+	}
+
+	return &ReceiptRequest{
+		Params: ReceiptParams{
+			Date:           rct.DATE,
+			Time:           rct.TIME,
+			TIN:            rct.TIN,
+			RegistrationID: rct.REGID,
+			EFDSerial:      rct.EFDSERIAL,
+			ReceiptNum:     rct.RCTNUM,
+			DailyCounter:   rct.DC,
+			GlobalCounter:  rct.GC,
+			ZNum:           rct.ZNUM,
+			ReceiptVNum:    rct.RCTVNUM,
+		},
+		Customer: Customer{
+			Type:   CustomerID(rct.CUSTIDTYPE),
+			ID:     rct.CUSTID,
+			Name:   rct.CUSTNAME,
+			Mobile: rct.MOBILENUM,
+		},
+		Items:    items,
+		Payments: paymentsFromModels(rct.PAYMENTS.PAYMENT),
+	}
+}
+
+// itemDiscounts recovers the discount of every item of rct. The discount of a
+// VAT rate is the amount of its items less its NETTAMOUNT and TAXAMOUNT, and is
+// given to the items of that rate in order.
+func itemDiscounts(rct *models.RCT) []money.Money {
+	remaining := make(map[string]money.Money)
+	for _, v := range rct.VATTOTALS.VATTOTAL {
+		remaining[v.VATRATE] -= v.NETTAMOUNT + v.TAXAMOUNT
+	}
+	for _, item := range rct.ITEMS.ITEM {
+		id := ParseTaxCode(item.TAXCODE).ID
+		if _, ok := remaining[id]; ok {
+			remaining[id] += item.AMT
+		}
+	}
+
+	discounts := make([]money.Money, len(rct.ITEMS.ITEM))
+	for i, item := range rct.ITEMS.ITEM {
+		id := ParseTaxCode(item.TAXCODE).ID
+		discount := remaining[id]
+		if discount > item.AMT {
+			discount = item.AMT
+		}
+		if discount <= 0 {
+			continue
+		}
+		discounts[i] = discount
+		remaining[id] -= discount
+	}
+
+	return discounts
+}
+
+func (p flatPayments) payments() ([]*models.PAYMENT, error) {
+	if len(p.PMTTYPE) != len(p.PMTAMOUNT) {
+		return nil, fmt.Errorf("%d payment types but %d payment amounts", len(p.PMTTYPE), len(p.PMTAMOUNT))
+	}
+
+	payments := make([]*models.PAYMENT, len(p.PMTTYPE))
+	for i := range p.PMTTYPE {
+		payments[i] = &models.PAYMENT{PMTTYPE: p.PMTTYPE[i], PMTAMOUNT: p.PMTAMOUNT[i]}
+	}
+
+	return payments, nil
+}
+
+func (v flatVATTotals) vatTotals() ([]*models.VATTOTAL, error) {
+	if len(v.VATRATE) != len(v.NETTAMOUNT) || len(v.VATRATE) != len(v.TAXAMOUNT) {
+		return nil, fmt.Errorf("%d vat rates but %d net amounts and %d tax amounts",
+			len(v.VATRATE), len(v.NETTAMOUNT), len(v.TAXAMOUNT))
+	}
+
+	totals := make([]*models.VATTOTAL, len(v.VATRATE))
+	for i := range v.VATRATE {
+		totals[i] = &models.VATTOTAL{VATRATE: v.VATRATE[i], NETTAMOUNT: v.NETTAMOUNT[i], TAXAMOUNT: v.TAXAMOUNT[i]}
+	}
+
+	return totals, nil
+}
+
+// decodeReceiptEnvelope decodes a signed receipt as produced by ReceiptBytes
+// back into the RCT it was generated from. The signature is not verified.
+func decodeReceiptEnvelope(data []byte) (*models.RCT, error) {
+	payload, _, err := signedElement(data, "RCT")
+	if err != nil {
+		return nil, err
+	}
+	return decodeReceiptElement(payload)
+}
+
+// decodeReceiptElement decodes the <RCT> element of a signed receipt.
+func decodeReceiptElement(payload []byte) (*models.RCT, error) {
+	var rct receiptElement
+	if err := xml.Unmarshal(payload, &rct); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	payments, err := rct.PAYMENTS.payments()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	vatTotals, err := rct.VATTOTALS.vatTotals()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	return &models.RCT{
+		DATE:       rct.DATE,
+		TIME:       rct.TIME,
+		TIN:        rct.TIN,
+		REGID:      rct.REGID,
+		EFDSERIAL:  rct.EFDSERIAL,
+		CUSTIDTYPE: rct.CUSTIDTYPE,
+		CUSTID:     rct.CUSTID,
+		CUSTNAME:   rct.CUSTNAME,
+		MOBILENUM:  rct.MOBILENUM,
+		RCTNUM:     rct.RCTNUM,
+		DC:         rct.DC,
+		GC:         rct.GC,
+		ZNUM:       rct.ZNUM,
+		RCTVNUM:    rct.RCTVNUM,
+		ITEMS:      rct.ITEMS,
+		TOTALS:     rct.TOTALS,
+		PAYMENTS:   models.PAYMENTS{PAYMENT: payments},
+		VATTOTALS:  models.VATTOTALS{VATTOTAL: vatTotals},
+	}, nil
+}
@@ -0,0 +1,197 @@
+package vfd_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestDecodeReceipt(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	receipt := testReceipt()
+	receipt.Params.ZNum = "20230101"
+	receipt.Params.ReceiptNum = "1"
+	receipt.Params.ReceiptVNum = "ABC1"
+	receipt.Customer = vfd.Customer{Type: vfd.TINCustomerID, ID: "987654321", Name: "Acme", Mobile: "0700000000"}
+	receipt.Items = []vfd.Item{
+		{ID: "1", Description: "Soap & Water", TaxCode: vfd.TaxableItemCode, Quantity: 2, UnitPrice: 1500, Discount: 100},
+		{ID: "2", Description: "Oil", TaxCode: vfd.TaxableItemCode, Quantity: 3, UnitPrice: 0.1},
+	}
+	receipt.Payments = []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 2000}, {Type: vfd.ElectronicPaymentType, Amount: 900.3}}
+
+	payload, err := vfd.ReceiptBytes(privateKey, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := vfd.DecodeReceipt(payload)
+	if err != nil {
+		t.Fatalf("DecodeReceipt() error = %v", err)
+	}
+	if !reflect.DeepEqual(signed.Request, receipt) {
+		t.Errorf("DecodeReceipt() request = %+v\nwant %+v", signed.Request, receipt)
+	}
+	if !bytes.HasPrefix(signed.Payload, []byte("<RCT>")) || !bytes.Contains(payload, signed.Payload) {
+		t.Errorf("DecodeReceipt() payload = %s", signed.Payload)
+	}
+	if err := signed.Verify(&privateKey.PublicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	again, err := vfd.ReceiptBytes(privateKey, signed.Request.Params, signed.Request.Customer,
+		signed.Request.Items, signed.Request.Payments)
+	if err != nil || !bytes.Equal(again, payload) {
+		t.Errorf("ReceiptBytes() of the decoded receipt differs: %s, %v", again, err)
+	}
+
+	entry := &vfd.OutboxEntry{Payload: payload}
+	if fromOutbox, err := entry.Receipt(); err != nil || fromOutbox.Request.Params.GlobalCounter != 1 {
+		t.Errorf("OutboxEntry.Receipt() = %+v, %v", fromOutbox, err)
+	}
+
+	signed.Payload = bytes.Replace(signed.Payload, []byte("Acme"), []byte("Acne"), 1)
+	if err := signed.Verify(&privateKey.PublicKey); err == nil {
+		t.Errorf("Verify() of a tampered payload succeeded")
+	}
+}
+
+func TestDecodeReceiptDiscounts(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	items := []vfd.Item{
+		{ID: "1", TaxCode: vfd.TaxableItemCode, Quantity: 1, UnitPrice: 100},
+		{ID: "2", TaxCode: vfd.NonTaxableItemCode, Quantity: 1, UnitPrice: 50, Discount: 20},
+		{ID: "3", TaxCode: vfd.TaxableItemCode, Quantity: 1, UnitPrice: 300, Discount: 150},
+	}
+	receipt := testReceipt()
+	receipt.Items = items
+
+	payload, err := vfd.ReceiptBytes(privateKey, receipt.Params, receipt.Customer, items, receipt.Payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := vfd.DecodeReceipt(payload)
+	if err != nil {
+		t.Fatalf("DecodeReceipt() error = %v", err)
+	}
+
+	var got []float64
+	for _, item := range signed.Request.Items {
+		got = append(got, item.Discount)
+	}
+	if want := []float64{100, 20, 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("item discounts = %v, want %v", got, want)
+	}
+
+	// the discount moved from item 3 to item 1, so only the tax inclusive
+	// totals are guaranteed to match
+	want := vfd.ProcessItems(items).TOTALS
+	decoded := vfd.ProcessItems(signed.Request.Items).TOTALS
+	if decoded.TOTALTAXINCL != want.TOTALTAXINCL || decoded.DISCOUNT != want.DISCOUNT {
+		t.Errorf("totals of the decoded items = %+v, want %+v", decoded, want)
+	}
+}
+
+func TestDecodeReport(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	params := &vfd.ReportParams{
+		Date:             "2023-01-01",
+		Time:             "23:59:59",
+		VRN:              "NOT REGISTERED",
+		TIN:              "123456789",
+		UIN:              "09VFDWEBAPI-123456789",
+		TaxOffice:        "Kinondoni",
+		RegistrationID:   "TZ0100089",
+		ZNumber:          "20230101",
+		EFDSerial:        "10TZ100089",
+		RegistrationDate: "2022-10-01",
+	}
+	address := vfd.Address{Name: "ACME LTD", Street: "MOROGORO ROAD", Mobile: "0700000000", City: "DAR ES SALAAM", Country: "TANZANIA"}
+	totals := vfd.ReportTotals{DailyTotalAmount: 4900.3, Gross: 104900.3, Discounts: 100, TicketsFiscal: 2}
+	vats := []vfd.VATTOTAL{
+		{ID: "A", Rate: 18, NetAmount: 2457.88, TaxAmount: 442.42},
+		{ID: "B", Rate: 0}, {ID: "C", Rate: 0, NetAmount: 2000}, {ID: "D", Rate: 0}, {ID: "E", Rate: 0},
+	}
+	payments := []vfd.Payment{
+		{Type: vfd.CashPaymentType, Amount: 4900}, {Type: vfd.ChequePaymentType},
+		{Type: vfd.CreditCardPaymentType}, {Type: vfd.ElectronicPaymentType, Amount: 0.3},
+		{Type: vfd.InvoicePaymentType},
+	}
+
+	payload, err := vfd.ReportBytes(privateKey, params, address, vats, payments, totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "report.xml")
+	if err := os.WriteFile(path, payload, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := vfd.DecodeReportFile(path)
+	if err != nil {
+		t.Fatalf("DecodeReportFile() error = %v", err)
+	}
+	want := &vfd.ReportRequest{Params: params, Address: &address, Totals: &totals, VATS: vats, Payment: payments}
+	if !reflect.DeepEqual(signed.Request, want) {
+		t.Errorf("DecodeReport() request = %+v\nwant %+v", signed.Request, want)
+	}
+	if err := signed.Verify(&privateKey.PublicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	r := signed.Request
+	again, err := vfd.ReportBytes(privateKey, r.Params, *r.Address, r.VATS, r.Payment, *r.Totals)
+	if err != nil || !bytes.Equal(again, payload) {
+		t.Errorf("ReportBytes() of the decoded report differs: %s, %v", again, err)
+	}
+}
+
+func TestDecodeInvalidEnvelope(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"<EFDMS><RCT>",
+		"<EFDMS><RCT><PAYMENTS><PMTTYPE>CASH</PMTTYPE></PAYMENTS></RCT><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>",
+		"<EFDMS><RCT></RCT></EFDMS>",
+	} {
+		if _, err := vfd.DecodeReceipt([]byte(data)); !errors.Is(err, vfd.ErrInvalidEnvelope) {
+			t.Errorf("DecodeReceipt(%q) error = %v, want %v", data, err, vfd.ErrInvalidEnvelope)
+		}
+	}
+
+	data := "<EFDMS><ZREPORT><VATTOTALS><VATRATE>A18</VATRATE><NETTAMOUNT>0</NETTAMOUNT>" +
+		"<TAXAMOUNT>0</TAXAMOUNT></VATTOTALS></ZREPORT><EFDMSSIGNATURE>x</EFDMSSIGNATURE></EFDMS>"
+	if _, err := vfd.DecodeReport([]byte(data)); !errors.Is(err, vfd.ErrInvalidEnvelope) {
+		t.Errorf("DecodeReport() error = %v, want %v", err, vfd.ErrInvalidEnvelope)
+	}
+}
+
+func TestDecodeRejectsDuplicateSignedElements(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	receipt := testReceipt()
+	payload, err := vfd.ReceiptBytes(privateKey, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := vfd.DecodeReceipt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed RCT is kept and an unsigned one is added after it, which
+	// xml.Unmarshal would read instead.
+	forged := bytes.Replace(signed.Payload, []byte("<GC>1</GC>"), []byte("<GC>2</GC>"), 1)
+	data := bytes.Replace(payload, []byte("</EFDMS>"), append(forged, []byte("</EFDMS>")...), 1)
+	if _, err := vfd.DecodeReceipt(data); !errors.Is(err, vfd.ErrInvalidEnvelope) {
+		t.Errorf("DecodeReceipt() with two RCT error = %v, want %v", err, vfd.ErrInvalidEnvelope)
+	}
+
+	report := []byte("<EFDMS><ZREPORT><ZNUMBER>20230101</ZNUMBER></ZREPORT>" +
+		"<EFDMSSIGNATURE>x</EFDMSSIGNATURE><ZREPORT><ZNUMBER>20230102</ZNUMBER></ZREPORT></EFDMS>")
+	if _, err := vfd.DecodeReport(report); !errors.Is(err, vfd.ErrInvalidEnvelope) {
+		t.Errorf("DecodeReport() with two ZREPORT error = %v, want %v", err, vfd.ErrInvalidEnvelope)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 )
 
 // ACKCODE	STATUS	DESCRIPTION	POSSIBLE REASON
@@ -26,8 +27,27 @@ const (
 	InvalidSerial        int64 = 6
 	InvalidClientHeader  int64 = 7
 	InvalidCertificate   int64 = 8
+
+	// UnknownAckCode is the Code of an AckError built from a response that
+	// carried no ACKCODE, such as an HTTP 500 or a failed token request.
+	UnknownAckCode int64 = -1
+)
+
+// Sentinel errors matched by errors.Is for an *AckError with the corresponding
+// ACKCODE.
+var (
+	ErrInvalidSignature    = errors.New("invalid signature")
+	ErrInvalidTaxID        = errors.New("invalid TIN")
+	ErrApprovalRequired    = errors.New("VFD registration approval required")
+	ErrUnhandledException  = errors.New("unhandled exception")
+	ErrInvalidSerial       = errors.New("invalid serial or serial not registered to Web API/TIN")
+	ErrInvalidClientHeader = errors.New("invalid client header")
+	ErrInvalidCertificate  = errors.New("wrong certificate used to register Web API")
 )
 
+// ErrUnauthorized is matched by errors.Is for every *AuthError.
+var ErrUnauthorized = errors.New("unauthorized")
+
 type (
 	Error struct {
 		Code    int64  `json:"code,omitempty"`
@@ -39,8 +59,147 @@ type (
 		Err     error
 		Message string
 	}
+
+	// AuthError is returned when the VFD server rejects a submission with HTTP 401
+	// or 403, which happens when the bearer token has expired or was revoked.
+	// Body is the raw response body.
+	AuthError struct {
+		Action     Action
+		StatusCode int
+		Body       []byte
+	}
+
+	// AckError is returned when the VFD server answers a registration, token,
+	// receipt or Z report request with anything other than success. Code is the
+	// ACKCODE or UnknownAckCode, StatusCode the HTTP status and Body the raw
+	// response body. Submissions return the decoded *Response alongside the
+	// AckError so that the acknowledgement is never lost.
+	//
+	// errors.Is matches an AckError against the sentinel of its code, such as
+	// ErrInvalidSignature, and against the failure sentinel of its action, such
+	// as ErrReceiptUploadFailed.
+	AckError struct {
+		Action     Action
+		Code       int64
+		Message    string
+		StatusCode int
+		Body       []byte
+	}
+
+	// UnreadableAckError is returned when a receipt or Z report submission was
+	// answered but the acknowledgement could not be decoded or its
+	// EFDMSSIGNATURE did not verify. The VFD server may have accepted the
+	// submission, Body is the raw response body to reconcile it with. Err is the
+	// decoding error or wraps ErrInvalidAckSignature.
+	UnreadableAckError struct {
+		Action Action
+		Body   []byte
+		Err    error
+	}
 )
 
+func (e *AckError) Error() string {
+	if e.Code == UnknownAckCode {
+		return fmt.Sprintf("%v: status code %d: %s", actionFailure(e.Action), e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%v: ack code %d: %s", actionFailure(e.Action), e.Code, e.Message)
+}
+
+// Is reports whether target is the sentinel of the code or of the action of e.
+func (e *AckError) Is(target error) bool {
+	if target == actionFailure(e.Action) {
+		return true
+	}
+	sentinel := ackCodeError(e.Code)
+	return sentinel != nil && target == sentinel
+}
+
+// Retryable reports whether sending the same request again may succeed. Only
+// unhandled exceptions and HTTP 5xx answers are retryable, every other code
+// means the request itself is wrong and will be rejected again.
+func (e *AckError) Retryable() bool {
+	return e.Code == UnhandledException || e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsAckError returns true if the error is an AckError.
+func IsAckError(err error) bool {
+	ackErr := &AckError{}
+	return errors.As(err, &ackErr)
+}
+
+// IsRetryable returns true if the request that failed with err may succeed when
+// it is sent again: network errors, authentication errors, which go away with a
+// new token, and retryable AckErrors.
+func IsRetryable(err error) bool {
+	ackErr := &AckError{}
+	if errors.As(err, &ackErr) {
+		return ackErr.Retryable()
+	}
+	return IsNetworkError(err) || IsAuthError(err)
+}
+
+// ackCodeError returns the sentinel error of code or nil.
+func ackCodeError(code int64) error {
+	switch code {
+	case InvalidSignatureCode:
+		return ErrInvalidSignature
+	case InvalidTaxID:
+		return ErrInvalidTaxID
+	case ApprovalRequired:
+		return ErrApprovalRequired
+	case UnhandledException:
+		return ErrUnhandledException
+	case InvalidSerial:
+		return ErrInvalidSerial
+	case InvalidClientHeader:
+		return ErrInvalidClientHeader
+	case InvalidCertificate:
+		return ErrInvalidCertificate
+	default:
+		return nil
+	}
+}
+
+// actionFailure returns the sentinel error used to wrap failures of action.
+func actionFailure(action Action) error {
+	switch action {
+	case RegisterClientAction:
+		return ErrRegistrationFailed
+	case FetchTokenAction:
+		return ErrFetchToken
+	case SubmitReportAction:
+		return ErrReportSubmitFailed
+	default:
+		return ErrReceiptUploadFailed
+	}
+}
+
+func (e *UnreadableAckError) Error() string {
+	if errors.Is(e.Err, ErrInvalidAckSignature) {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v : %v", actionFailure(e.Action), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *UnreadableAckError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %s: status code %d", e.Action, ErrUnauthorized, e.StatusCode)
+}
+
+// Is reports whether target is ErrUnauthorized.
+func (e *AuthError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// IsAuthError returns true if the error is an AuthError.
+func IsAuthError(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
+
 func (e *NetworkError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Message, e.Err.Error())
 }
@@ -0,0 +1,109 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestAckErrorIs(t *testing.T) {
+	tests := []struct {
+		err       *vfd.AckError
+		sentinels []error
+		retryable bool
+	}{
+		{
+			err:       &vfd.AckError{Action: vfd.SubmitReceiptAction, Code: vfd.InvalidSignatureCode, StatusCode: 200},
+			sentinels: []error{vfd.ErrInvalidSignature, vfd.ErrReceiptUploadFailed},
+		},
+		{
+			err:       &vfd.AckError{Action: vfd.SubmitReportAction, Code: vfd.UnhandledException, StatusCode: 200},
+			sentinels: []error{vfd.ErrUnhandledException, vfd.ErrReportSubmitFailed},
+			retryable: true,
+		},
+		{
+			err:       &vfd.AckError{Action: vfd.RegisterClientAction, Code: vfd.InvalidCertificate, StatusCode: 200},
+			sentinels: []error{vfd.ErrInvalidCertificate, vfd.ErrRegistrationFailed},
+		},
+		{
+			err:       &vfd.AckError{Action: vfd.FetchTokenAction, Code: vfd.UnknownAckCode, StatusCode: 503},
+			sentinels: []error{vfd.ErrFetchToken},
+			retryable: true,
+		},
+	}
+	for _, tt := range tests {
+		err := fmt.Errorf("wrapped: %w", tt.err)
+		for _, sentinel := range tt.sentinels {
+			if !errors.Is(err, sentinel) {
+				t.Errorf("errors.Is(%v, %v) = false", err, sentinel)
+			}
+		}
+		if errors.Is(err, vfd.ErrInvalidTaxID) {
+			t.Errorf("errors.Is(%v, %v) = true", err, vfd.ErrInvalidTaxID)
+		}
+		if got := vfd.IsRetryable(err); got != tt.retryable {
+			t.Errorf("IsRetryable(%v) = %v, want %v", err, got, tt.retryable)
+		}
+	}
+
+	if vfd.IsRetryable(errors.New("boom")) {
+		t.Error("IsRetryable() of a plain error = true")
+	}
+	if !vfd.IsRetryable(&vfd.AuthError{Action: vfd.SubmitReceiptAction, StatusCode: 401}) {
+		t.Error("IsRetryable() of an AuthError = false")
+	}
+}
+
+func TestSubmitReceiptAckError(t *testing.T) {
+	body := strings.Replace(strings.Replace(receiptAckBody, "<ACKCODE>0", "<ACKCODE>3", 1),
+		"Success", "Invalid TIN", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	client := vfd.NewClient(vfd.WithHttpClient(server.Client()))
+	headers := &vfd.RequestHeaders{CertSerial: "serial", BearerToken: "token"}
+	resp, err := client.SubmitReceipt(context.Background(), server.URL, headers, testPrivateKey(t), testReceipt())
+	if resp == nil || resp.Code != vfd.InvalidTaxID {
+		t.Fatalf("SubmitReceipt() = %+v, want the acknowledgement", resp)
+	}
+
+	ackErr := &vfd.AckError{}
+	if !errors.As(err, &ackErr) {
+		t.Fatalf("SubmitReceipt() error = %v, want an AckError", err)
+	}
+	if ackErr.Code != vfd.InvalidTaxID || ackErr.Message != "Invalid TIN" || string(ackErr.Body) != body {
+		t.Errorf("AckError = %+v", ackErr)
+	}
+	if !errors.Is(err, vfd.ErrInvalidTaxID) || vfd.IsRetryable(err) {
+		t.Errorf("SubmitReceipt() error = %v, want a permanent %v", err, vfd.ErrInvalidTaxID)
+	}
+}
+
+func TestFetchTokenAckError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ACKCODE", "6")
+		w.Header().Set("ACKMSG", "Invalid Serial")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprint(w, `{"error":"invalid_grant"}`)
+	}))
+	defer server.Close()
+
+	client := vfd.NewClient(vfd.WithHttpClient(server.Client()))
+	_, err := client.FetchToken(context.Background(), server.URL, &vfd.TokenRequest{Username: "u", Password: "p"})
+
+	ackErr := &vfd.AckError{}
+	if !errors.As(err, &ackErr) || ackErr.Action != vfd.FetchTokenAction || ackErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("FetchToken() error = %v, want an AckError", err)
+	}
+	if !errors.Is(err, vfd.ErrInvalidSerial) || !errors.Is(err, vfd.ErrFetchToken) {
+		t.Errorf("FetchToken() error = %v, want %v and %v", err, vfd.ErrInvalidSerial, vfd.ErrFetchToken)
+	}
+}
@@ -0,0 +1,106 @@
+package vfd
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/vfdcloud/vfd/pkg/qrcode"
+)
+
+// ESC/POS commands used to print receipts.
+var (
+	escposInit       = []byte{0x1B, 0x40}             // ESC @
+	escposBoldOn     = []byte{0x1B, 0x45, 0x01}       // ESC E 1
+	escposBoldOff    = []byte{0x1B, 0x45, 0x00}       // ESC E 0
+	escposFeedAndCut = []byte{0x1D, 0x56, 0x42, 0x03} // GS V 66 3, feed 3 lines and cut partially
+)
+
+// escposAlign returns ESC a n.
+func escposAlign(a lineAlign) []byte {
+	n := byte(0)
+	switch a {
+	case alignCenter:
+		n = 1
+	case alignRight:
+		n = 2
+	}
+	return []byte{0x1B, 0x61, n}
+}
+
+// escposQR returns the GS ( k commands that select QR model 2, the module size
+// and the error correction level, store data and print it.
+func escposQR(data []byte, moduleSize byte, level qrcode.Level) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x1D, 0x28, 0x6B, 0x04, 0x00, 0x31, 0x41, 0x32, 0x00})
+	b.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x43, moduleSize})
+	b.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x45, 0x30 + byte(level)})
+	n := len(data) + 3
+	b.Write([]byte{0x1D, 0x28, 0x6B, byte(n), byte(n >> 8), 0x31, 0x50, 0x30})
+	b.Write(data)
+	b.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x51, 0x30})
+	return b.Bytes()
+}
+
+// WriteESCPOS writes the receipt as ESC/POS commands for a thermal printer of
+// width characters per line, use PaperWidth58mm or PaperWidth80mm. Headers and
+// the total are bold, centred lines use the printer alignment, the QR code is
+// printed with the native QR command and the paper is cut at the end.
+//
+// Printers use single byte code pages, so characters outside ASCII are printed
+// as '?'.
+func (d *ReceiptDocument) WriteESCPOS(w io.Writer, width int) error {
+	lines, err := d.layout(width)
+	if err != nil {
+		return err
+	}
+
+	moduleSize := byte(6)
+	if width <= PaperWidth58mm {
+		moduleSize = 4
+	}
+
+	var b bytes.Buffer
+	b.Write(escposInit)
+	current := alignLeft
+	setAlign := func(a lineAlign) {
+		if a != current {
+			b.Write(escposAlign(a))
+			current = a
+		}
+	}
+
+	for _, line := range lines {
+		if line.qr {
+			setAlign(alignCenter)
+			b.Write(escposQR([]byte(d.Link()), moduleSize, qrcode.Medium))
+			b.WriteByte('\n')
+			continue
+		}
+
+		setAlign(line.align)
+		if line.bold {
+			b.Write(escposBoldOn)
+		}
+		b.WriteString(asciiOnly(line.text))
+		if line.bold {
+			b.Write(escposBoldOff)
+		}
+		b.WriteByte('\n')
+	}
+	b.Write(escposFeedAndCut)
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// asciiOnly replaces the characters outside ASCII with '?'.
+func asciiOnly(text string) string {
+	out := []byte(nil)
+	for _, r := range text {
+		if r < 0x20 || r > 0x7E {
+			r = '?'
+		}
+		out = append(out, byte(r))
+	}
+	return string(out)
+}
@@ -0,0 +1,149 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package vfd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleLockAge is how long a lock file may go without being touched before it
+// is taken to be left behind by a holder that crashed. The holder touches the
+// file every lockTouchInterval for as long as it holds the lock, however long
+// the work done under it, such as signing with a remote signer, takes.
+const staleLockAge = 30 * time.Second
+
+// lockTouchInterval is how often a held lock file is touched.
+var lockTouchInterval = staleLockAge / 3
+
+// lockPath takes an exclusive lock by creating the file at path, waiting while
+// another holder has it, and returns the function that releases it. The file
+// holds the process ID of the holder, a lock whose holder is no longer running
+// or that was not touched for staleLockAge is broken.
+func lockPath(ctx context.Context, path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, err
+			}
+			return holdLock(path), nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		broken, err := breakStaleLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if broken {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// holdLock touches the lock file at path until the returned function is
+// called, which then removes it.
+func holdLock(path string) func() {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockTouchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				_ = os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		_ = os.Remove(path)
+	}
+}
+
+// breakStaleLock removes the lock file at path when its holder is gone and
+// reports whether the lock can be tried again right away.
+func breakStaleLock(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return os.IsNotExist(err), nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err), nil
+	}
+
+	stale := time.Since(info.ModTime()) > staleLockAge
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && !processRunning(pid) {
+		stale = true
+	}
+	if !stale {
+		return false, nil
+	}
+
+	// The lock is moved aside before it is removed so that a lock taken by
+	// another waiter in the meantime is not removed with it.
+	moved := fmt.Sprintf("%s.%d.stale", path, os.Getpid())
+	if err := os.Rename(path, moved); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("could not break stale lock %s: %w", path, err)
+	}
+	defer func() { _ = os.Remove(moved) }()
+
+	movedData, err := os.ReadFile(moved)
+	if err != nil {
+		return false, err
+	}
+	movedInfo, err := os.Stat(moved)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(movedData, data) || !movedInfo.ModTime().Equal(info.ModTime()) {
+		// Another waiter broke the lock and took it first, give it back.
+		if err := os.Link(moved, path); err != nil {
+			return false, fmt.Errorf("could not restore lock %s: %w", path, err)
+		}
+	}
+
+	return true, nil
+}
+
+// processRunning reports whether a process with the ID pid is running. It is
+// only known on Windows, elsewhere the age of the lock decides.
+func processRunning(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
@@ -0,0 +1,65 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLockPathBreaksStaleLock(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "counters.json.lock")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockPath(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockPath() on a held lock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := lockPath(ctx, path)
+	if err != nil {
+		t.Fatalf("lockPath() on a stale lock error = %v", err)
+	}
+	unlock()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file still exists after unlock: %v", err)
+	}
+}
+
+func TestLockPathTouchesHeldLock(t *testing.T) {
+	interval := lockTouchInterval
+	lockTouchInterval = 10 * time.Millisecond
+	defer func() { lockTouchInterval = interval }()
+
+	path := filepath.Join(t.TempDir(), "counters.json.lock")
+	unlock, err := lockPath(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if broken, err := breakStaleLock(path); err != nil || broken {
+		t.Fatalf("breakStaleLock() of a held lock = %v, %v, want it kept", broken, err)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package vfd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockPathHonorsContext(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "counters.json.lock")
+	unlock, err := lockPath(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockPath(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockPath() on a held lock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err = lockPath(ctx, path)
+	if err != nil {
+		t.Fatalf("lockPath() after unlock error = %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,61 @@
+package vfd_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func testPrivateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate private key: %v", err)
+	}
+	return privateKey
+}
+
+func testCertificate(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	privateKey := testPrivateKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vfd test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+	return privateKey, cert
+}
+
+func testReceipt() *vfd.ReceiptRequest {
+	return &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date:          "2023-01-01",
+			Time:          "10:00:00",
+			TIN:           "123456789",
+			GlobalCounter: 1,
+			DailyCounter:  1,
+		},
+		Customer: vfd.Customer{Type: vfd.NonCustomerID},
+		Items: []vfd.Item{
+			{ID: "1", Description: "Item", TaxCode: vfd.TaxableItemCode, Quantity: 1, UnitPrice: 1000},
+		},
+		Payments: []vfd.Payment{
+			{Type: vfd.CashPaymentType, Amount: 1000},
+		},
+	}
+}
@@ -0,0 +1,67 @@
+// Package element finds signed elements in EFDMS envelopes and acknowledgements,
+// for the vfd package and its vfdtest simulator to read envelopes the same way.
+package element
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned by Bytes when body has no element of the name.
+var ErrNotFound = errors.New("element not found")
+
+// Bytes returns the bytes of the element called name in body, from the start of
+// its opening tag to the end of its closing tag, exactly as they appear. It
+// fails with ErrNotFound when there is no such element and with an
+// error when there are several, which are read differently by xml.Unmarshal.
+func Bytes(body []byte, name string) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var (
+		found []byte
+		start int64 = -1
+		depth int
+	)
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF && start >= 0 {
+			line := bytes.Count(body, []byte("\n")) + 1
+			return nil, &xml.SyntaxError{Msg: fmt.Sprintf("element %s is not closed", name), Line: line}
+		}
+		if err == io.EOF {
+			if found == nil {
+				return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+			}
+			return found, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local != name {
+				continue
+			}
+			if found != nil {
+				return nil, fmt.Errorf("more than one element %s", name)
+			}
+			if start < 0 {
+				start = offset
+			}
+			depth++
+		case xml.EndElement:
+			if t.Name.Local != name || start < 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				found = body[start:decoder.InputOffset()]
+				start = -1
+			}
+		}
+	}
+}
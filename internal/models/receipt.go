@@ -2,10 +2,9 @@ package models
 
 import (
 	"encoding/xml"
-	"math"
-)
 
-const hundred = 100
+	"github.com/vfdcloud/vfd/pkg/money"
+)
 
 type (
 	// RCTACK is the receipt acknowledge received from
@@ -57,29 +56,29 @@ type (
 	}
 
 	ITEM struct {
-		XMLName xml.Name `xml:"ITEM"`
-		Text    string   `xml:",chardata"`
-		ID      string   `xml:"ID"`
-		DESC    string   `xml:"DESC"`
-		QTY     float64  `xml:"QTY"`
-		TAXCODE int64    `xml:"TAXCODE"`
-		AMT     float64  `xml:"AMT"`
+		XMLName xml.Name    `xml:"ITEM"`
+		Text    string      `xml:",chardata"`
+		ID      string      `xml:"ID"`
+		DESC    string      `xml:"DESC"`
+		QTY     float64     `xml:"QTY"`
+		TAXCODE int64       `xml:"TAXCODE"`
+		AMT     money.Money `xml:"AMT"`
 	}
 
 	TOTALS struct {
-		XMLName      xml.Name `xml:"TOTALS"`
-		Text         string   `xml:",chardata"`
-		TOTALTAXEXCL float64  `xml:"TOTALTAXEXCL"`
-		TOTALTAXINCL float64  `xml:"TOTALTAXINCL"`
-		DISCOUNT     float64  `xml:"DISCOUNT"`
+		XMLName      xml.Name    `xml:"TOTALS"`
+		Text         string      `xml:",chardata"`
+		TOTALTAXEXCL money.Money `xml:"TOTALTAXEXCL"`
+		TOTALTAXINCL money.Money `xml:"TOTALTAXINCL"`
+		DISCOUNT     money.Money `xml:"DISCOUNT"`
 	}
 
 	VATTOTAL struct {
-		XMLName    xml.Name `xml:"VATTOTAL"`
-		Text       string   `xml:",chardata"`
-		VATRATE    string   `xml:"VATRATE"`
-		NETTAMOUNT string   `xml:"NETTAMOUNT"`
-		TAXAMOUNT  string   `xml:"TAXAMOUNT"`
+		XMLName    xml.Name    `xml:"VATTOTAL"`
+		Text       string      `xml:",chardata"`
+		VATRATE    string      `xml:"VATRATE"`
+		NETTAMOUNT money.Money `xml:"NETTAMOUNT"`
+		TAXAMOUNT  money.Money `xml:"TAXAMOUNT"`
 	}
 
 	VATTOTALS struct {
@@ -89,10 +88,10 @@ type (
 	}
 
 	PAYMENT struct {
-		XMLName   xml.Name `xml:"PAYMENT"`
-		Text      string   `xml:",chardata"`
-		PMTTYPE   string   `xml:"PMTTYPE"`
-		PMTAMOUNT string   `xml:"PMTAMOUNT"`
+		XMLName   xml.Name    `xml:"PAYMENT"`
+		Text      string      `xml:",chardata"`
+		PMTTYPE   string      `xml:"PMTTYPE"`
+		PMTAMOUNT money.Money `xml:"PMTAMOUNT"`
 	}
 
 	PAYMENTS struct {
@@ -101,12 +100,3 @@ type (
 		PAYMENT []*PAYMENT `xml:"PAYMENT"`
 	}
 )
-
-// RoundOff is a helper function to round off the all the values of RCT with float64 as a Data Type
-// to 2 decimal places.
-func (r *RCT) RoundOff() {
-	// RoundOff all the RCT.TOTALS
-	r.TOTALS.TOTALTAXEXCL = math.Round(r.TOTALS.TOTALTAXEXCL*hundred) / hundred
-	r.TOTALS.TOTALTAXINCL = math.Round(r.TOTALS.TOTALTAXINCL*hundred) / hundred
-	r.TOTALS.DISCOUNT = math.Round(r.TOTALS.DISCOUNT*hundred) / hundred
-}
@@ -2,7 +2,8 @@ package models
 
 import (
 	"encoding/xml"
-	"math"
+
+	"github.com/vfdcloud/vfd/pkg/money"
 )
 
 type (
@@ -57,27 +58,16 @@ type (
 	}
 
 	REPORTTOTALS struct {
-		XMLName          xml.Name `xml:"TOTALS"`
-		Text             string   `xml:",chardata"`
-		DAILYTOTALAMOUNT float64  `xml:"DAILYTOTALAMOUNT"`
-		GROSS            float64  `xml:"GROSS"`
-		CORRECTIONS      float64  `xml:"CORRECTIONS"`
-		DISCOUNTS        float64  `xml:"DISCOUNTS"`
-		SURCHARGES       float64  `xml:"SURCHARGES"`
-		TICKETSVOID      int64    `xml:"TICKETSVOID"`
-		TICKETSVOIDTOTAL float64  `xml:"TICKETSVOIDTOTAL"`
-		TICKETSFISCAL    int64    `xml:"TICKETSFISCAL"`
-		TICKETSNONFISCAL int64    `xml:"TICKETSNONFISCAL"`
+		XMLName          xml.Name    `xml:"TOTALS"`
+		Text             string      `xml:",chardata"`
+		DAILYTOTALAMOUNT money.Money `xml:"DAILYTOTALAMOUNT"`
+		GROSS            money.Money `xml:"GROSS"`
+		CORRECTIONS      money.Money `xml:"CORRECTIONS"`
+		DISCOUNTS        money.Money `xml:"DISCOUNTS"`
+		SURCHARGES       money.Money `xml:"SURCHARGES"`
+		TICKETSVOID      int64       `xml:"TICKETSVOID"`
+		TICKETSVOIDTOTAL money.Money `xml:"TICKETSVOIDTOTAL"`
+		TICKETSFISCAL    int64       `xml:"TICKETSFISCAL"`
+		TICKETSNONFISCAL int64       `xml:"TICKETSNONFISCAL"`
 	}
 )
-
-// RoundOff is a helper function to round off all the ZREPORT values with data type
-// float64 to 2 decimal places
-func (z *ZREPORT) RoundOff() {
-	z.TOTALS.DAILYTOTALAMOUNT = math.Round(z.TOTALS.DAILYTOTALAMOUNT*100) / 100
-	z.TOTALS.GROSS = math.Round(z.TOTALS.GROSS*100) / 100
-	z.TOTALS.CORRECTIONS = math.Round(z.TOTALS.CORRECTIONS*100) / 100
-	z.TOTALS.DISCOUNTS = math.Round(z.TOTALS.DISCOUNTS*100) / 100
-	z.TOTALS.SURCHARGES = math.Round(z.TOTALS.SURCHARGES*100) / 100
-	z.TOTALS.TICKETSVOIDTOTAL = math.Round(z.TOTALS.TICKETSVOIDTOTAL*100) / 100
-}
@@ -0,0 +1,483 @@
+package vfd
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+const (
+	OutboxPending      OutboxStatus = "pending"
+	OutboxAcknowledged OutboxStatus = "acknowledged"
+	OutboxRejected     OutboxStatus = "rejected"
+	OutboxFailed       OutboxStatus = "failed"
+	OutboxUnverified   OutboxStatus = "unverified"
+
+	DefaultOutboxMinBackoff = 5 * time.Second
+	DefaultOutboxMaxBackoff = 5 * time.Minute
+)
+
+// ErrOutboxEntryNotFound is returned by OutboxStore.Get when there is no entry
+// with the given id.
+var ErrOutboxEntryNotFound = errors.New("outbox entry not found")
+
+// ErrOutboxEntryExists is returned by OutboxStore.Insert when there already is
+// an entry with the same id.
+var ErrOutboxEntryExists = errors.New("outbox entry already exists")
+
+type (
+	// OutboxStatus is the delivery state of an OutboxEntry. Entries start as pending
+	// and become acknowledged when the VFD server accepts them or rejected when it
+	// answers with an ACKCODE other than SuccessCode that is not retryable. Entries
+	// that fail without an answer and would fail again, such as a payload that can
+	// not be sent at all, become failed and stay in the store until deleted.
+	// Entries whose answer can not be decoded or fails the check of
+	// WithAckCertificate become unverified: the VFD server may have accepted them,
+	// RawAck keeps the answer so that they can be reconciled, and they too stay in
+	// the store until deleted.
+	OutboxStatus string
+
+	// OutboxEntry is a signed receipt waiting to be delivered, or already delivered,
+	// to the VFD server. Payload is the EFDMS envelope exactly as produced by
+	// ReceiptBytes and Ack is the RCTACK received for it. RawAck is the answer of
+	// an unverified entry. Surcharges is the total of the SurchargeAdjustment
+	// shares of the receipt, for ZReportAggregator.AddEnvelopeWithSurcharges.
+	OutboxEntry struct {
+		ID            string       `json:"id"`
+		EFDSerial     string       `json:"efd_serial"`
+		GlobalCounter int64        `json:"gc"`
+		Payload       []byte       `json:"payload"`
+		Status        OutboxStatus `json:"status"`
+		Attempts      int          `json:"attempts"`
+		LastError     string       `json:"last_error,omitempty"`
+		CreatedAt     time.Time    `json:"created_at"`
+		NextAttempt   time.Time    `json:"next_attempt"`
+		DeliveredAt   time.Time    `json:"delivered_at,omitempty"`
+		Ack           *Response    `json:"ack,omitempty"`
+		RawAck        []byte       `json:"raw_ack,omitempty"`
+		Surcharges    float64      `json:"surcharges,omitempty"`
+	}
+
+	// OutboxStore persists outbox entries. Put inserts or replaces the entry with
+	// the same ID. Insert only adds an entry whose ID is not taken yet, in a single
+	// step, and returns ErrOutboxEntryExists otherwise.
+	OutboxStore interface {
+		Put(ctx context.Context, entry *OutboxEntry) error
+		Insert(ctx context.Context, entry *OutboxEntry) error
+		Get(ctx context.Context, id string) (*OutboxEntry, error)
+		List(ctx context.Context) ([]*OutboxEntry, error)
+		Delete(ctx context.Context, id string) error
+	}
+
+	// OutboxSender delivers the payload of an entry to the VFD server.
+	OutboxSender func(ctx context.Context, entry *OutboxEntry) (*Response, error)
+
+	// OutboxOption configures an Outbox.
+	OutboxOption func(*Outbox)
+
+	// Outbox persists signed receipts before they are sent and keeps retrying their
+	// delivery in the background, so that the receipt can be printed while the VFD
+	// server is unreachable. Receipts of the same EFD serial are delivered strictly in
+	// GC order: a receipt is not sent until all receipts with a lower GC have been
+	// acknowledged or rejected.
+	Outbox struct {
+		store      OutboxStore
+		send       OutboxSender
+		minBackoff time.Duration
+		maxBackoff time.Duration
+		now        func() time.Time
+		onDelivery func(entry *OutboxEntry)
+		client     *Client
+		wake       chan struct{}
+		flushMu    sync.Mutex
+	}
+
+	// MemoryOutboxStore keeps outbox entries in memory.
+	MemoryOutboxStore struct {
+		mu      sync.Mutex
+		entries map[string]*OutboxEntry
+	}
+)
+
+// Receipt decodes the Payload of the entry with DecodeReceipt.
+func (e *OutboxEntry) Receipt() (*SignedReceipt, error) {
+	return DecodeReceipt(e.Payload)
+}
+
+// WithOutboxBackoff sets the delay before the first retry and the upper bound of
+// the exponential backoff between retries.
+func WithOutboxBackoff(minDelay, maxDelay time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		if minDelay > 0 {
+			o.minBackoff = minDelay
+		}
+		if maxDelay >= o.minBackoff {
+			o.maxBackoff = maxDelay
+		}
+	}
+}
+
+// WithOutboxClock replaces time.Now, mostly useful in tests.
+func WithOutboxClock(now func() time.Time) OutboxOption {
+	return func(o *Outbox) {
+		if now != nil {
+			o.now = now
+		}
+	}
+}
+
+// WithOutboxClient sets the Client whose PayloadSigner, tax rates and
+// validation Add signs receipts with, usually the one of ReceiptSender. The
+// default is a Client without options.
+func WithOutboxClient(client *Client) OutboxOption {
+	return func(o *Outbox) {
+		if client != nil {
+			o.client = client
+		}
+	}
+}
+
+// WithDeliveryHook sets a callback invoked every time an entry is acknowledged,
+// rejected or left unverified by the VFD server, or fails for good.
+func WithDeliveryHook(hook func(entry *OutboxEntry)) OutboxOption {
+	return func(o *Outbox) {
+		o.onDelivery = hook
+	}
+}
+
+// NewOutbox creates an Outbox that keeps entries in store and delivers them with send.
+func NewOutbox(store OutboxStore, send OutboxSender, options ...OutboxOption) *Outbox {
+	o := &Outbox{
+		store:      store,
+		send:       send,
+		minBackoff: DefaultOutboxMinBackoff,
+		maxBackoff: DefaultOutboxMaxBackoff,
+		now:        time.Now,
+		client:     NewClient(),
+		wake:       make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+// ReceiptSender returns an OutboxSender that submits entries to url with the Client,
+// using its TokenSource when headers carry no bearer token.
+func (c *Client) ReceiptSender(url string, headers *RequestHeaders) OutboxSender {
+	return func(ctx context.Context, entry *OutboxEntry) (*Response, error) {
+		return c.submit(ctx, headers, func(headers *RequestHeaders) (*Response, error) {
+			return submitReceiptPayload(ctx, c.http, url, headers, entry.Payload, c.ackCert)
+		})
+	}
+}
+
+// OutboxEntryID returns the id of the outbox entry of the receipt with the given
+// EFD serial and global counter.
+func OutboxEntryID(efdSerial string, gc int64) string {
+	return fmt.Sprintf("%s-%020d", efdSerial, gc)
+}
+
+// Add validates and signs the receipt with Client.ReceiptBytes, see
+// WithOutboxClient, persists the envelope and wakes up the delivery loop. Once Add
+// returns the receipt is safe to print: it will be delivered even if the process
+// restarts, as long as the store is durable.
+func (o *Outbox) Add(ctx context.Context, signer crypto.Signer, receipt *ReceiptRequest) (*OutboxEntry, error) {
+	payload, err := o.client.ReceiptBytes(signer, receipt)
+	if err != nil {
+		return nil, err
+	}
+	result, err := o.client.taxes.ProcessItems(receipt.Params, receipt.Items, receipt.Adjustments...)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.enqueue(ctx, receipt.Params.EFDSerial, receipt.Params.GlobalCounter, payload, result.surcharges())
+}
+
+// Enqueue persists an already signed receipt envelope and wakes up the delivery
+// loop. The Surcharges of the entry are left at 0.
+func (o *Outbox) Enqueue(ctx context.Context, efdSerial string, gc int64, payload []byte) (*OutboxEntry, error) {
+	return o.enqueue(ctx, efdSerial, gc, payload, 0)
+}
+
+func (o *Outbox) enqueue(ctx context.Context, efdSerial string, gc int64, payload []byte,
+	surcharges money.Money,
+) (*OutboxEntry, error) {
+	now := o.now()
+	entry := &OutboxEntry{
+		ID:            OutboxEntryID(efdSerial, gc),
+		EFDSerial:     efdSerial,
+		GlobalCounter: gc,
+		Payload:       payload,
+		Status:        OutboxPending,
+		CreatedAt:     now,
+		NextAttempt:   now,
+		Surcharges:    surcharges.Float64(),
+	}
+
+	if err := o.store.Insert(ctx, entry); errors.Is(err, ErrOutboxEntryExists) {
+		return nil, fmt.Errorf("outbox: receipt %s already queued: %w", entry.ID, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("outbox: could not persist receipt: %w", err)
+	}
+
+	o.Notify()
+
+	return entry, nil
+}
+
+// Notify wakes up Run so that pending entries are delivered without waiting
+// for the next retry.
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers pending entries until ctx is canceled. It returns ctx.Err().
+func (o *Outbox) Run(ctx context.Context) error {
+	for {
+		next, err := o.Flush(ctx)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		wait := o.maxBackoff
+		if err == nil && !next.IsZero() {
+			wait = next.Sub(o.now())
+		}
+		if err != nil {
+			wait = o.minBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-o.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Flush makes one delivery pass over the pending entries that are due and returns
+// the time the earliest remaining pending entry is due, or the zero time if
+// nothing is pending.
+func (o *Outbox) Flush(ctx context.Context) (time.Time, error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	entries, err := o.Pending(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var (
+		next    time.Time
+		blocked = map[string]bool{}
+	)
+	for _, entry := range entries {
+		if blocked[entry.EFDSerial] {
+			continue
+		}
+
+		if o.now().Before(entry.NextAttempt) {
+			blocked[entry.EFDSerial] = true
+			next = earliest(next, entry.NextAttempt)
+			continue
+		}
+
+		if err := o.deliver(ctx, entry); err != nil {
+			return time.Time{}, err
+		}
+
+		if entry.Status == OutboxPending {
+			blocked[entry.EFDSerial] = true
+			next = earliest(next, entry.NextAttempt)
+		}
+	}
+
+	return next, nil
+}
+
+// Pending returns the entries that have not been delivered yet ordered by EFD serial
+// and GC.
+func (o *Outbox) Pending(ctx context.Context) ([]*OutboxEntry, error) {
+	entries, err := o.store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: could not list entries: %w", err)
+	}
+
+	pending := make([]*OutboxEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Status == OutboxPending {
+			pending = append(pending, entry)
+		}
+	}
+	sortOutboxEntries(pending)
+
+	return pending, nil
+}
+
+// Prune deletes the entries delivered before t. Failed entries are kept.
+func (o *Outbox) Prune(ctx context.Context, t time.Time) error {
+	entries, err := o.store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("outbox: could not list entries: %w", err)
+	}
+
+	for _, entry := range entries {
+		delivered := entry.Status == OutboxAcknowledged || entry.Status == OutboxRejected
+		if delivered && entry.DeliveredAt.Before(t) {
+			if err := o.store.Delete(ctx, entry.ID); err != nil {
+				return fmt.Errorf("outbox: could not delete %s: %w", entry.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// deliver sends entry once and persists the outcome. Errors from the sender
+// that IsRetryable reports as retryable schedule a retry, an *UnreadableAckError
+// leaves the entry unverified, other errors reject the entry when they come with
+// an acknowledgement and fail it otherwise. The returned error is about
+// persisting the entry.
+func (o *Outbox) deliver(ctx context.Context, entry *OutboxEntry) error {
+	entry.Attempts++
+	response, err := o.send(ctx, entry)
+	if err != nil && IsRetryable(err) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entry.LastError = err.Error()
+		entry.NextAttempt = o.now().Add(o.backoff(entry.Attempts))
+		return o.store.Put(ctx, entry)
+	}
+
+	unreadable := &UnreadableAckError{}
+	switch {
+	case errors.As(err, &unreadable):
+		entry.DeliveredAt = o.now()
+		entry.Status = OutboxUnverified
+		entry.RawAck = unreadable.Body
+		entry.LastError = err.Error()
+	case err != nil && response == nil:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entry.Status = OutboxFailed
+		entry.LastError = err.Error()
+	case err != nil || !IsSuccess(response.Code):
+		entry.Ack = response
+		entry.DeliveredAt = o.now()
+		entry.Status = OutboxRejected
+		entry.LastError = fmt.Sprintf("ack code %d: %s", response.Code, response.Message)
+	default:
+		entry.Ack = response
+		entry.DeliveredAt = o.now()
+		entry.Status = OutboxAcknowledged
+		entry.LastError = ""
+	}
+
+	if err := o.store.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	if o.onDelivery != nil {
+		o.onDelivery(entry)
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the next attempt after attempts failed attempts.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.minBackoff
+	for i := 1; i < attempts && delay < o.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.maxBackoff {
+		delay = o.maxBackoff
+	}
+	return delay
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func sortOutboxEntries(entries []*OutboxEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].EFDSerial != entries[j].EFDSerial {
+			return entries[i].EFDSerial < entries[j].EFDSerial
+		}
+		return entries[i].GlobalCounter < entries[j].GlobalCounter
+	})
+}
+
+// NewMemoryOutboxStore creates an empty MemoryOutboxStore.
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{entries: make(map[string]*OutboxEntry)}
+}
+
+func (s *MemoryOutboxStore) Put(ctx context.Context, entry *OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *entry
+	s.entries[entry.ID] = &stored
+	return nil
+}
+
+func (s *MemoryOutboxStore) Insert(ctx context.Context, entry *OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[entry.ID]; ok {
+		return ErrOutboxEntryExists
+	}
+	stored := *entry
+	s.entries[entry.ID] = &stored
+	return nil
+}
+
+func (s *MemoryOutboxStore) Get(ctx context.Context, id string) (*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return nil, ErrOutboxEntryNotFound
+	}
+	found := *entry
+	return &found, nil
+}
+
+func (s *MemoryOutboxStore) List(ctx context.Context) ([]*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*OutboxEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		listed := *entry
+		entries = append(entries, &listed)
+	}
+	return entries, nil
+}
+
+func (s *MemoryOutboxStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
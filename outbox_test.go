@@ -0,0 +1,332 @@
+package vfd_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestOutboxDeliversInOrderWithRetries(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store, err := vfd.NewFileOutboxStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileOutboxStore() error = %v", err)
+	}
+
+	var (
+		now       = time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+		delivered []int64
+		failures  = 2
+	)
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		if entry.GlobalCounter == 2 && failures > 0 {
+			failures--
+			return nil, &vfd.NetworkError{Err: errors.New("connection refused"), Message: "receipt submit"}
+		}
+		delivered = append(delivered, entry.GlobalCounter)
+		return &vfd.Response{Number: entry.GlobalCounter, Code: vfd.SuccessCode, Message: "Success"}, nil
+	}
+
+	outbox := vfd.NewOutbox(store, send,
+		vfd.WithOutboxClock(func() time.Time { return now }),
+		vfd.WithOutboxBackoff(time.Second, 4*time.Second))
+
+	for _, gc := range []int64{3, 1, 2} {
+		if _, err := outbox.Enqueue(ctx, "SERIAL", gc, []byte("<EFDMS/>")); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	if _, err := outbox.Enqueue(ctx, "SERIAL", 1, []byte("<EFDMS/>")); err == nil {
+		t.Errorf("Enqueue() of a duplicate GC should fail")
+	}
+
+	next, err := outbox.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if want := now.Add(time.Second); !next.Equal(want) {
+		t.Errorf("Flush() next = %v, want %v", next, want)
+	}
+	if len(delivered) != 1 || delivered[0] != 1 {
+		t.Fatalf("delivered = %v, want [1] as GC 3 must wait for GC 2", delivered)
+	}
+
+	now = now.Add(time.Second)
+	next, _ = outbox.Flush(ctx)
+	if want := now.Add(2 * time.Second); !next.Equal(want) {
+		t.Errorf("Flush() next = %v, want %v after the second failure", next, want)
+	}
+
+	now = now.Add(2 * time.Second)
+	next, _ = outbox.Flush(ctx)
+	if !next.IsZero() {
+		t.Errorf("Flush() next = %v, want zero time", next)
+	}
+	if len(delivered) != 3 || delivered[1] != 2 || delivered[2] != 3 {
+		t.Errorf("delivered = %v, want [1 2 3]", delivered)
+	}
+
+	entry, err := store.Get(ctx, vfd.OutboxEntryID("SERIAL", 2))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if entry.Status != vfd.OutboxAcknowledged || entry.Attempts != 3 || entry.Ack == nil || entry.Ack.Number != 2 {
+		t.Errorf("entry = %+v, want acknowledged after 3 attempts", entry)
+	}
+
+	if err := outbox.Prune(ctx, now.Add(time.Second)); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if entries, _ := store.List(ctx); len(entries) != 0 {
+		t.Errorf("List() after Prune = %d entries, want 0", len(entries))
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	done := make(chan *vfd.OutboxEntry, 1)
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return nil, &vfd.NetworkError{Err: context.DeadlineExceeded, Message: "receipt submit"}
+		}
+		return &vfd.Response{Number: 7, Code: 3, Message: "Invalid TIN"}, nil
+	}
+
+	outbox := vfd.NewOutbox(vfd.NewMemoryOutboxStore(), send,
+		vfd.WithOutboxBackoff(time.Millisecond, 5*time.Millisecond),
+		vfd.WithDeliveryHook(func(entry *vfd.OutboxEntry) { done <- entry }))
+
+	go func() { _ = outbox.Run(ctx) }()
+
+	if _, err := outbox.Enqueue(ctx, "SERIAL", 7, []byte("<EFDMS/>")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	select {
+	case entry := <-done:
+		if entry.Status != vfd.OutboxRejected || entry.Ack.Code != 3 {
+			t.Errorf("entry = %+v, want rejected with ack code 3", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("entry was not delivered")
+	}
+}
+
+func TestOutboxEnqueueConcurrentDuplicates(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	fileStore, err := vfd.NewFileOutboxStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileOutboxStore() error = %v", err)
+	}
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		return &vfd.Response{Code: vfd.SuccessCode}, nil
+	}
+
+	for _, store := range []vfd.OutboxStore{fileStore, vfd.NewMemoryOutboxStore()} {
+		outbox := vfd.NewOutbox(store, send)
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			accepted int
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := outbox.Enqueue(ctx, "SERIAL", 1, []byte("<EFDMS/>"))
+				switch {
+				case err == nil:
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				case !errors.Is(err, vfd.ErrOutboxEntryExists):
+					t.Errorf("Enqueue() error = %v, want %v", err, vfd.ErrOutboxEntryExists)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if accepted != 1 {
+			t.Errorf("%T: %d concurrent Enqueue() of the same GC succeeded, want 1", store, accepted)
+		}
+	}
+}
+
+func TestOutboxFailsPermanentErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := vfd.NewMemoryOutboxStore()
+
+	var attempts int
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		attempts++
+		if entry.GlobalCounter == 1 {
+			return nil, errors.New("could not sign payload")
+		}
+		return &vfd.Response{Number: entry.GlobalCounter, Code: vfd.SuccessCode}, nil
+	}
+	outbox := vfd.NewOutbox(store, send)
+	for _, gc := range []int64{1, 2} {
+		if _, err := outbox.Enqueue(ctx, "SERIAL", gc, []byte("<EFDMS/>")); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if next, err := outbox.Flush(ctx); err != nil || !next.IsZero() {
+			t.Fatalf("Flush() = %v, %v, want nothing left pending", next, err)
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("send was called %d times, want 2", attempts)
+	}
+
+	entry, err := store.Get(ctx, vfd.OutboxEntryID("SERIAL", 1))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if entry.Status != vfd.OutboxFailed || entry.LastError == "" {
+		t.Errorf("entry = %+v, want failed with its error", entry)
+	}
+
+	if err := outbox.Prune(ctx, time.Now()); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if _, err := store.Get(ctx, entry.ID); err != nil {
+		t.Errorf("Get() of a failed entry after Prune error = %v, want it kept", err)
+	}
+}
+
+func TestOutboxKeepsUnverifiedAcks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := vfd.NewMemoryOutboxStore()
+
+	answer := []byte("<EFDMS><RCTACK><ACKCODE>0</ACKCODE></RCTACK></EFDMS>")
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		return nil, &vfd.UnreadableAckError{Action: vfd.SubmitReceiptAction, Body: answer, Err: vfd.ErrInvalidAckSignature}
+	}
+	outbox := vfd.NewOutbox(store, send)
+	if _, err := outbox.Enqueue(ctx, "SERIAL", 1, []byte("<EFDMS/>")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if next, err := outbox.Flush(ctx); err != nil || !next.IsZero() {
+		t.Fatalf("Flush() = %v, %v, want nothing left pending", next, err)
+	}
+
+	entry, err := store.Get(ctx, vfd.OutboxEntryID("SERIAL", 1))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if entry.Status != vfd.OutboxUnverified || !bytes.Equal(entry.RawAck, answer) || entry.DeliveredAt.IsZero() {
+		t.Errorf("entry = %+v, want unverified with the raw answer", entry)
+	}
+	if err := outbox.Prune(ctx, time.Now()); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if _, err := store.Get(ctx, entry.ID); err != nil {
+		t.Errorf("Get() of an unverified entry after Prune error = %v, want it kept", err)
+	}
+}
+
+func TestFileOutboxStoreSkipsCorruptEntries(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := vfd.NewFileOutboxStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileOutboxStore() error = %v", err)
+	}
+
+	var delivered []int64
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		delivered = append(delivered, entry.GlobalCounter)
+		return &vfd.Response{Number: entry.GlobalCounter, Code: vfd.SuccessCode}, nil
+	}
+	outbox := vfd.NewOutbox(store, send)
+	if _, err := outbox.Enqueue(ctx, "SERIAL", 1, []byte("<EFDMS/>")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	corrupt := filepath.Join(dir, vfd.OutboxEntryID("SERIAL", 2)+".json")
+	if err := os.WriteFile(corrupt, []byte(`{"id": "SERIAL-`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := outbox.Flush(ctx); err != nil {
+		t.Fatalf("Flush() with a corrupt entry error = %v", err)
+	}
+	if len(delivered) != 1 || delivered[0] != 1 {
+		t.Errorf("delivered = %v, want [1]", delivered)
+	}
+	if _, err := os.Stat(corrupt + ".corrupt"); err != nil {
+		t.Errorf("corrupt entry was not moved aside: %v", err)
+	}
+}
+
+func TestOutboxAddSignsWithClient(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := vfd.NewMemoryOutboxStore()
+	key := testPrivateKey(t)
+
+	var signs int
+	client := vfd.NewClient(vfd.WithPayloadSigner(func(signer crypto.Signer, payload []byte) ([]byte, error) {
+		signs++
+		return vfd.Sign(signer, payload)
+	}))
+	send := func(ctx context.Context, entry *vfd.OutboxEntry) (*vfd.Response, error) {
+		return &vfd.Response{Number: entry.GlobalCounter, Code: vfd.SuccessCode}, nil
+	}
+	outbox := vfd.NewOutbox(store, send, vfd.WithOutboxClient(client))
+
+	receipt := testReceipt()
+	receipt.Adjustments = []vfd.Adjustment{{Type: vfd.DiscountAdjustment, Description: "10% OFF", Percentage: 10}}
+	receipt.Payments = []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 900}}
+	entry, err := outbox.Add(ctx, key, receipt)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if signs != 1 {
+		t.Errorf("payload signer of the client called %d times, want 1", signs)
+	}
+	if !bytes.Contains(entry.Payload, []byte("<DISCOUNT>100.00</DISCOUNT>")) {
+		t.Errorf("Add() payload %s does not carry the discount of the adjustment", entry.Payload)
+	}
+	want, err := client.ReceiptBytes(key, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entry.Payload, want) {
+		t.Errorf("Add() payload = %s, want %s", entry.Payload, want)
+	}
+
+	invalid := testReceipt()
+	invalid.Params.GlobalCounter = 2
+	invalid.Payments = []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1}}
+	if _, err := outbox.Add(ctx, key, invalid); !errors.Is(err, vfd.ErrInvalidReceipt) {
+		t.Errorf("Add() of an invalid receipt error = %v, want %v", err, vfd.ErrInvalidReceipt)
+	}
+	if entries, _ := outbox.Pending(ctx); len(entries) != 1 {
+		t.Errorf("Pending() = %d entries, want 1", len(entries))
+	}
+}
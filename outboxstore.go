@@ -0,0 +1,151 @@
+package vfd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	outboxFileExt    = ".json"
+	outboxCorruptExt = ".corrupt"
+)
+
+// FileOutboxStore keeps every outbox entry as a JSON file in a directory. Entries are
+// written atomically so a crash never leaves a half written receipt behind. An entry
+// file that List can not read is renamed with the extension .corrupt, reported on
+// stderr and left out, so that it does not hold up the delivery of the others.
+type FileOutboxStore struct {
+	dir string
+}
+
+// NewFileOutboxStore creates a FileOutboxStore in dir, creating the directory
+// if it does not exist.
+func NewFileOutboxStore(dir string) (*FileOutboxStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create outbox directory: %w", err)
+	}
+
+	return &FileOutboxStore{dir: dir}, nil
+}
+
+func (s *FileOutboxStore) Put(ctx context.Context, entry *OutboxEntry) error {
+	path, err := s.path(entry.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox entry: %w", err)
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (s *FileOutboxStore) Insert(ctx context.Context, entry *OutboxEntry) error {
+	path, err := s.path(entry.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox entry: %w", err)
+	}
+
+	if err := writeFileExclusive(path, data); errors.Is(err, os.ErrExist) {
+		return ErrOutboxEntryExists
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileOutboxStore) Get(ctx context.Context, id string) (*OutboxEntry, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return readOutboxEntry(path)
+}
+
+func (s *FileOutboxStore) List(ctx context.Context) ([]*OutboxEntry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*OutboxEntry, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != outboxFileExt {
+			continue
+		}
+		path := filepath.Join(s.dir, file.Name())
+		entry, err := readOutboxEntry(path)
+		if errors.Is(err, ErrOutboxEntryNotFound) {
+			// Deleted since the directory was read.
+			continue
+		}
+		if err != nil {
+			quarantineOutboxEntry(path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (s *FileOutboxStore) Delete(ctx context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileOutboxStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid outbox entry id %q", id)
+	}
+
+	return filepath.Join(s.dir, id+outboxFileExt), nil
+}
+
+// quarantineOutboxEntry moves the unreadable entry file at path aside.
+func quarantineOutboxEntry(path string, err error) {
+	if rerr := os.Rename(path, path+outboxCorruptExt); rerr != nil && !os.IsNotExist(rerr) {
+		_, _ = fmt.Fprintf(os.Stderr, "outbox: skipping unreadable entry %s: %v\n", path, err)
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "outbox: moved unreadable entry %s aside: %v\n", path, err)
+}
+
+func readOutboxEntry(path string) (*OutboxEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrOutboxEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &OutboxEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("could not decode outbox entry %s: %w", path, err)
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,182 @@
+// Package money implements the fixed-point amounts used in receipts and Z reports.
+//
+// A Money is a whole number of cents, so sums are exact and every rounding happens
+// in one well-defined place: when a float64 or a fraction is converted to Money.
+// Rounding is half away from zero, like math.Round.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Zero is the zero amount.
+const Zero Money = 0
+
+// ErrInvalid is returned when a string is not a decimal amount.
+var ErrInvalid = errors.New("invalid money amount")
+
+// Money is an amount in cents. It marshals to and from text, XML and JSON with
+// exactly two decimals, the format the VFD server expects.
+type Money int64
+
+// FromCents returns the Money worth cents cents.
+func FromCents(cents int64) Money {
+	return Money(cents)
+}
+
+// FromFloat converts f to Money, rounding to the nearest cent.
+func FromFloat(f float64) Money {
+	return Money(math.Round(f * 100))
+}
+
+// Parse parses a decimal amount such as "1500", "1500.5" or "-0.05". More than
+// two decimals are rounded to the nearest cent.
+func Parse(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	negative := strings.HasPrefix(whole, "-")
+	whole = strings.TrimPrefix(strings.TrimPrefix(whole, "-"), "+")
+	if whole == "" {
+		whole = "0"
+	}
+	if strings.ContainsAny(whole, "+-") || strings.ContainsAny(fraction, "+-") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+
+	var cents int64
+	if fraction != "" {
+		padded := fraction + "00"
+		cents, err = strconv.ParseInt(padded[:2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+		}
+		if rest := padded[2:]; strings.Trim(rest, "0123456789") != "" {
+			return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+		} else if rest != "" && rest[0] >= '5' {
+			cents++
+		}
+	}
+
+	m := Money(units*100 + cents)
+	if negative {
+		m = -m
+	}
+
+	return m, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for constants in
+// tests and examples.
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Cents returns m in cents.
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+// Float64 returns m as a float64, for the float compatibility API.
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// Mul returns m multiplied by quantity, rounded to the nearest cent.
+func (m Money) Mul(quantity float64) Money {
+	return Money(math.Round(float64(m) * quantity))
+}
+
+// MulDiv returns m * num / den rounded to the nearest cent, computed with
+// integers so that no precision is lost.
+func (m Money) MulDiv(num, den int64) Money {
+	n := int64(m) * num
+	q := (abs(n)*2 + abs(den)) / (2 * abs(den))
+	if n != 0 && (n < 0) != (den < 0) {
+		q = -q
+	}
+	return Money(q)
+}
+
+// String formats m with two decimals, for example "1500.00" or "-0.05".
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// MarshalText implements encoding.TextMarshaler, used by encoding/xml.
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, used by encoding/xml.
+func (m *Money) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// MarshalJSON encodes m as a JSON number with two decimals.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string holding a decimal amount.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalid, s)
+		}
+		*m = FromFloat(f)
+		return nil
+	}
+	return m.UnmarshalText([]byte(s))
+}
+
+// Sum returns the sum of amounts.
+func Sum(amounts ...Money) Money {
+	var total Money
+	for _, a := range amounts {
+		total += a
+	}
+	return total
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
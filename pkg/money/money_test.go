@@ -0,0 +1,116 @@
+package money
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"0", 0},
+		{"1500", 150000},
+		{"1500.5", 150050},
+		{"1500.05", 150005},
+		{"-0.05", -5},
+		{"+12.30", 1230},
+		{".75", 75},
+		{"0.995", 100},
+		{"2.344", 234},
+		{" 7.00 ", 700},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "1.2.3", "1.-5", "--1", "1e3"} {
+		if _, err := Parse(in); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q) error = %v, want %v", in, err, ErrInvalid)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := map[Money]string{
+		0:       "0.00",
+		5:       "0.05",
+		-5:      "-0.05",
+		150000:  "1500.00",
+		-123456: "-1234.56",
+	}
+	for m, want := range tests {
+		if got := m.String(); got != want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(m), got, want)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	tests := map[float64]Money{
+		0.1 + 0.2: 30,
+		1.005:     100, // 1.005 is 1.00499999... as a float64
+		2.675:     268,
+		-0.015:    -2,
+		4237.29:   423729,
+	}
+	for f, want := range tests {
+		if got := FromFloat(f); got != want {
+			t.Errorf("FromFloat(%v) = %d, want %d", f, got, want)
+		}
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	tests := []struct {
+		m        Money
+		num, den int64
+		want     Money
+	}{
+		{290000, 10000, 11800, 245763},
+		{500000, 10000, 11800, 423729},
+		{30, 10000, 11800, 25},
+		{-500000, 10000, 11800, -423729},
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{5, 1, -2, -3},
+	}
+	for _, tt := range tests {
+		if got := tt.m.MulDiv(tt.num, tt.den); got != tt.want {
+			t.Errorf("Money(%d).MulDiv(%d, %d) = %d, want %d", int64(tt.m), tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type doc struct {
+		XMLName xml.Name `xml:"DOC" json:"-"`
+		Amount  Money    `xml:"AMOUNT" json:"amount"`
+	}
+
+	out, err := xml.Marshal(doc{Amount: 300000})
+	if err != nil || string(out) != "<DOC><AMOUNT>3000.00</AMOUNT></DOC>" {
+		t.Errorf("xml.Marshal() = %s, %v", out, err)
+	}
+	var d doc
+	if err := xml.Unmarshal([]byte("<DOC><AMOUNT>12.5</AMOUNT></DOC>"), &d); err != nil || d.Amount != 1250 {
+		t.Errorf("xml.Unmarshal() = %d, %v", d.Amount, err)
+	}
+
+	out, err = json.Marshal(doc{Amount: -5})
+	if err != nil || string(out) != `{"amount":-0.05}` {
+		t.Errorf("json.Marshal() = %s, %v", out, err)
+	}
+	for in, want := range map[string]Money{`{"amount":12.5}`: 1250, `{"amount":"7.01"}`: 701, `{"amount":1e2}`: 10000} {
+		d = doc{}
+		if err := json.Unmarshal([]byte(in), &d); err != nil || d.Amount != want {
+			t.Errorf("json.Unmarshal(%s) = %d, %v, want %d", in, d.Amount, err, want)
+		}
+	}
+}
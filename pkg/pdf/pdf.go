@@ -0,0 +1,181 @@
+// Package pdf writes simple PDF documents: pages of text in the standard
+// Courier and Helvetica fonts, filled rectangles and lines. Fonts are not
+// embedded and text is encoded with WinAnsiEncoding, so only Latin-1
+// characters can be shown, other characters are written as '?'.
+//
+// The output only depends on what was drawn, the same document always
+// produces the same bytes.
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Font is one of the standard PDF fonts every reader has.
+type Font int
+
+const (
+	Courier Font = iota
+	CourierBold
+	Helvetica
+	HelveticaBold
+)
+
+var fontNames = [...]string{"Courier", "Courier-Bold", "Helvetica", "Helvetica-Bold"}
+
+// Points per millimetre, PDF coordinates are in points of 1/72 inch.
+const MM = 72 / 25.4
+
+type (
+	// Document is a PDF document being drawn.
+	Document struct {
+		pages []*Page
+	}
+
+	// Page is a page of a Document. The origin is the bottom left corner.
+	Page struct {
+		Width, Height float64
+		content       bytes.Buffer
+	}
+)
+
+// New returns an empty Document.
+func New() *Document {
+	return &Document{}
+}
+
+// AddPage adds a page of width by height points.
+func (d *Document) AddPage(width, height float64) *Page {
+	p := &Page{Width: width, Height: height}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// Text draws text with its baseline starting at x, y.
+func (p *Page) Text(x, y float64, font Font, size float64, text string) {
+	fmt.Fprintf(&p.content, "BT /F%d %s Tf %s %s Td (%s) Tj ET\n",
+		int(font)+1, number(size), number(x), number(y), escape(text))
+}
+
+// Rect fills the rectangle of width w and height h whose bottom left corner
+// is x, y in black.
+func (p *Page) Rect(x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "%s %s %s %s re f\n", number(x), number(y), number(w), number(h))
+}
+
+// Line draws a black line of the given width from x1, y1 to x2, y2.
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n",
+		number(width), number(x1), number(y1), number(x2), number(y2))
+}
+
+// TextWidth returns the width in points of text in font at size. Only the
+// Courier fonts have a fixed width, Helvetica uses an average width.
+func TextWidth(font Font, size float64, text string) float64 {
+	n := float64(len([]rune(text)))
+	if font == Courier || font == CourierBold {
+		return n * 0.6 * size
+	}
+	return n * 0.5 * size
+}
+
+// WriteTo writes the document to w.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	var offsets []int64
+	object := func(body string) {
+		offsets = append(offsets, cw.n)
+		fmt.Fprintf(cw, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// objects 1 and 2 are the catalog and the page tree, then come the fonts
+	// and, for every page, the page and its content stream.
+	fontObject := 3
+	firstPage := fontObject + len(fontNames)
+
+	cw.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	var kids bytes.Buffer
+	for i := range d.pages {
+		if i > 0 {
+			kids.WriteByte(' ')
+		}
+		fmt.Fprintf(&kids, "%d 0 R", firstPage+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids.String(), len(d.pages)))
+
+	var fonts bytes.Buffer
+	for i, name := range fontNames {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+		fmt.Fprintf(&fonts, "/F%d %d 0 R ", i+1, fontObject+i)
+	}
+
+	for i, p := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << %s>> >> /Contents %d 0 R >>",
+			number(p.Width), number(p.Height), fonts.String(), firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.Bytes()))
+	}
+
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(cw, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(cw, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// number formats f with at most 2 decimals and without trailing zeros.
+func number(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+// escape encodes text in WinAnsiEncoding as a PDF literal string.
+func escape(text string) string {
+	var b bytes.Buffer
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r <= 0x7E:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (c *countingWriter) WriteString(s string) {
+	_, _ = c.Write([]byte(s))
+}
@@ -0,0 +1,63 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	d := New()
+	p := d.AddPage(80*MM, 100)
+	p.Text(10, 90, CourierBold, 8, "TOTAL (incl) \\ 1,000.00")
+	p.Text(10, 80, Helvetica, 8, "Ntilié – €")
+	p.Rect(10, 10, 2.5, 2.5)
+	p.Line(10, 50, 200, 50, 0.5)
+	d.AddPage(100, 100)
+
+	var buf bytes.Buffer
+	n, err := d.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo() = %d, %v, wrote %d bytes", n, err, buf.Len())
+	}
+	out := buf.Bytes()
+
+	for _, want := range []string{
+		"%PDF-1.4\n",
+		"/MediaBox [0 0 226.77 100]",
+		"/Kids [7 0 R 9 0 R] /Count 2",
+		"BT /F2 8 Tf 10 90 Td (TOTAL \\(incl\\) \\\\ 1,000.00) Tj ET\n",
+		"(Ntili\\351 ? ?) Tj",
+		"10 10 2.5 2.5 re f\n",
+		"0.5 w 10 50 m 200 50 l S\n",
+		"/BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("WriteTo() has no %q", want)
+		}
+	}
+
+	// every xref entry points at its object
+	xref := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(out)
+	if xref == nil {
+		t.Fatalf("no startxref at the end of\n%s", out)
+	}
+	start, _ := strconv.Atoi(string(xref[1]))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(out[start:], -1)
+	if len(entries) != 10 {
+		t.Fatalf("xref has %d objects, want 10", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(out[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, out[offset:offset+10])
+		}
+	}
+
+	var again bytes.Buffer
+	if _, err := d.WriteTo(&again); err != nil || !bytes.Equal(again.Bytes(), out) {
+		t.Errorf("WriteTo() is not deterministic")
+	}
+}
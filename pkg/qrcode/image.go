@@ -0,0 +1,23 @@
+package qrcode
+
+import (
+	"image"
+	"image/color"
+)
+
+// Image draws the symbol with every module scale pixels wide, black on white,
+// surrounded by a quiet zone quiet modules wide.
+func (c *Code) Image(scale, quiet int) *image.Gray {
+	side := (c.Size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			v := color.Gray{Y: 0xFF}
+			if c.Black(px/scale-quiet, py/scale-quiet) {
+				v = color.Gray{}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+	return img
+}
@@ -0,0 +1,235 @@
+// Package qrcode encodes short byte strings, such as receipt verification
+// links, as QR Code symbols (ISO/IEC 18004) of versions 1 to 10 in byte mode.
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// MaxVersion is the largest symbol version Encode produces.
+const MaxVersion = 10
+
+// ErrTooLong is returned when the data does not fit a version 10 symbol at the
+// requested error correction level.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+type (
+	// Level is the error correction level of a symbol, the share of damaged
+	// codewords it can recover from: about 7%, 15%, 25% and 30%.
+	Level int
+
+	// Code is an encoded QR Code symbol of Size x Size modules.
+	Code struct {
+		Size    int
+		Version int
+		Level   Level
+		Mask    int
+		modules []bool
+
+		// reserved marks the modules of the function patterns, which are left
+		// alone by drawCodewords and applyMask.
+		reserved []bool
+	}
+
+	// blockSpec is the layout of the codewords of a version and level: the
+	// error correction codewords per block, then the number of blocks and data
+	// codewords per block of the two groups.
+	blockSpec struct {
+		ecc            int
+		blocks1, data1 int
+		blocks2, data2 int
+	}
+)
+
+const (
+	Low Level = iota
+	Medium
+	Quartile
+	High
+)
+
+// blockSpecs is indexed by version, then by Level.
+var blockSpecs = [MaxVersion + 1][4]blockSpec{
+	1:  {{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}, {13, 1, 13, 0, 0}, {17, 1, 9, 0, 0}},
+	2:  {{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}, {22, 1, 22, 0, 0}, {28, 1, 16, 0, 0}},
+	3:  {{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 17, 0, 0}, {22, 2, 13, 0, 0}},
+	4:  {{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}, {26, 2, 24, 0, 0}, {16, 4, 9, 0, 0}},
+	5:  {{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}, {18, 2, 15, 2, 16}, {22, 2, 11, 2, 12}},
+	6:  {{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}, {24, 4, 19, 0, 0}, {28, 4, 15, 0, 0}},
+	7:  {{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}, {18, 2, 14, 4, 15}, {26, 4, 13, 1, 14}},
+	8:  {{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}, {22, 4, 18, 2, 19}, {26, 4, 14, 2, 15}},
+	9:  {{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}, {20, 4, 16, 4, 17}, {24, 4, 12, 4, 13}},
+	10: {{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}, {24, 6, 19, 2, 20}, {28, 6, 15, 2, 16}},
+}
+
+func (s blockSpec) dataCodewords() int {
+	return s.blocks1*s.data1 + s.blocks2*s.data2
+}
+
+// formatBits are the 2 bits identifying a Level in the format information.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+func (l Level) String() string {
+	switch l {
+	case Low:
+		return "L"
+	case Medium:
+		return "M"
+	case Quartile:
+		return "Q"
+	case High:
+		return "H"
+	}
+	return "?"
+}
+
+// Encode returns the smallest symbol holding data in byte mode at the given
+// level, with the mask that scores the lowest penalty.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < Low || level > High {
+		return nil, errors.New("qrcode: invalid error correction level")
+	}
+
+	for version := 1; version <= MaxVersion; version++ {
+		spec := blockSpecs[version][level]
+		if 4+countBits(version)+8*len(data) > 8*spec.dataCodewords() {
+			continue
+		}
+
+		codewords := addErrorCorrection(encodeData(data, version, spec), spec)
+		var best *Code
+		bestPenalty := -1
+		for mask := 0; mask < 8; mask++ {
+			c := newCode(version, level)
+			c.drawFunctionPatterns()
+			c.drawCodewords(codewords)
+			c.applyMask(mask)
+			c.drawFormatBits(mask)
+			if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+				best, bestPenalty = c, penalty
+			}
+		}
+		return best, nil
+	}
+
+	return nil, ErrTooLong
+}
+
+// Black reports whether the module in column x and row y is dark. Modules
+// outside the symbol, in the quiet zone, are light.
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// Lines draws the symbol with Unicode half blocks, two rows of modules per
+// line, surrounded by a quiet zone quiet modules wide. Dark modules are
+// drawn as blocks, for dark text on a light background.
+func (c *Code) Lines(quiet int) []string {
+	var lines []string
+	for y := -quiet; y < c.Size+quiet; y += 2 {
+		var b strings.Builder
+		for x := -quiet; x < c.Size+quiet; x++ {
+			top, bottom := c.Black(x, y), c.Black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteRune('█')
+			case top:
+				b.WriteRune('▀')
+			case bottom:
+				b.WriteRune('▄')
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+// countBits is the length of the character count indicator in byte mode.
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// encodeData returns the data codewords: the byte mode indicator, the count,
+// the data, a terminator and the alternating pad codewords.
+func encodeData(data []byte, version int, spec blockSpec) []byte {
+	w := &bitWriter{}
+	w.write(0x4, 4)
+	w.write(len(data), countBits(version))
+	for _, b := range data {
+		w.write(int(b), 8)
+	}
+
+	capacity := 8 * spec.dataCodewords()
+	terminator := capacity - w.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	w.write(0, terminator)
+	if r := w.n % 8; r != 0 {
+		w.write(0, 8-r)
+	}
+	for pad := 0xEC; w.n < capacity; pad ^= 0xEC ^ 0x11 {
+		w.write(pad, 8)
+	}
+
+	return w.bytes
+}
+
+// addErrorCorrection splits data into blocks, computes the error correction
+// codewords of every block and interleaves them.
+func addErrorCorrection(data []byte, spec blockSpec) []byte {
+	var blocks, eccs [][]byte
+	for i := 0; i < spec.blocks1+spec.blocks2; i++ {
+		n := spec.data1
+		if i >= spec.blocks1 {
+			n = spec.data2
+		}
+		blocks = append(blocks, data[:n])
+		eccs = append(eccs, reedSolomon(data[:n], spec.ecc))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i < spec.data1 || i < spec.data2; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ecc; i++ {
+		for _, ecc := range eccs {
+			out = append(out, ecc[i])
+		}
+	}
+
+	return out
+}
+
+type bitWriter struct {
+	bytes []byte
+	n     int
+}
+
+func (w *bitWriter) write(value, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		if value>>i&1 == 1 {
+			w.bytes[w.n/8] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
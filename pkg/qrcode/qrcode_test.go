@@ -0,0 +1,264 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD as a 1-Q symbol, from the worked example of the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236}
+	want := []byte{168, 72, 22, 82, 217, 54, 156, 0, 46, 15, 180, 122, 16}
+	if got := reedSolomon(data, 13); !bytes.Equal(got, want) {
+		t.Errorf("reedSolomon() = %v, want %v", got, want)
+	}
+}
+
+func TestBlockSpecs(t *testing.T) {
+	for version := 1; version <= MaxVersion; version++ {
+		// modules left for codewords once the function patterns are drawn
+		raw := (16*version+128)*version + 64
+		if version >= 2 {
+			count := version/7 + 2
+			raw -= (25*count-10)*count - 55
+			if version >= 7 {
+				raw -= 36
+			}
+		}
+
+		for level, spec := range blockSpecs[version] {
+			total := spec.dataCodewords() + (spec.blocks1+spec.blocks2)*spec.ecc
+			if total != raw/8 {
+				t.Errorf("version %d level %v has %d codewords, want %d", version, Level(level), total, raw/8)
+			}
+		}
+
+		c := newCode(version, Low)
+		c.drawFunctionPatterns()
+		free := 0
+		for _, reserved := range c.reserved {
+			if !reserved {
+				free++
+			}
+		}
+		if free != raw {
+			t.Errorf("version %d has %d free modules, want %d", version, free, raw)
+		}
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	c := newCode(7, Medium)
+	c.drawFunctionPatterns()
+	c.drawFormatBits(0)
+	// 101010000010010 is the format information of level M with mask 0
+	if got := readFormat(c); got != 0x5412 {
+		t.Errorf("format bits = %015b, want %015b", got, 0x5412)
+	}
+
+	// 000111110010010100 is the version information of version 7
+	var version int
+	for i := 17; i >= 0; i-- {
+		version <<= 1
+		if c.Black(i/3, c.Size-11+i%3) {
+			version |= 1
+		}
+	}
+	if version != 0x07C94 {
+		t.Errorf("version bits = %018b, want %018b", version, 0x07C94)
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	want := map[int][]int{2: {6, 18}, 6: {6, 34}, 7: {6, 22, 38}, 10: {6, 28, 50}}
+	for version, positions := range want {
+		if got := alignmentPositions(version); !equalInts(got, positions) {
+			t.Errorf("alignmentPositions(%d) = %v, want %v", version, got, positions)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		data    string
+		level   Level
+		version int
+	}{
+		{"https://verify.tra.go.tz/6C72A51042_080509", Medium, 3},
+		{"https://verify.tra.go.tz/6C72A51042_080509", Low, 3},
+		{"https://virtual.tra.go.tz/efdmsRctVerify/6C72A51042_080509", Quartile, 5},
+		{strings.Repeat("receipt ", 12) + "1234", High, 10},
+		{"", Low, 1},
+	}
+	for _, tt := range tests {
+		c, err := Encode([]byte(tt.data), tt.level)
+		if err != nil {
+			t.Fatalf("Encode(%q) error = %v", tt.data, err)
+		}
+		if c.Version != tt.version || c.Size != 4*tt.version+17 {
+			t.Errorf("Encode(%q) version = %d, want %d", tt.data, c.Version, tt.version)
+		}
+		if got := decode(t, c); got != tt.data {
+			t.Errorf("decode(Encode(%q)) = %q", tt.data, got)
+		}
+	}
+
+	if _, err := Encode(bytes.Repeat([]byte("x"), 272), Low); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode() of 272 bytes error = %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestLines(t *testing.T) {
+	c, err := Encode([]byte("vfd"), Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := c.Lines(2)
+	if len(lines) != (c.Size+4+1)/2 {
+		t.Fatalf("Lines() has %d lines", len(lines))
+	}
+	// the top left finder starts after a quiet line and 2 quiet columns
+	if !strings.HasPrefix(lines[1], "  █▀▀▀▀▀█ ") || strings.TrimSpace(lines[0]) != "" {
+		t.Errorf("Lines() =\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+// readFormat reads the format information next to the top left finder.
+func readFormat(c *Code) int {
+	var bits int
+	read := func(x, y, i int) {
+		if c.Black(x, y) {
+			bits |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		read(8, i, i)
+	}
+	read(8, 7, 6)
+	read(8, 8, 7)
+	read(7, 8, 8)
+	for i := 9; i < 15; i++ {
+		read(14-i, 8, i)
+	}
+	return bits
+}
+
+// decode reads the data back from c: it finds the level and mask from the
+// format information, unmasks and reads the codewords, checks the error
+// correction of every block and parses the byte mode segment.
+func decode(t *testing.T, c *Code) string {
+	t.Helper()
+
+	format := readFormat(c) ^ 0x5412
+	level := Level([...]int{1, 0, 3, 2}[format>>13])
+	mask := format >> 10 & 7
+	if level != c.Level || mask != c.Mask {
+		t.Fatalf("format information says level %v mask %d, want %v %d", level, mask, c.Level, c.Mask)
+	}
+
+	empty := newCode(c.Version, level)
+	empty.drawFunctionPatterns()
+	var bits []bool
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = c.Size - 1 - vert
+			}
+			for x := right; x > right-2; x-- {
+				if !empty.reserved[y*c.Size+x] {
+					bits = append(bits, c.Black(x, y) != masked(mask, x, y))
+				}
+			}
+		}
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			if bits[i*8+j] {
+				codewords[i] |= 0x80 >> j
+			}
+		}
+	}
+
+	spec := blockSpecs[c.Version][level]
+	blocks := make([][]byte, spec.blocks1+spec.blocks2)
+	eccs := make([][]byte, len(blocks))
+	next := 0
+	for i := 0; i < spec.data1 || i < spec.data2; i++ {
+		for b := range blocks {
+			if b < spec.blocks1 && i < spec.data1 || b >= spec.blocks1 && i < spec.data2 {
+				blocks[b] = append(blocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < spec.ecc; i++ {
+		for b := range eccs {
+			eccs[b] = append(eccs[b], codewords[next])
+			next++
+		}
+	}
+
+	var data []byte
+	for b := range blocks {
+		if !bytes.Equal(reedSolomon(blocks[b], spec.ecc), eccs[b]) {
+			t.Fatalf("block %d has wrong error correction codewords", b)
+		}
+		data = append(data, blocks[b]...)
+	}
+
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("mode = %x, want byte mode", data[0]>>4)
+	}
+	var count, offset int
+	if countBits(c.Version) == 8 {
+		count = int(data[0]&0xF)<<4 | int(data[1]>>4)
+		offset = 1
+	} else {
+		count = int(data[0]&0xF)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		offset = 2
+	}
+	out := make([]byte, count)
+	for i := range out {
+		out[i] = data[offset+i]<<4 | data[offset+i+1]>>4
+	}
+
+	return string(out)
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestImage(t *testing.T) {
+	c, err := Encode([]byte("vfd"), Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := c.Image(3, 4)
+	if side := (c.Size + 8) * 3; img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+		t.Fatalf("Image() bounds = %v, want %d pixels square", img.Bounds(), side)
+	}
+	for _, p := range []struct {
+		x, y  int
+		black bool
+	}{{0, 0, false}, {11, 11, false}, {12, 12, true}, {14, 14, true}, {15, 15, false}, {20, 20, true}} {
+		if got := img.GrayAt(p.x, p.y).Y == 0; got != p.black {
+			t.Errorf("pixel %d,%d black = %v, want %v", p.x, p.y, got, p.black)
+		}
+	}
+}
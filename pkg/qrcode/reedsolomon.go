@@ -0,0 +1,47 @@
+package qrcode
+
+// reedSolomon returns the n error correction codewords of data: the remainder
+// of data, as a polynomial over GF(256), divided by the generator polynomial
+// of degree n.
+func reedSolomon(data []byte, n int) []byte {
+	divisor := generator(n)
+	result := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[n-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// generator returns the coefficients, highest power first and without the
+// leading 1, of the product of (x - 2^i) for i from 0 to n-1.
+func generator(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+// gfMul multiplies x and y in GF(256) with the QR Code polynomial
+// x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
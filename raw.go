@@ -3,26 +3,25 @@ package vfd
 import (
 	"bytes"
 	"context"
-	"encoding/xml"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 
 	"github.com/vfdcloud/vfd/pkg/env"
 
 	vhttp "github.com/vfdcloud/vfd/internal/http"
-	"github.com/vfdcloud/vfd/internal/models"
 )
 
 type (
 
 	// RawRequest contains information needed to send receipt/z report file
-	// to the vfd server.
+	// to the vfd server. URL overrides the endpoint derived from Env and Action
+	// when it is not empty.
 	RawRequest struct {
 		Env      env.Env
 		Action   Action
 		FilePath string
+		URL      string
 	}
 )
 
@@ -30,12 +29,14 @@ type (
 // content of the file is read and submitted to the server as is.
 func SubmitRawRequest(ctx context.Context, headers *RequestHeaders, raw *RawRequest) (*Response, error) {
 	var (
-		client      = vhttp.Instance()
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-		reqURL      = RequestURL(raw.Env, raw.Action)
+		client = vhttp.Instance()
+		reqURL = RequestURL(raw.Env, raw.Action)
 	)
 
+	if raw.URL != "" {
+		reqURL = raw.URL
+	}
+
 	payload := bytes.NewBuffer(nil)
 
 	// read the file if the file path is provided and return the content as bytes
@@ -50,82 +51,12 @@ func SubmitRawRequest(ctx context.Context, headers *RequestHeaders, raw *RawRequ
 		}
 	}
 
-	newContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, reqURL, payload)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
-
-	if raw.Action == SubmitReceiptAction {
-		req.Header.Set("Routing-Key", SubmitReceiptRoutingKey)
-	}
-
-	if raw.Action == SubmitReportAction {
-		req.Header.Set("Routing-Key", SubmitReportRoutingKey)
+	switch raw.Action {
+	case SubmitReceiptAction:
+		return submitReceiptPayload(ctx, client, reqURL, headers, payload.Bytes(), nil)
+	case SubmitReportAction:
+		return submitReportPayload(ctx, client, reqURL, headers, payload.Bytes(), nil)
+	default:
+		return nil, fmt.Errorf("couldnt figure out the action")
 	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "raw request submit", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "registration: could not close response body %v", err)
-		}
-	}(resp.Body)
-
-	out, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-	}
-
-	if resp.StatusCode == 500 {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-		}
-
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
-	}
-
-	if raw.Action == SubmitReportAction {
-		response := models.ReportAckEFDMS{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
-		}
-
-		return &Response{
-			Number:  response.ZACK.ZNUMBER,
-			Date:    response.ZACK.DATE,
-			Time:    response.ZACK.TIME,
-			Code:    response.ZACK.ACKCODE,
-			Message: response.ZACK.ACKMSG,
-		}, nil
-	}
-
-	if raw.Action == SubmitReceiptAction {
-		response := models.RCTACKEFDMS{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-		}
-		return &Response{
-			Number:  response.RCTACK.RCTNUM,
-			Date:    response.RCTACK.DATE,
-			Time:    response.RCTACK.TIME,
-			Code:    response.RCTACK.ACKCODE,
-			Message: response.RCTACK.ACKMSG,
-		}, nil
-	}
-
-	return nil, fmt.Errorf("couldnt figure out the action")
 }
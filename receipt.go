@@ -1,18 +1,17 @@
 package vfd
 
 import (
-	"bytes"
 	"context"
-	"crypto/rsa"
-	"encoding/xml"
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
 
 	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/pkg/money"
 
 	xhttp "github.com/vfdcloud/vfd/internal/http"
 
@@ -21,6 +20,16 @@ import (
 
 var ErrReceiptUploadFailed = errors.New("receipt upload failed")
 
+const (
+	// TaxInclusivePricing is the pricing of items whose UnitPrice and Discount
+	// include VAT, the default.
+	TaxInclusivePricing Pricing = "INCLUSIVE"
+
+	// TaxExclusivePricing is the pricing of items whose UnitPrice and Discount
+	// are net of VAT, the VAT is added on top.
+	TaxExclusivePricing Pricing = "EXCLUSIVE"
+)
+
 type (
 	// ReceiptParams contains parameters icluded while sending the receipts
 	ReceiptParams struct {
@@ -46,7 +55,10 @@ type (
 
 	// Item represent a purchased item. TaxCode is an integer that can take the
 	// value of 1 for taxable items and 3 for non-taxable items.
-	// Discount is for the whole package not a unit discount
+	// Discount is for the whole package not a unit discount.
+	// UnitPrice and Discount are converted to money.Money, rounded to the
+	// nearest cent, before any arithmetic is done on them. Pricing tells
+	// whether they include VAT, an empty Pricing is TaxInclusivePricing.
 	Item struct {
 		ID          string
 		Description string
@@ -54,103 +66,96 @@ type (
 		Quantity    float64
 		UnitPrice   float64
 		Discount    float64
+		Pricing     Pricing
 	}
 
+	// Pricing tells whether the prices of an Item include VAT.
+	Pricing string
+
+	// ReceiptRequest is a receipt to sign and submit. Adjustments are the
+	// discounts and surcharges on the whole receipt, see Adjustment.
 	ReceiptRequest struct {
-		Params   ReceiptParams
-		Customer Customer
-		Items    []Item
-		Payments []Payment
+		Params      ReceiptParams
+		Customer    Customer
+		Items       []Item
+		Payments    []Payment
+		Adjustments []Adjustment
 	}
 )
 
-// SubmitReceipt uploads a receipt to the VFD server.
-func SubmitReceipt(ctx context.Context, requestURL string, headers *RequestHeaders, privateKey *rsa.PrivateKey,
+// SubmitReceipt uploads a receipt to the VFD server. The receipt is checked with
+// Validate before it is signed.
+func SubmitReceipt(ctx context.Context, requestURL string, headers *RequestHeaders, signer crypto.Signer,
 	receiptRequest *ReceiptRequest,
 ) (*Response, error) {
 	client := xhttp.Instance()
-	return submitReceipt(ctx, client, requestURL, headers, privateKey, receiptRequest)
+	return submitReceipt(ctx, client, requestURL, headers, signer, receiptRequest)
 }
 
 func submitReceipt(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
-	privateKey *rsa.PrivateKey, rct *ReceiptRequest,
+	signer crypto.Signer, rct *ReceiptRequest,
 ) (*Response, error) {
-	var (
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-	)
-
-	newContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	payload, err := ReceiptBytes(
-		privateKey, rct.Params, rct.Customer, rct.Items, rct.Payments)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-	}
-
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, requestURL,
-		bytes.NewBuffer(payload))
+	payload, err := receiptPayload(Sign, signer, nil, rct, true)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Routing-Key", SubmitReceiptRoutingKey)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
+	return submitReceiptPayload(ctx, client, requestURL, headers, payload, nil)
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "receipt upload", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "registration: could not close response body %v", err)
+// receiptPayload validates the receipt when validate is true and signs it with
+// sign, as ReceiptBytes does with Sign and the default tax table.
+func receiptPayload(sign PayloadSigner, signer crypto.Signer, taxes *TaxSchedule, rct *ReceiptRequest,
+	validate bool,
+) ([]byte, error) {
+	if validate {
+		if err := rct.validate(taxes); err != nil {
+			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
 		}
-	}(resp.Body)
+	}
 
-	out, err := io.ReadAll(resp.Body)
+	payload, err := receiptBytes(sign, signer, taxes, rct)
 	if err != nil {
 		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
 	}
 
-	if resp.StatusCode == 500 {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
-		}
+	return payload, nil
+}
 
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
+// submitReceiptPayload sends an already signed receipt payload as produced by
+// ReceiptBytes and decodes the acknowledgement, verifying its
+// signature with ackCert when it is not nil.
+func submitReceiptPayload(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
+	payload []byte, ackCert *x509.Certificate,
+) (*Response, error) {
+	out, err := submitPayload(ctx, client, requestURL, SubmitReceiptAction, headers, payload)
+	if err != nil {
+		return nil, err
 	}
 
-	response := models.RCTACKEFDMS{}
-	err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
+	return decodeReceiptAck(out, ackCert)
+}
+
+// generateReceipt returns the RCT of r, taxed at the rates of taxes.
+func generateReceipt(taxes *TaxSchedule, r *ReceiptRequest) (*models.RCT, error) {
+	result, err := taxes.ProcessItems(r.Params, r.Items, r.Adjustments...)
 	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReceiptUploadFailed, err)
+		return nil, err
 	}
-
-	return &Response{
-		Number:  response.RCTACK.RCTNUM,
-		Date:    response.RCTACK.DATE,
-		Time:    response.RCTACK.TIME,
-		Code:    response.RCTACK.ACKCODE,
-		Message: response.RCTACK.ACKMSG,
-	}, nil
+	return receiptFromItems(r, result), nil
 }
 
-func generateReceipt(params ReceiptParams, customer Customer, items []Item, payments []Payment) *models.RCT {
+// receiptFromItems returns the RCT of r with the items and totals of RESULTS.
+func receiptFromItems(r *ReceiptRequest, RESULTS *ItemProcessResponse) *models.RCT {
+	params, customer, payments := r.Params, r.Customer, r.Payments
 	rctPayments := make([]*models.PAYMENT, len(payments))
 	for i, payment := range payments {
 		rctPayments[i] = &models.PAYMENT{
 			PMTTYPE:   string(payment.Type),
-			PMTAMOUNT: fmt.Sprintf("%.2f", payment.Amount),
+			PMTAMOUNT: money.FromFloat(payment.Amount),
 		}
 	}
 
-	RESULTS := ProcessItems(items)
 	ITEMS := models.ITEMS{ITEM: RESULTS.ITEMS}
 	TOTALS := RESULTS.TOTALS
 	VATTOTALS := models.VATTOTALS{VATTOTAL: RESULTS.VATTOTALS}
@@ -177,38 +182,33 @@ func generateReceipt(params ReceiptParams, customer Customer, items []Item, paym
 		VATTOTALS:  VATTOTALS,
 	}
 
-	// round off all values to 2 decimal places
-	RECEIPT.RoundOff()
-
 	return RECEIPT
 }
 
-func ReceiptBytes(privateKey *rsa.PrivateKey, params ReceiptParams, customer Customer,
+// ReceiptBytes returns the signed EFDMS envelope of the receipt. The <RCT>
+// element is written by a purpose built encoder, see encodeReceipt, so the
+// signed bytes only depend on the receipt. The taxes are computed with the
+// DefaultTaxTable.
+func ReceiptBytes(signer crypto.Signer, params ReceiptParams, customer Customer,
 	items []Item, payments []Payment,
 ) ([]byte, error) {
-	receipt := generateReceipt(params, customer, items, payments)
-	receiptBytes, err := xml.Marshal(receipt)
+	return receiptBytes(Sign, signer, nil, &ReceiptRequest{
+		Params: params, Customer: customer, Items: items, Payments: payments,
+	})
+}
+
+func receiptBytes(sign PayloadSigner, signer crypto.Signer, taxes *TaxSchedule, rct *ReceiptRequest) ([]byte, error) {
+	receipt, err := generateReceipt(taxes, rct)
 	if err != nil {
-		return nil, fmt.Errorf("could not marshal receipt: %w", err)
+		return nil, err
 	}
-	replacer := strings.NewReplacer(
-		"<PAYMENT>", "",
-		"</PAYMENT>", "",
-		"<VATTOTAL>", "",
-		"</VATTOTAL>", "")
-
-	receiptBytes = []byte(replacer.Replace(string(receiptBytes)))
-	signedReceipt, err := Sign(privateKey, receiptBytes)
+	receiptBytes := encodeReceipt(receipt)
+	signedReceipt, err := sign(signer, receiptBytes)
 	if err != nil {
 		return nil, fmt.Errorf("could not sign receipt: %w", err)
 	}
-	base64SignedReceipt := encodeBase64Bytes(signedReceipt)
-	receiptString := string(receiptBytes)
-
-	report := fmt.Sprintf("<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>", receiptString, base64SignedReceipt)
-	report = fmt.Sprintf("%s%s", xml.Header, report)
 
-	return []byte(report), nil
+	return envelope(receiptBytes, encodeBase64Bytes(signedReceipt)), nil
 }
 
 // ReceiptLink creates a link to the receipt it accepts RECEIPTCODE, GC and the RECEIPTTIME
@@ -234,71 +234,105 @@ func receiptLink(baseURL string, receiptCode string, gc int64, receiptTime strin
 }
 
 type (
+	// ItemProcessResponse is the result of ProcessItems. Lines holds the
+	// breakdown of every item, in the order of the items, and adds up to
+	// VATTOTALS and TOTALS to the cent. Adjustments holds the tax inclusive
+	// amount of every Adjustment, in the order they were given.
 	ItemProcessResponse struct {
-		ITEMS     []*models.ITEM
-		VATTOTALS []*models.VATTOTAL
-		TOTALS    models.TOTALS
+		ITEMS       []*models.ITEM
+		VATTOTALS   []*models.VATTOTAL
+		TOTALS      models.TOTALS
+		Lines       []ItemLine
+		Adjustments []money.Money
+	}
+
+	// ItemLine is the breakdown of an item at the rate VAT. Amount is the tax
+	// inclusive line amount before the discount, the AMT of the item in the
+	// payload, and Discount the tax inclusive discount. Net and Tax split what is
+	// left once the discount is taken off, Amount - Discount = Net + Tax.
+	//
+	// Surcharge and BasketDiscount are the shares of the adjustments of the
+	// receipt the item got, they are included in Amount and Discount.
+	ItemLine struct {
+		ID             string
+		VAT            ValueAddedTax
+		Amount         money.Money
+		Discount       money.Money
+		Surcharge      money.Money
+		BasketDiscount money.Money
+		Net            money.Money
+		Tax            money.Money
 	}
 
 	vatTotal struct {
 		VATRATE    string
-		NETTAMOUNT float64
-		TAXAMOUNT  float64
+		NETTAMOUNT money.Money
+		TAXAMOUNT  money.Money
 	}
 )
 
 // ProcessItems processes the []Items in the submitted receipt request
 // and create []*models.ITEM which is used to create the xml request also
-// calculates the total discount, total tax exclusive and total tax inclusive
-func ProcessItems(items []Item) *ItemProcessResponse {
+// calculates the total discount, total tax exclusive and total tax inclusive.
+// All amounts are computed in money.Money, so the totals are the exact sums
+// of the per line amounts. VATTOTALS lists the rates used, in the order A to E,
+// so that the same items always produce the same payload. The adjustments of
+// the receipt, if any, are shared out between the items. The rates and the
+// rounding are those of the DefaultTaxTable.
+func ProcessItems(items []Item, adjustments ...Adjustment) *ItemProcessResponse {
+	return DefaultTaxTable().ProcessItems(items, adjustments...)
+}
+
+// ProcessItems is ProcessItems with the rates and the rounding of the table.
+func (t *TaxTable) ProcessItems(items []Item, adjustments ...Adjustment) *ItemProcessResponse {
+	t = t.table()
+	lines := make([]ItemLine, len(items))
+	for i, item := range items {
+		lines[i] = itemLine(item, t.ParseTaxCode(item.TaxCode))
+	}
+	amounts := applyAdjustments(lines, adjustments)
+	if t.rounding == RoundPerRate {
+		roundPerRate(items, lines)
+	}
+
 	var (
-		DISCOUNT          = 0.0
-		TOTALTAXEXCLUSIVE = 0.0
-		TOTALTAXINCLUSIVE = 0.0
+		DISCOUNT          money.Money
+		TOTALTAXEXCLUSIVE money.Money
+		TOTALTAXINCLUSIVE money.Money
 	)
-
-	// TotalPrice = UnitPrice * Quantity
-	// Amount = TotalPrice - Discount
-	// TaxableAmount + TaxableAmount * TaxRate = Amount
 	vatTotals := make(map[string]*vatTotal)
-	var ITEMS []*models.ITEM
-	for _, item := range items {
-		item := item
-		itemAmount := item.Quantity * item.UnitPrice
-		itemXML := &models.ITEM{
+	ITEMS := make([]*models.ITEM, 0, len(items))
+	for i, item := range items {
+		line := lines[i]
+		ITEMS = append(ITEMS, &models.ITEM{
 			ID:      item.ID,
 			DESC:    item.Description,
 			QTY:     item.Quantity,
 			TAXCODE: item.TaxCode,
-			AMT:     itemAmount,
-		}
-		itemAmountWithoutDiscount := itemAmount - item.Discount
-		DISCOUNT += item.Discount
-		ITEMS = append(ITEMS, itemXML)
-		NETAMOUNT := NetAmount(item.TaxCode, itemAmountWithoutDiscount)
-		TOTALTAXEXCLUSIVE += NETAMOUNT
-		TOTALTAXINCLUSIVE += itemAmountWithoutDiscount
-		TAXAMOUNT := ValueAddedTaxAmount(item.TaxCode, itemAmountWithoutDiscount)
-		vatID := ParseTaxCode(item.TaxCode).ID
-		// check if the tax code is already in the map if not add it
+			AMT:     line.Amount,
+		})
+		DISCOUNT += line.Discount
+		TOTALTAXEXCLUSIVE += line.Net
+		TOTALTAXINCLUSIVE += line.Net + line.Tax
+
+		vatID := line.VAT.ID
 		if _, ok := vatTotals[vatID]; !ok {
-			vatTotals[vatID] = &vatTotal{
-				VATRATE:    vatID,
-				NETTAMOUNT: NETAMOUNT,
-				TAXAMOUNT:  TAXAMOUNT,
-			}
-		} else {
-			vatTotals[vatID].NETTAMOUNT += NETAMOUNT
-			vatTotals[vatID].TAXAMOUNT += TAXAMOUNT
+			vatTotals[vatID] = &vatTotal{VATRATE: vatID}
 		}
+		vatTotals[vatID].NETTAMOUNT += line.Net
+		vatTotals[vatID].TAXAMOUNT += line.Tax
 	}
 
 	VATTOTALS := make([]*models.VATTOTAL, 0)
-	for _, v := range vatTotals {
+	for code := int64(StandardVATCODE); code <= ExemptedVATCODE; code++ {
+		v, ok := vatTotals[t.ParseTaxCode(code).ID]
+		if !ok {
+			continue
+		}
 		V := &models.VATTOTAL{
 			VATRATE:    v.VATRATE,
-			NETTAMOUNT: fmt.Sprintf("%.2f", v.NETTAMOUNT),
-			TAXAMOUNT:  fmt.Sprintf("%.2f", v.TAXAMOUNT),
+			NETTAMOUNT: v.NETTAMOUNT,
+			TAXAMOUNT:  v.TAXAMOUNT,
 		}
 		VATTOTALS = append(VATTOTALS, V)
 	}
@@ -308,8 +342,139 @@ func ProcessItems(items []Item) *ItemProcessResponse {
 		DISCOUNT:     DISCOUNT,
 	}
 	return &ItemProcessResponse{
-		ITEMS:     ITEMS,
-		VATTOTALS: VATTOTALS,
-		TOTALS:    TOTALS,
+		ITEMS:       ITEMS,
+		VATTOTALS:   VATTOTALS,
+		TOTALS:      TOTALS,
+		Lines:       lines,
+		Adjustments: amounts,
+	}
+}
+
+// surcharges returns the sum of the surcharges of the lines.
+func (r *ItemProcessResponse) surcharges() money.Money {
+	var total money.Money
+	for _, line := range r.Lines {
+		total += line.Surcharge
+	}
+	return total
+}
+
+// itemLine returns the breakdown of item taxed at vat, with the tax of the line
+// rounded to the cent.
+//
+//	TotalPrice = UnitPrice * Quantity
+//
+// Tax inclusive prices:
+//
+//	Amount = TotalPrice
+//	Net + Net * rate = TotalPrice - Discount
+//
+// Tax exclusive prices, the discount is grossed up like the price:
+//
+//	Net = TotalPrice - Discount
+//	Tax = Net * rate
+//	Amount = Net + Tax + Discount + Discount * rate
+func itemLine(item Item, vat ValueAddedTax) ItemLine {
+	line := ItemLine{ID: item.ID, VAT: vat}
+	price := money.FromFloat(item.UnitPrice).Mul(item.Quantity)
+	discount := money.FromFloat(item.Discount)
+	if item.Pricing != TaxExclusivePricing {
+		line.Amount, line.Discount = price, discount
+		line.Net = vat.Net(price - discount)
+		line.Tax = price - discount - line.Net
+		return line
+	}
+
+	line.Net = price - discount
+	line.Tax = vat.TaxOn(line.Net)
+	line.Discount = discount + vat.TaxOn(discount)
+	line.Amount = line.Net + line.Tax + line.Discount
+	return line
+}
+
+// roundPerRate rounds the tax of the lines of each rate, and pricing, once on
+// their total and hands the cents out again: every line gets its tax rounded
+// down and the cents left go one each to the lines with the largest remainders,
+// the first line winning a tie. The Net of tax inclusive lines and the Amount
+// of tax exclusive lines follow their Tax. Lines with a share of an adjustment
+// are taxed on their tax inclusive amount, whatever their pricing.
+func roundPerRate(items []Item, lines []ItemLine) {
+	type group struct {
+		id        string
+		exclusive bool
+	}
+	groups := make(map[group][]int)
+	var order []group
+	for i, item := range items {
+		exclusive := item.Pricing == TaxExclusivePricing && !lines[i].adjusted()
+		g := group{id: lines[i].VAT.ID, exclusive: exclusive}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	for _, g := range order {
+		indexes := groups[g]
+		vat := lines[indexes[0]].VAT
+		rate := vat.basisPoints()
+
+		// The tax of a line is base * rate / den, of the tax inclusive amount
+		// or of the net amount.
+		den := int64(basisPointsBase)
+		if !g.exclusive {
+			den += rate
+		}
+		var total, rounded money.Money
+		remainders := make([]int64, len(indexes))
+		for j, i := range indexes {
+			line := &lines[i]
+			base := line.Net
+			if !g.exclusive {
+				base = line.Amount - line.Discount
+			}
+			total += base
+
+			n := int64(base) * rate
+			tax, rem := n/den, n%den
+			if rem < 0 {
+				tax, rem = tax-1, rem+den
+			}
+			remainders[j] = rem
+			line.setTax(money.Money(tax), g.exclusive)
+			rounded += line.Tax
+		}
+
+		want := vat.Tax(total)
+		if g.exclusive {
+			want = vat.TaxOn(total)
+		}
+		ranked := make([]int, len(indexes))
+		for j := range ranked {
+			ranked[j] = j
+		}
+		sort.SliceStable(ranked, func(a, b int) bool {
+			return remainders[ranked[a]] > remainders[ranked[b]]
+		})
+		for k := 0; rounded < want && k < len(ranked); k++ {
+			line := &lines[indexes[ranked[k]]]
+			line.setTax(line.Tax+1, g.exclusive)
+			rounded++
+		}
+	}
+}
+
+// adjusted reports whether the line got a share of an adjustment.
+func (l *ItemLine) adjusted() bool {
+	return l.Surcharge != 0 || l.BasketDiscount != 0
+}
+
+// setTax sets the tax of the line and the amount that depends on it.
+func (l *ItemLine) setTax(tax money.Money, exclusive bool) {
+	if exclusive {
+		l.Amount += tax - l.Tax
+	} else {
+		l.Net -= tax - l.Tax
 	}
+	l.Tax = tax
 }
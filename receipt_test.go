@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
 )
 
 func TestProcessItems(t *testing.T) {
@@ -46,14 +47,14 @@ func TestProcessItems(t *testing.T) {
 						XMLName:    xml.Name{},
 						Text:       "",
 						VATRATE:    "A",
-						NETTAMOUNT: "4237.29",
-						TAXAMOUNT:  "762.71",
+						NETTAMOUNT: money.MustParse("4237.29"),
+						TAXAMOUNT:  money.MustParse("762.71"),
 					},
 				},
 				Totals: models.TOTALS{
-					TOTALTAXEXCL: 4237.29,
-					TOTALTAXINCL: 5000.00,
-					DISCOUNT:     5000.00,
+					TOTALTAXEXCL: money.MustParse("4237.29"),
+					TOTALTAXINCL: money.MustParse("5000.00"),
+					DISCOUNT:     money.MustParse("5000.00"),
 				},
 			},
 		},
@@ -78,14 +79,14 @@ func TestProcessItems(t *testing.T) {
 						XMLName:    xml.Name{},
 						Text:       "",
 						VATRATE:    "A",
-						NETTAMOUNT: "4237.29",
-						TAXAMOUNT:  "762.71",
+						NETTAMOUNT: money.MustParse("4237.29"),
+						TAXAMOUNT:  money.MustParse("762.71"),
 					},
 				},
 				Totals: models.TOTALS{
-					TOTALTAXEXCL: 4237.29,
-					TOTALTAXINCL: 5000.00,
-					DISCOUNT:     0.00,
+					TOTALTAXEXCL: money.MustParse("4237.29"),
+					TOTALTAXINCL: money.MustParse("5000.00"),
+					DISCOUNT:     money.MustParse("0.00"),
 				},
 			},
 		},
@@ -96,8 +97,8 @@ func TestProcessItems(t *testing.T) {
 				items := got.ITEMS
 				for i, item := range items {
 					wantItemAmount := tt.want.ItemsAmount[i]
-					message := fmt.Sprintf("[GOT]: Item %d: id: %s, quantity: %.2f, amount: %.2f [EXPECTED]: %.2f\n", i, item.ID, item.QTY, item.AMT, wantItemAmount)
-					if item.AMT != wantItemAmount {
+					message := fmt.Sprintf("[GOT]: Item %d: id: %s, quantity: %.2f, amount: %s [EXPECTED]: %.2f\n", i, item.ID, item.QTY, item.AMT, wantItemAmount)
+					if item.AMT.Float64() != wantItemAmount {
 						t.Errorf("[ERROR] ProcessItems Error(): %s", message)
 					}
 					t.Logf("[INFO] ProcessItems(): %s", message)
@@ -106,15 +107,15 @@ func TestProcessItems(t *testing.T) {
 				// Comparing TOTALS
 				func(got, want models.TOTALS) {
 					if got.TOTALTAXEXCL != want.TOTALTAXEXCL {
-						t.Errorf("[ERROR] TOTALTAXEXCL: got %.2f, want %.2f", got.TOTALTAXEXCL, want.TOTALTAXEXCL)
+						t.Errorf("[ERROR] TOTALTAXEXCL: got %s, want %s", got.TOTALTAXEXCL, want.TOTALTAXEXCL)
 					}
 					if got.TOTALTAXINCL != want.TOTALTAXINCL {
-						t.Errorf("[ERROR] TOTALTAXINCL: got %.2f, want %.2f", got.TOTALTAXINCL, want.TOTALTAXINCL)
+						t.Errorf("[ERROR] TOTALTAXINCL: got %s, want %s", got.TOTALTAXINCL, want.TOTALTAXINCL)
 					}
 					if got.DISCOUNT != want.DISCOUNT {
-						t.Errorf("[ERROR] DISCOUNT: got %.2f, want %.2f", got.DISCOUNT, want.DISCOUNT)
+						t.Errorf("[ERROR] DISCOUNT: got %s, want %s", got.DISCOUNT, want.DISCOUNT)
 					}
-					t.Logf("[INFO] TOTALS: [GOT]: TAXEXCL: %.2f, TAXINCL: %.2f, DISCOUNT: %.2f [EXPECTED]: TAXEXCL: %.2f, TAXINCL: %.2f, DISCOUNT: %.2f ",
+					t.Logf("[INFO] TOTALS: [GOT]: TAXEXCL: %s, TAXINCL: %s, DISCOUNT: %s [EXPECTED]: TAXEXCL: %s, TAXINCL: %s, DISCOUNT: %s ",
 						got.TOTALTAXEXCL, got.TOTALTAXINCL, got.DISCOUNT, want.TOTALTAXEXCL, want.TOTALTAXINCL, want.DISCOUNT)
 				}(got.TOTALS, tt.want.Totals)
 
@@ -187,3 +188,162 @@ func TestReceiptBytes(t *testing.T) {
 
 	t.Logf("Receipt bytes: \n\n%s\n\n", string(got))
 }
+
+func TestProcessItemsVATMatchesLines(t *testing.T) {
+	var items []Item
+	for i, price := range []float64{0.35, 1.15, 19.99, 0.05, 3333.33, 7.77, 0.1, 0.2} {
+		items = append(items, Item{
+			ID:        fmt.Sprint(i),
+			TaxCode:   TaxableItemCode,
+			Quantity:  3,
+			UnitPrice: price,
+			Discount:  0.01,
+		})
+	}
+
+	got := ProcessItems(items)
+
+	var net, tax money.Money
+	for _, item := range got.ITEMS {
+		amount := item.AMT - money.MustParse("0.01")
+		lineNet := standardVAT.Net(amount)
+		net += lineNet
+		tax += amount - lineNet
+	}
+
+	if len(got.VATTOTALS) != 1 {
+		t.Fatalf("VATTOTALS = %d rates, want 1", len(got.VATTOTALS))
+	}
+	vat := got.VATTOTALS[0]
+	if vat.NETTAMOUNT != net || vat.TAXAMOUNT != tax {
+		t.Errorf("VATTOTAL = %s + %s, want the per line sums %s + %s", vat.NETTAMOUNT, vat.TAXAMOUNT, net, tax)
+	}
+	if vat.NETTAMOUNT+vat.TAXAMOUNT != got.TOTALS.TOTALTAXINCL || vat.NETTAMOUNT != got.TOTALS.TOTALTAXEXCL {
+		t.Errorf("VATTOTAL %s + %s does not add up to TOTALS %+v", vat.NETTAMOUNT, vat.TAXAMOUNT, got.TOTALS)
+	}
+}
+
+func TestProcessItemsTaxExclusive(t *testing.T) {
+	got := ProcessItems([]Item{
+		{ID: "1", TaxCode: StandardVATCODE, Quantity: 5, UnitPrice: 1000, Discount: 500, Pricing: TaxExclusivePricing},
+		{ID: "2", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 1180},
+		{ID: "3", TaxCode: ZeroVATCODE, Quantity: 1, UnitPrice: 2000, Pricing: TaxExclusivePricing},
+	})
+
+	var amounts []money.Money
+	for _, item := range got.ITEMS {
+		amounts = append(amounts, item.AMT)
+	}
+	if want := []money.Money{590000, 118000, 200000}; !reflect.DeepEqual(amounts, want) {
+		t.Errorf("ITEM AMT = %v, want %v", amounts, want)
+	}
+
+	wantTotals := models.TOTALS{
+		TOTALTAXEXCL: money.MustParse("7500.00"),
+		TOTALTAXINCL: money.MustParse("8490.00"),
+		DISCOUNT:     money.MustParse("590.00"),
+	}
+	if got.TOTALS != wantTotals {
+		t.Errorf("TOTALS = %+v, want %+v", got.TOTALS, wantTotals)
+	}
+
+	wantVATs := []*models.VATTOTAL{
+		{VATRATE: "A", NETTAMOUNT: money.MustParse("5500.00"), TAXAMOUNT: money.MustParse("990.00")},
+		{VATRATE: "C", NETTAMOUNT: money.MustParse("2000.00"), TAXAMOUNT: 0},
+	}
+	if !reflect.DeepEqual(got.VATTOTALS, wantVATs) {
+		t.Errorf("VATTOTALS = %+v, want %+v", got.VATTOTALS, wantVATs)
+	}
+
+	var sum money.Money
+	for _, item := range got.ITEMS {
+		sum += item.AMT
+	}
+	if sum-got.TOTALS.DISCOUNT != got.TOTALS.TOTALTAXINCL {
+		t.Errorf("items %s less discount %s != TOTALTAXINCL %s", sum, got.TOTALS.DISCOUNT, got.TOTALS.TOTALTAXINCL)
+	}
+}
+
+func TestProcessItemsRoundPerRate(t *testing.T) {
+	items := []Item{
+		{ID: "1", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35},
+		{ID: "2", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35},
+		{ID: "3", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35},
+		{ID: "4", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35, Pricing: TaxExclusivePricing},
+		{ID: "5", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35, Pricing: TaxExclusivePricing},
+		{ID: "6", TaxCode: StandardVATCODE, Quantity: 1, UnitPrice: 0.35, Pricing: TaxExclusivePricing},
+	}
+
+	tests := []struct {
+		rounding VATRounding
+		taxes    []money.Money
+		vat      models.VATTOTAL
+	}{
+		{RoundPerLine, []money.Money{5, 5, 5, 6, 6, 6}, models.VATTOTAL{VATRATE: "A", NETTAMOUNT: 195, TAXAMOUNT: 33}},
+		{RoundPerRate, []money.Money{6, 5, 5, 7, 6, 6}, models.VATTOTAL{VATRATE: "A", NETTAMOUNT: 194, TAXAMOUNT: 35}},
+	}
+	for _, tt := range tests {
+		got := DefaultTaxTable().WithRounding(tt.rounding).ProcessItems(items)
+
+		var taxes []money.Money
+		for _, line := range got.Lines {
+			taxes = append(taxes, line.Tax)
+		}
+		if !reflect.DeepEqual(taxes, tt.taxes) {
+			t.Errorf("rounding %d: line taxes = %v, want %v", tt.rounding, taxes, tt.taxes)
+		}
+		if len(got.VATTOTALS) != 1 || *got.VATTOTALS[0] != tt.vat {
+			t.Errorf("rounding %d: VATTOTALS = %+v, want %+v", tt.rounding, got.VATTOTALS, tt.vat)
+		}
+	}
+
+	if got := DefaultTaxTable().Rounding(); got != RoundPerLine {
+		t.Errorf("DefaultTaxTable().Rounding() = %d, want RoundPerLine", got)
+	}
+}
+
+func TestProcessItemsLinesAddUp(t *testing.T) {
+	var items []Item
+	for i, price := range []float64{0.35, 1.15, 19.99, 0.05, 3333.33, 7.77, 0.1, 0.2, 12.5} {
+		item := Item{ID: fmt.Sprint(i), TaxCode: int64(i%3 + 1), Quantity: 3, UnitPrice: price, Discount: 0.01}
+		if i%2 == 1 {
+			item.Pricing = TaxExclusivePricing
+		}
+		items = append(items, item)
+	}
+
+	for _, rounding := range []VATRounding{RoundPerLine, RoundPerRate} {
+		got := DefaultTaxTable().WithRounding(rounding).ProcessItems(items)
+		if len(got.Lines) != len(items) {
+			t.Fatalf("rounding %d: %d lines for %d items", rounding, len(got.Lines), len(items))
+		}
+
+		var totals models.TOTALS
+		vats := make(map[string]models.VATTOTAL)
+		for i, line := range got.Lines {
+			if line.Amount-line.Discount != line.Net+line.Tax {
+				t.Errorf("rounding %d: line %s amount %s less discount %s != net %s + tax %s",
+					rounding, line.ID, line.Amount, line.Discount, line.Net, line.Tax)
+			}
+			if line.Amount != got.ITEMS[i].AMT {
+				t.Errorf("rounding %d: line %s amount %s != AMT %s", rounding, line.ID, line.Amount, got.ITEMS[i].AMT)
+			}
+			totals.TOTALTAXEXCL += line.Net
+			totals.TOTALTAXINCL += line.Net + line.Tax
+			totals.DISCOUNT += line.Discount
+			v := vats[line.VAT.ID]
+			v.VATRATE = line.VAT.ID
+			v.NETTAMOUNT += line.Net
+			v.TAXAMOUNT += line.Tax
+			vats[line.VAT.ID] = v
+		}
+		if totals != got.TOTALS {
+			t.Errorf("rounding %d: lines add up to %+v, TOTALS = %+v", rounding, totals, got.TOTALS)
+		}
+		for _, v := range got.VATTOTALS {
+			if vats[v.VATRATE] != *v {
+				t.Errorf("rounding %d: lines of %s add up to %+v, VATTOTAL = %+v", rounding, v.VATRATE, vats[v.VATRATE], *v)
+			}
+		}
+	}
+}
@@ -3,13 +3,15 @@ package vfd
 import (
 	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 
 	xhttp "github.com/vfdcloud/vfd/internal/http"
 	"github.com/vfdcloud/vfd/internal/models"
@@ -94,15 +96,17 @@ func responseFormat(response *models.REGDATARESP) *RegistrationResponse {
 // Register send the registration for a Virtual Fiscal Device to the VFD server. The
 // registration request is signed with the private key of the certificate used to
 // authenticate the INSTANCE.
-func Register(ctx context.Context, requestURL string, privateKey *rsa.PrivateKey,
+func Register(ctx context.Context, requestURL string, signer crypto.Signer,
 	request *RegistrationRequest,
 ) (*RegistrationResponse, error) {
 	client := xhttp.Instance()
-	return register(ctx, client, requestURL, privateKey, request)
+	return register(ctx, client, requestURL, Sign, signer, request, nil)
 }
 
-func register(ctx context.Context, client *http.Client, requestURL string, privateKey *rsa.PrivateKey,
-	request *RegistrationRequest,
+// register sends the registration request. If ackCert is not nil the EFDMSSIGNATURE
+// of the response is verified with it.
+func register(ctx context.Context, client *http.Client, requestURL string, sign PayloadSigner,
+	signer crypto.Signer, request *RegistrationRequest, ackCert *x509.Certificate,
 ) (*RegistrationResponse, error) {
 	var (
 		taxIdNumber = request.Tin
@@ -120,7 +124,7 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 		return nil, fmt.Errorf("%v: failed to marshal registration body: %w", ErrRegistrationFailed, err)
 	}
 
-	signedPayload, err := Sign(privateKey, out)
+	signedPayload, err := sign(signer, out)
 	if err != nil {
 		return nil, err
 	}
@@ -168,22 +172,34 @@ func register(ctx context.Context, client *http.Client, requestURL string, priva
 			return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
 		}
 
-		return nil, fmt.Errorf("%w: %s", ErrRegistrationFailed, errBody.Message)
+		return nil, &AckError{
+			Action:     RegisterClientAction,
+			Code:       UnknownAckCode,
+			Message:    errBody.Message,
+			StatusCode: resp.StatusCode,
+			Body:       out,
+		}
 	}
 
-	responseBody := models.REGRESPACK{}
-	err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&responseBody)
-	if err != nil {
+	response := &models.REGDATARESP{}
+	if err := decodeAck(ackCert, out, "EFDMSRESP", response); err != nil {
 		return nil, fmt.Errorf("%v: %w", ErrRegistrationFailed, err)
 	}
 
-	response := &responseBody.EFDMSRESP
-
 	// check if the response code is equal to zero if not
 	// return an error with code and message
 	if responseCode := response.ACKCODE; responseCode != "0" {
-		responseMessage := response.ACKMSG
-		return nil, fmt.Errorf("%v response code: %s, message: %s", ErrRegistrationFailed, responseCode, responseMessage)
+		code, err := strconv.ParseInt(responseCode, 10, 64)
+		if err != nil {
+			code = UnknownAckCode
+		}
+		return nil, &AckError{
+			Action:     RegisterClientAction,
+			Code:       code,
+			Message:    response.ACKMSG,
+			StatusCode: resp.StatusCode,
+			Body:       out,
+		}
 	}
 
 	return responseFormat(response), nil
@@ -0,0 +1,225 @@
+package vfd
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	xhttp "github.com/vfdcloud/vfd/internal/http"
+	"github.com/vfdcloud/vfd/pkg/env"
+)
+
+// ErrTenantNotFound is returned by a TenantLoader for an ID it does not know.
+var ErrTenantNotFound = errors.New("tenant not found")
+
+type (
+	// Tenant is a merchant fiscalising through a Registry. The certificate is
+	// either given as Signer and Certificate or loaded from CertPath with
+	// CertPassword the first time the tenant is used. Signer can be a key held
+	// outside the process, see Sign. Counters defaults to in-memory counters,
+	// see Device.
+	Tenant struct {
+		Registration *RegistrationResponse
+		Env          env.Env
+		CertSerial   string
+		CertPath     string
+		CertPassword string
+		Signer       crypto.Signer
+		Certificate  *x509.Certificate
+		Counters     *Counters
+		Options      []DeviceOption
+	}
+
+	// TenantLoader returns the Tenant identified by id, usually its TIN or the
+	// serial of its VFD. It returns an error wrapping ErrTenantNotFound when
+	// there is no such tenant.
+	TenantLoader func(ctx context.Context, id string) (*Tenant, error)
+
+	// Registry holds a Device per tenant, created on first use from the Tenant
+	// returned by its TenantLoader. Every tenant has its own certificate, token
+	// and counters while all of them share one http.Client and its connection
+	// pool.
+	//
+	// Failures are isolated: a tenant whose certificate does not load or whose
+	// token is rejected does not affect the others, and a tenant that failed to
+	// load is loaded again on its next use. A Registry is safe for concurrent use.
+	Registry struct {
+		load    TenantLoader
+		http    *http.Client
+		options []DeviceOption
+
+		mu      sync.Mutex
+		tenants map[string]*tenantEntry
+	}
+
+	// RegistryOption configures a Registry.
+	RegistryOption func(*Registry)
+
+	// tenantEntry is a tenant being loaded or loaded. done is closed once device
+	// or err is set.
+	tenantEntry struct {
+		done   chan struct{}
+		device *Device
+		err    error
+	}
+)
+
+// WithRegistryHttpClient sets the http.Client shared by every tenant. The default
+// is the client of the package level functions, with a pool of 100 connections.
+func WithRegistryHttpClient(client *http.Client) RegistryOption {
+	return func(r *Registry) {
+		if client != nil {
+			r.http = client
+		}
+	}
+}
+
+// WithRegistryDeviceOptions sets options applied to the Device of every tenant,
+// before the options of the Tenant itself.
+func WithRegistryDeviceOptions(options ...DeviceOption) RegistryOption {
+	return func(r *Registry) {
+		r.options = append(r.options, options...)
+	}
+}
+
+// NewRegistry creates a Registry that loads tenants with load.
+func NewRegistry(load TenantLoader, options ...RegistryOption) *Registry {
+	r := &Registry{
+		load:    load,
+		http:    xhttp.Instance(),
+		tenants: make(map[string]*tenantEntry),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// Device returns the Device of the tenant id, loading the tenant when it is used
+// for the first time. Concurrent calls for a tenant being loaded wait for the
+// same load, calls for other tenants do not.
+func (r *Registry) Device(ctx context.Context, id string) (*Device, error) {
+	r.mu.Lock()
+	entry, ok := r.tenants[id]
+	if !ok {
+		entry = &tenantEntry{done: make(chan struct{})}
+		r.tenants[id] = entry
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		go r.loadTenant(ctx, id, entry)
+	}
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if entry.err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", id, entry.err)
+	}
+	return entry.device, nil
+}
+
+// Remove forgets the tenant id, its Device is created again from the
+// TenantLoader on its next use, for example after its certificate was renewed.
+// In-memory counters and Z report totals of the tenant are lost.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tenants, id)
+}
+
+// Issue issues a receipt for the tenant id, see Device.Issue.
+func (r *Registry) Issue(ctx context.Context, id string, customer Customer, items []Item, payments []Payment,
+	adjustments ...Adjustment,
+) (*IssuedReceipt, error) {
+	device, err := r.Device(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return device.Issue(ctx, customer, items, payments, adjustments...)
+}
+
+// CloseDay submits the Z report of the tenant id, see Device.CloseDay.
+func (r *Registry) CloseDay(ctx context.Context, id string) (*Response, error) {
+	device, err := r.Device(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return device.CloseDay(ctx)
+}
+
+// SubmitReceipt signs and submits a receipt of the tenant id, see
+// Device.SubmitReceipt.
+func (r *Registry) SubmitReceipt(ctx context.Context, id string, receipt *ReceiptRequest) (*Response, error) {
+	device, err := r.Device(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return device.SubmitReceipt(ctx, receipt)
+}
+
+// SubmitReport signs and submits a Z report of the tenant id, see
+// Device.SubmitReport.
+func (r *Registry) SubmitReport(ctx context.Context, id string, report *ReportRequest) (*Response, error) {
+	device, err := r.Device(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return device.SubmitReport(ctx, report)
+}
+
+// loadTenant creates the Device of the tenant id and publishes it to everyone
+// waiting on entry. The load is detached from the cancellation of the caller
+// that triggered it so that other callers are not failed because the first one
+// gave up. A failed load is forgotten so that the next call tries again.
+func (r *Registry) loadTenant(ctx context.Context, id string, entry *tenantEntry) {
+	entry.device, entry.err = r.newDevice(detachedContext{ctx}, id)
+	if entry.err != nil {
+		r.mu.Lock()
+		if r.tenants[id] == entry {
+			delete(r.tenants, id)
+		}
+		r.mu.Unlock()
+	}
+	close(entry.done)
+}
+
+// newDevice loads the tenant id and creates its Device.
+func (r *Registry) newDevice(ctx context.Context, id string) (*Device, error) {
+	tenant, err := r.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.Registration == nil {
+		return nil, errors.New("tenant has no registration response")
+	}
+
+	signer, cert := tenant.Signer, tenant.Certificate
+	if signer == nil {
+		key, loaded, err := LoadCert(tenant.CertPath, tenant.CertPassword)
+		if err != nil {
+			return nil, err
+		}
+		signer, cert = key, loaded
+	}
+
+	options := append([]DeviceOption{
+		WithDeviceClientOptions(WithHttpClient(r.http)),
+	}, r.options...)
+	if tenant.CertSerial != "" {
+		options = append(options, WithDeviceCertSerial(tenant.CertSerial))
+	}
+	if tenant.Counters != nil {
+		options = append(options, WithDeviceCounters(tenant.Counters))
+	}
+	options = append(options, tenant.Options...)
+
+	return NewDevice(signer, cert, tenant.Env, tenant.Registration, options...), nil
+}
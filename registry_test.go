@@ -0,0 +1,154 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+func TestRegistryIsolatesTenants(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	tenants := map[string]*vfd.Tenant{}
+	for i, tin := range []string{"111111111", "222222222"} {
+		key, cert, err := vfdtest.GenerateCertificate("merchant " + tin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial := fmt.Sprintf("serial-%d", i)
+		reg := server.AddDevice(vfdtest.Device{TIN: tin, CertKey: "KEY" + tin, CertSerial: serial, Certificate: cert})
+		tenants[tin] = &vfd.Tenant{Registration: &reg, Env: env.PROD, CertSerial: serial, Signer: key, Certificate: cert}
+	}
+	tenants["333333333"] = &vfd.Tenant{
+		Registration: &vfd.RegistrationResponse{TIN: "333333333"},
+		CertPath:     "testdata/missing.pfx",
+	}
+
+	var loads int32
+	registry := vfd.NewRegistry(func(ctx context.Context, id string) (*vfd.Tenant, error) {
+		atomic.AddInt32(&loads, 1)
+		tenant, ok := tenants[id]
+		if !ok {
+			return nil, vfd.ErrTenantNotFound
+		}
+		return tenant, nil
+	},
+		vfd.WithRegistryHttpClient(server.Client()),
+		vfd.WithRegistryDeviceOptions(vfd.WithDeviceRequestURL(server.RequestURL)),
+	)
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1000}}
+	cash := []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1000}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		tin := []string{"111111111", "222222222"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			issued, err := registry.Issue(ctx, tin, vfd.Customer{Type: vfd.NonCustomerID}, items, cash)
+			if err == nil && issued.Receipt.Params.TIN != tin {
+				err = fmt.Errorf("receipt of %s issued with TIN %s", tin, issued.Receipt.Params.TIN)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Issue() error = %v", err)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("tenants were loaded %d times, want 2", loads)
+	}
+	if n := len(server.Receipts()); n != 10 {
+		t.Errorf("server accepted %d receipts, want 10", n)
+	}
+	if gc := server.LastGC("serial-0"); gc != 5 {
+		t.Errorf("LastGC(serial-0) = %d, want 5", gc)
+	}
+
+	if _, err := registry.Device(ctx, "444444444"); !errors.Is(err, vfd.ErrTenantNotFound) {
+		t.Errorf("Device() of an unknown tenant error = %v, want %v", err, vfd.ErrTenantNotFound)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := registry.Issue(ctx, "333333333", vfd.Customer{Type: vfd.NonCustomerID}, items, cash); err == nil {
+			t.Errorf("Issue() for a tenant without certificate succeeded")
+		}
+	}
+	if loads != 5 {
+		t.Errorf("tenants were loaded %d times, want failed loads to be retried", loads)
+	}
+
+	if _, err := registry.CloseDay(ctx, "222222222"); err != nil {
+		t.Errorf("CloseDay() error = %v", err)
+	}
+	registry.Remove("222222222")
+	if _, err := registry.Device(ctx, "222222222"); err != nil || loads != 6 {
+		t.Errorf("Device() after Remove() = %v, loads = %d", err, loads)
+	}
+}
+
+func TestRegistryLoadOutlivesFirstCaller(t *testing.T) {
+	t.Parallel()
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := &vfd.Tenant{
+		Registration: &vfd.RegistrationResponse{TIN: "111111111"}, Env: env.PROD, Signer: key, Certificate: cert,
+	}
+
+	var loads int32
+	loading, release := make(chan struct{}), make(chan struct{})
+	registry := vfd.NewRegistry(func(ctx context.Context, id string) (*vfd.Tenant, error) {
+		atomic.AddInt32(&loads, 1)
+		close(loading)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return tenant, nil
+	})
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := registry.Device(first, "111111111")
+		firstErr <- err
+	}()
+	<-loading
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Device() of the canceled caller error = %v, want %v", err, context.Canceled)
+	}
+
+	second := make(chan error, 1)
+	go func() {
+		device, err := registry.Device(context.Background(), "111111111")
+		if err == nil && device.Registration() != tenant.Registration {
+			err = errors.New("device of another registration")
+		}
+		second <- err
+	}()
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("Device() of the second caller error = %v", err)
+	}
+	if loads != 1 {
+		t.Errorf("tenant was loaded %d times, want 1", loads)
+	}
+}
@@ -0,0 +1,343 @@
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/pkg/money"
+	"github.com/vfdcloud/vfd/pkg/qrcode"
+)
+
+const (
+	// PaperWidth58mm is the number of characters per line of a 58mm receipt
+	// printer with its default font.
+	PaperWidth58mm = 32
+
+	// PaperWidth80mm is the number of characters per line of an 80mm receipt
+	// printer with its default font.
+	PaperWidth80mm = 48
+
+	// minPaperWidth is the narrowest line the receipt layout fits in.
+	minPaperWidth = 24
+)
+
+// ErrReceiptRejected is returned when printing a receipt whose acknowledgement
+// has an ACKCODE other than SuccessCode.
+var ErrReceiptRejected = errors.New("receipt was rejected by the VFD server")
+
+type (
+	// ReceiptDocument is everything printed on a fiscal receipt: the receipt as
+	// it was submitted, the registration of the device that issued it and the
+	// acknowledgement of the VFD server. Ack may be nil for a receipt still
+	// waiting in the Outbox. Env selects the verification site of the QR code.
+	// Template replaces the HTML template of WriteHTML, see ReceiptTemplate.
+	// Taxes are the rates the receipt was computed with, when nil those of the
+	// TAXCODES of Registration.
+	ReceiptDocument struct {
+		Receipt      *ReceiptRequest
+		Registration *RegistrationResponse
+		Ack          *Response
+		Env          env.Env
+		Template     *template.Template
+		Taxes        *TaxSchedule
+	}
+
+	lineAlign int
+
+	// printLine is a line of the receipt layout. Text is already padded to the
+	// paper width when it has two columns, align only applies to shorter text.
+	// A qr line stands for the verification QR code.
+	printLine struct {
+		text  string
+		align lineAlign
+		bold  bool
+		qr    bool
+	}
+)
+
+const (
+	alignLeft lineAlign = iota
+	alignCenter
+	alignRight
+)
+
+// Link returns the verification URL encoded in the QR code of the receipt.
+func (d *ReceiptDocument) Link() string {
+	return ReceiptLink(d.Env, d.Registration.RECEIPTCODE, d.Receipt.Params.GlobalCounter, d.Receipt.Params.Time)
+}
+
+// VerificationCode returns the RCTVNUM of the receipt, the receipt code of the
+// device followed by the global counter when ReceiptVNum is not set.
+func (d *ReceiptDocument) VerificationCode() string {
+	if d.Receipt.Params.ReceiptVNum != "" {
+		return d.Receipt.Params.ReceiptVNum
+	}
+	return fmt.Sprintf("%s%d", d.Registration.RECEIPTCODE, d.Receipt.Params.GlobalCounter)
+}
+
+// QRCode encodes Link at the highest error correction level that still fits
+// width modules, or at qrcode.Low when none does.
+func (d *ReceiptDocument) QRCode(width int) (*qrcode.Code, error) {
+	var code *qrcode.Code
+	for _, level := range []qrcode.Level{qrcode.Medium, qrcode.Low} {
+		c, err := qrcode.Encode([]byte(d.Link()), level)
+		if err != nil {
+			return nil, err
+		}
+		code = c
+		if c.Size <= width {
+			break
+		}
+	}
+	return code, nil
+}
+
+// WriteText writes the receipt as plain text lines of width characters, use
+// PaperWidth58mm or PaperWidth80mm. The QR code is drawn with Unicode half
+// blocks, the printer or terminal must support them.
+func (d *ReceiptDocument) WriteText(w io.Writer, width int) error {
+	lines, err := d.layout(width)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		if !line.qr {
+			b.WriteString(strings.TrimRight(align(line.text, line.align, width), " "))
+			b.WriteByte('\n')
+			continue
+		}
+
+		code, err := d.QRCode(width)
+		if err != nil {
+			return err
+		}
+		quiet := (width - code.Size) / 2
+		if quiet > 4 {
+			quiet = 4
+		}
+		if quiet < 0 {
+			quiet = 0
+		}
+		for _, l := range code.Lines(quiet) {
+			b.WriteString(strings.TrimRight(align(l, alignCenter, width), " "))
+			b.WriteByte('\n')
+		}
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// layout lays the receipt out in lines of width characters. The text, ESC/POS
+// and HTML renderers all print the same lines.
+func (d *ReceiptDocument) layout(width int) ([]printLine, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+	if width < minPaperWidth {
+		return nil, fmt.Errorf("paper width %d is less than %d characters", width, minPaperWidth)
+	}
+
+	table, err := d.taxTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reg      = d.Registration
+		params   = d.Receipt.Params
+		customer = d.Receipt.Customer
+		lines    []printLine
+	)
+	center := func(text string, bold bool) {
+		for _, l := range wrap(text, width) {
+			lines = append(lines, printLine{text: l, align: alignCenter, bold: bold})
+		}
+	}
+	left := func(text string) {
+		for _, l := range wrap(text, width) {
+			lines = append(lines, printLine{text: l})
+		}
+	}
+	pair := func(label, value string, bold bool) {
+		for _, l := range columns(label, value, width) {
+			lines = append(lines, printLine{text: l, bold: bold})
+		}
+	}
+	rule := func() {
+		lines = append(lines, printLine{text: strings.Repeat("-", width)})
+	}
+
+	center("*** START OF LEGAL RECEIPT ***", false)
+	center(strings.ToUpper(reg.NAME), true)
+	for _, l := range []string{reg.ADDRESS, reg.STREET, joinNonEmpty(", ", reg.CITY, reg.COUNTRY)} {
+		if l != "" {
+			center(strings.ToUpper(l), false)
+		}
+	}
+	center("MOBILE: "+reg.MOBILE, false)
+	center("TIN: "+reg.TIN, false)
+	center("VRN: "+reg.VRN, false)
+	center("SERIAL NO: "+reg.SERIAL, false)
+	center("UIN: "+reg.UIN, false)
+	center("TAX OFFICE: "+reg.TAXOFFICE, false)
+	rule()
+
+	pair("CUSTOMER NAME:", customer.Name, false)
+	pair("CUSTOMER ID TYPE:", customer.Type.String(), false)
+	pair("CUSTOMER ID:", customer.ID, false)
+	pair("CUSTOMER MOBILE:", customer.Mobile, false)
+	rule()
+
+	pair("RECEIPT NUMBER:", params.ReceiptNum, false)
+	pair("Z NUMBER:", params.ZNum, false)
+	pair("RECEIPT DATE:", params.Date, false)
+	pair("RECEIPT TIME:", params.Time, false)
+	rule()
+
+	result := table.ProcessItems(d.Receipt.Items, d.Receipt.Adjustments...)
+	for i, item := range d.Receipt.Items {
+		vat := table.ParseTaxCode(item.TaxCode)
+		left(item.Description)
+		quantity := fmt.Sprintf("  %v x %s", item.Quantity, money.FromFloat(item.UnitPrice))
+		if item.Pricing == TaxExclusivePricing {
+			quantity += " +VAT"
+		}
+		line := result.Lines[i]
+		pair(quantity, fmt.Sprintf("%s %s", line.Amount-line.Surcharge, vat.ID), false)
+		if discount := line.Discount - line.BasketDiscount; discount != 0 {
+			pair("  DISCOUNT", (-discount).String(), false)
+		}
+	}
+	for i, adjustment := range d.Receipt.Adjustments {
+		pair(strings.ToUpper(adjustment.label()), adjustment.signed(result.Adjustments[i]).String(), false)
+	}
+	rule()
+
+	var tax money.Money
+	pair("TOTAL EXCL OF TAX:", result.TOTALS.TOTALTAXEXCL.String(), false)
+	for _, v := range result.VATTOTALS {
+		label := v.VATRATE
+		if vat, ok := table.vat(v.VATRATE); ok {
+			label = fmt.Sprintf("%s-%.2f%%", vat.ID, vat.Percentage)
+		}
+		pair("TAX "+label+":", v.TAXAMOUNT.String(), false)
+		tax += v.TAXAMOUNT
+	}
+	pair("TOTAL TAX:", tax.String(), false)
+	if result.TOTALS.DISCOUNT != 0 {
+		pair("DISCOUNT:", result.TOTALS.DISCOUNT.String(), false)
+	}
+	pair("TOTAL INCL OF TAX:", result.TOTALS.TOTALTAXINCL.String(), true)
+	rule()
+
+	for _, p := range d.Receipt.Payments {
+		pair(string(p.Type), money.FromFloat(p.Amount).String(), false)
+	}
+	rule()
+
+	center("RECEIPT VERIFICATION CODE", false)
+	center(d.VerificationCode(), true)
+	lines = append(lines, printLine{qr: true})
+	center("*** END OF LEGAL RECEIPT ***", false)
+
+	return lines, nil
+}
+
+// check returns an error when the document can not be printed.
+func (d *ReceiptDocument) check() error {
+	if d.Receipt == nil || d.Registration == nil {
+		return errors.New("receipt document needs a receipt and a registration")
+	}
+	if d.Ack != nil && !IsSuccess(d.Ack.Code) {
+		return fmt.Errorf("%w: ack code %d: %s", ErrReceiptRejected, d.Ack.Code, d.Ack.Message)
+	}
+	return nil
+}
+
+// taxTable returns the rates the receipt was computed with.
+func (d *ReceiptDocument) taxTable() (*TaxTable, error) {
+	if d.Taxes != nil {
+		p := d.Receipt.Params
+		return d.Taxes.tableAt(p.Date, p.Time)
+	}
+	return registrationTaxTable(d.Registration)
+}
+
+// columns puts label on the left and value on the right of a line of width
+// characters. When both do not fit, the label is wrapped and the value right
+// aligned on a line of its own.
+func columns(label, value string, width int) []string {
+	gap := width - utf8.RuneCountInString(label) - utf8.RuneCountInString(value)
+	if gap >= 1 {
+		return []string{label + strings.Repeat(" ", gap) + value}
+	}
+
+	return append(wrap(label, width), align(value, alignRight, width))
+}
+
+// align pads text to width characters.
+func align(text string, a lineAlign, width int) string {
+	gap := width - utf8.RuneCountInString(text)
+	if gap <= 0 {
+		return text
+	}
+	switch a {
+	case alignCenter:
+		return strings.Repeat(" ", gap/2) + text + strings.Repeat(" ", gap-gap/2)
+	case alignRight:
+		return strings.Repeat(" ", gap) + text
+	default:
+		return text + strings.Repeat(" ", gap)
+	}
+}
+
+// wrap breaks text into lines of at most width characters, at spaces when
+// possible.
+func wrap(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for utf8.RuneCountInString(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func joinNonEmpty(sep string, values ...string) string {
+	var parts []string
+	for _, v := range values {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,115 @@
+package vfd_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+)
+
+func testReceiptDocument() *vfd.ReceiptDocument {
+	return &vfd.ReceiptDocument{
+		Receipt: &vfd.ReceiptRequest{
+			Params: vfd.ReceiptParams{
+				Date:          "2023-03-14",
+				Time:          "08:05:09",
+				TIN:           "123456789",
+				ReceiptNum:    "1042",
+				DailyCounter:  7,
+				GlobalCounter: 1042,
+				ZNum:          "20230314",
+				ReceiptVNum:   "6C72A51042",
+			},
+			Customer: vfd.Customer{Type: vfd.TINCustomerID, ID: "987654321", Name: "Mama Ntilie & Sons", Mobile: "0713000000"},
+			Items: []vfd.Item{
+				{ID: "1", Description: "Sugar", TaxCode: vfd.NonTaxableItemCode, Quantity: 0.5, UnitPrice: 3200},
+				{ID: "2", Description: "Bar soap, lemon scented, family pack of twelve", TaxCode: vfd.TaxableItemCode,
+					Quantity: 3, UnitPrice: 1499.99, Discount: 0.97},
+			},
+			Payments: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 5000}, {Type: vfd.ElectronicPaymentType, Amount: 1099}},
+		},
+		Registration: &vfd.RegistrationResponse{
+			NAME:        "Acme Traders Ltd",
+			STREET:      "Morogoro Road",
+			CITY:        "Dar es Salaam",
+			COUNTRY:     "Tanzania",
+			MOBILE:      "0713000000",
+			TIN:         "123456789",
+			VRN:         "40-012345-A",
+			SERIAL:      "10TZ100089",
+			UIN:         "09VFDWEBAPI-123456789",
+			TAXOFFICE:   "Kinondoni",
+			RECEIPTCODE: "6C72A5",
+		},
+		Ack: &vfd.Response{Number: 1042, Code: vfd.SuccessCode, Message: "Success"},
+		Env: env.PROD,
+	}
+}
+
+func TestReceiptDocumentWriteText(t *testing.T) {
+	doc := testReceiptDocument()
+	if link := doc.Link(); link != "https://verify.tra.go.tz/6C72A51042_080509" {
+		t.Errorf("Link() = %q", link)
+	}
+
+	for name, width := range map[string]int{"receipt_58mm.txt": vfd.PaperWidth58mm, "receipt_80mm.txt": vfd.PaperWidth80mm} {
+		var buf bytes.Buffer
+		if err := doc.WriteText(&buf, width); err != nil {
+			t.Fatalf("WriteText(%d) error = %v", width, err)
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if n := len([]rune(line)); n > width {
+				t.Errorf("line %q is %d characters wide, want at most %d", line, n, width)
+			}
+		}
+		golden(t, name, buf.Bytes())
+	}
+}
+
+func TestReceiptDocumentWriteESCPOS(t *testing.T) {
+	doc := testReceiptDocument()
+	doc.Receipt.Customer.Name = "Mama Ntilié"
+
+	var buf bytes.Buffer
+	if err := doc.WriteESCPOS(&buf, vfd.PaperWidth58mm); err != nil {
+		t.Fatalf("WriteESCPOS() error = %v", err)
+	}
+	out := buf.Bytes()
+
+	link := doc.Link()
+	store := append([]byte{0x1D, 0x28, 0x6B, byte(len(link) + 3), 0x00, 0x31, 0x50, 0x30}, link...)
+	for name, want := range map[string][]byte{
+		"centred header":    []byte("\x1b@\x1ba\x01*** START OF LEGAL RECEIPT ***\n"),
+		"bold name":         []byte("\n\x1bE\x01ACME TRADERS LTD\x1bE\x00\n"),
+		"left aligned rule": []byte("\x1ba\x00--------------------------------\n"),
+		"QR module size 4":  {0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x43, 0x04},
+		"QR level M":        {0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x45, 0x31},
+		"QR data":           store,
+		"non ASCII":         []byte("Mama Ntili?\n"),
+	} {
+		if !bytes.Contains(out, want) {
+			t.Errorf("WriteESCPOS() has no %s %q", name, want)
+		}
+	}
+	if !bytes.HasPrefix(out, []byte{0x1B, 0x40}) || !bytes.HasSuffix(out, []byte{0x1D, 0x56, 0x42, 0x03}) {
+		t.Errorf("WriteESCPOS() does not start with ESC @ and end with a cut")
+	}
+
+	golden(t, "receipt_58mm.escpos", out)
+}
+
+func TestReceiptDocumentRejected(t *testing.T) {
+	doc := testReceiptDocument()
+	doc.Ack = &vfd.Response{Code: vfd.InvalidSignatureCode, Message: "Invalid Signature"}
+	if err := doc.WriteText(&bytes.Buffer{}, vfd.PaperWidth80mm); !errors.Is(err, vfd.ErrReceiptRejected) {
+		t.Errorf("WriteText() error = %v, want %v", err, vfd.ErrReceiptRejected)
+	}
+
+	doc.Ack = nil
+	if err := doc.WriteText(&bytes.Buffer{}, 10); err == nil {
+		t.Errorf("WriteText() with a width of 10 succeeded")
+	}
+}
@@ -1,19 +1,20 @@
 package vfd
 
 import (
-	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
-	"io"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	xhttp "github.com/vfdcloud/vfd/internal/http"
 
 	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
 )
 
 var ErrReportSubmitFailed = fmt.Errorf("report submit failed")
@@ -64,75 +65,36 @@ type (
 
 // submitReport submits a report to the VFD server.
 func submitReport(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
-	privateKey *rsa.PrivateKey,
+	signer crypto.Signer,
 	report *ReportRequest,
 ) (*Response, error) {
-	var (
-		certSerial  = headers.CertSerial
-		bearerToken = headers.BearerToken
-	)
-
-	newContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	payload, err := ReportBytes(
-		privateKey, report.Params, *report.Address, report.VATS,
-		report.Payment, *report.Totals)
+	payload, err := reportBytes(SignPayload, signer, nil, report)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate the report payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(newContext, http.MethodPost, requestURL, bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", ContentTypeXML)
-	req.Header.Set("Routing-Key", SubmitReportRoutingKey)
-	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
-	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, checkNetworkError(newContext, "submit report", err)
-	}
-	defer resp.Body.Close()
-
-	out, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
-	}
-
-	if resp.StatusCode == http.StatusInternalServerError {
-		errBody := models.Error{}
-		err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody)
-		if err != nil {
-			return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
-		}
-
-		return nil, fmt.Errorf("registration error: %s", errBody.Message)
-	}
+	return submitReportPayload(ctx, client, requestURL, headers, payload, nil)
+}
 
-	response := models.ReportAckEFDMS{}
-	err = xml.NewDecoder(bytes.NewBuffer(out)).Decode(&response)
+// submitReportPayload sends an already signed Z report payload as produced by
+// ReportBytes and decodes the acknowledgement, verifying its
+// signature with ackCert when it is not nil.
+func submitReportPayload(ctx context.Context, client *http.Client, requestURL string, headers *RequestHeaders,
+	payload []byte, ackCert *x509.Certificate,
+) (*Response, error) {
+	out, err := submitPayload(ctx, client, requestURL, SubmitReportAction, headers, payload)
 	if err != nil {
-		return nil, fmt.Errorf("%v : %w", ErrReportSubmitFailed, err)
+		return nil, err
 	}
 
-	return &Response{
-		Number:  response.ZACK.ZNUMBER,
-		Date:    response.ZACK.DATE,
-		Time:    response.ZACK.TIME,
-		Code:    response.ZACK.ACKCODE,
-		Message: response.ZACK.ACKMSG,
-	}, nil
+	return decodeReportAck(out, ackCert)
 }
 
-func SubmitReport(ctx context.Context, url string, headers *RequestHeaders, privateKey *rsa.PrivateKey,
+func SubmitReport(ctx context.Context, url string, headers *RequestHeaders, signer crypto.Signer,
 	report *ReportRequest,
 ) (*Response, error) {
 	client := xhttp.Instance()
-	return submitReport(ctx, client, url, headers, privateKey, report)
+	return submitReport(ctx, client, url, headers, signer, report)
 }
 
 func (lines *Address) AsList() []string {
@@ -144,100 +106,72 @@ func (lines *Address) AsList() []string {
 	}
 }
 
-// sumVatTotals
-func sumVatTotals(vats []VATTOTAL) models.VATTOTALS {
-	vatTotalMap := map[string]struct {
-		NetAmount float64
-		TaxAmount float64
-	}{
-		"A-18.00": {0, 0},
-		"B-0.00":  {0, 0},
-		"C-0.00":  {0, 0},
-		"D-0.00":  {0, 0},
-		"E-0.00":  {0, 0},
+// sumVatTotals sums the VAT totals per rate and returns one VATTOTAL for each
+// of the rates A to E of table, in that order, including the rates without
+// sales. Rates of vats that are not in table follow, ordered by ID and rate.
+func sumVatTotals(table *TaxTable, vats []VATTOTAL) models.VATTOTALS {
+	type amounts struct {
+		NetAmount money.Money
+		TaxAmount money.Money
 	}
 
+	var rates []string
+	listed := make(map[string]bool)
+	for _, vat := range table.VATs() {
+		rates = append(rates, vat.reportRateID())
+		listed[vat.reportRateID()] = true
+	}
+	vatTotalMap := make(map[string]amounts, len(rates))
+	var others []ValueAddedTax
 	for _, vat := range vats {
-		rate := fmt.Sprintf("%s-%.2f", vat.ID, vat.Rate)
-		vatTotalMap[rate] = struct {
-			NetAmount float64
-			TaxAmount float64
-		}{
-			vatTotalMap[rate].NetAmount + vat.NetAmount,
-			vatTotalMap[rate].TaxAmount + vat.TaxAmount,
+		v := ValueAddedTax{ID: vat.ID, Percentage: vat.Rate}
+		rate := v.reportRateID()
+		total, ok := vatTotalMap[rate]
+		if !ok && !listed[rate] {
+			others = append(others, v)
+		}
+		total.NetAmount += money.FromFloat(vat.NetAmount)
+		total.TaxAmount += money.FromFloat(vat.TaxAmount)
+		vatTotalMap[rate] = total
+	}
+	sortVATs(others)
+	for _, v := range others {
+		rates = append(rates, v.reportRateID())
+	}
+
+	totals := make([]*models.VATTOTAL, len(rates))
+	for i, rate := range rates {
+		totals[i] = &models.VATTOTAL{
+			VATRATE:    rate,
+			NETTAMOUNT: vatTotalMap[rate].NetAmount,
+			TAXAMOUNT:  vatTotalMap[rate].TaxAmount,
 		}
 	}
 
 	return models.VATTOTALS{
-		VATTOTAL: []*models.VATTOTAL{
-			{
-				VATRATE:    "A-18.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["A-18.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["A-18.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "B-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["B-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["B-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "C-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["C-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["C-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "D-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["D-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["D-0.00"].TaxAmount),
-			},
-			{
-				VATRATE:    "E-0.00",
-				NETTAMOUNT: fmt.Sprintf("%.2f", vatTotalMap["E-0.00"].NetAmount),
-				TAXAMOUNT:  fmt.Sprintf("%.2f", vatTotalMap["E-0.00"].TaxAmount),
-			},
-		},
+		VATTOTAL: totals,
 	}
 }
 
-// sumPayments sums all payments
+// sumPayments sums all payments per type and returns one PAYMENT for each of
+// CASH, CHEQUE, CCARD, EMONEY and INVOICE, in that order.
 func sumPayments(payments []Payment) models.PAYMENTS {
-	paymentMap := map[string]float64{
-		"CASH":    0.0,
-		"CHEQUE":  0.0,
-		"CCARD":   0.0,
-		"EMONEY":  0.0,
-		"INVOICE": 0.0,
+	types := []PaymentType{
+		CashPaymentType, ChequePaymentType, CreditCardPaymentType,
+		ElectronicPaymentType, InvoicePaymentType,
 	}
 
+	paymentMap := make(map[PaymentType]money.Money, len(types))
 	for _, p := range payments {
-		pType := string(p.Type)
-		paymentMap[pType] += p.Amount
+		paymentMap[p.Type] += money.FromFloat(p.Amount)
 	}
 
-	// paymentList contains a list of payments and the order
-	// should be the same as in the paymentMap
-	paymentsList := make([]*models.PAYMENT, 5)
-	paymentsList[0] = &models.PAYMENT{
-		PMTTYPE:   "CASH",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CASH"]),
-	}
-	paymentsList[1] = &models.PAYMENT{
-		PMTTYPE:   "CHEQUE",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CHEQUE"]),
-	}
-	paymentsList[2] = &models.PAYMENT{
-		PMTTYPE:   "CCARD",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["CCARD"]),
-	}
-
-	paymentsList[3] = &models.PAYMENT{
-		PMTTYPE:   "EMONEY",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["EMONEY"]),
-	}
-
-	paymentsList[4] = &models.PAYMENT{
-		PMTTYPE:   "INVOICE",
-		PMTAMOUNT: fmt.Sprintf("%.2f", paymentMap["INVOICE"]),
+	paymentsList := make([]*models.PAYMENT, len(types))
+	for i, t := range types {
+		paymentsList[i] = &models.PAYMENT{
+			PMTTYPE:   string(t),
+			PMTAMOUNT: paymentMap[t],
+		}
 	}
 
 	return models.PAYMENTS{
@@ -245,27 +179,34 @@ func sumPayments(payments []Payment) models.PAYMENTS {
 	}
 }
 
-func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, payments []Payment, totals ReportTotals) *models.ZREPORT {
+func generateZReport(taxes *TaxSchedule, params *ReportParams, address Address, vats []VATTOTAL, payments []Payment, totals ReportTotals) (*models.ZREPORT, error) {
 	const (
 		SIMIMSI       = "WEBAPI"
 		FWVERSION     = "3.0"
 		FWCHECKSUM    = "WEBAPI"
-		VATCHANGENUM  = "0"
 		HEADCHANGENUM = "0"
 		ERRORS        = ""
 	)
 
+	// The rates listed and the VAT changes counted are those in effect at the
+	// end of the day reported.
+	table, changes, err := taxes.reportTable(params)
+	if err != nil {
+		return nil, err
+	}
+	VATCHANGENUM := strconv.Itoa(changes)
+
 	PAYMENTS := sumPayments(payments)
-	VATTOTALS := sumVatTotals(vats)
+	VATTOTALS := sumVatTotals(table, vats)
 
 	TT := models.REPORTTOTALS{
-		DAILYTOTALAMOUNT: totals.DailyTotalAmount,
-		GROSS:            totals.Gross,
-		CORRECTIONS:      totals.Corrections,
-		DISCOUNTS:        totals.Discounts,
-		SURCHARGES:       totals.Surcharges,
+		DAILYTOTALAMOUNT: money.FromFloat(totals.DailyTotalAmount),
+		GROSS:            money.FromFloat(totals.Gross),
+		CORRECTIONS:      money.FromFloat(totals.Corrections),
+		DISCOUNTS:        money.FromFloat(totals.Discounts),
+		SURCHARGES:       money.FromFloat(totals.Surcharges),
 		TICKETSVOID:      totals.TicketsVoid,
-		TICKETSVOIDTOTAL: totals.TicketsVoidTotal,
+		TICKETSVOIDTOTAL: money.FromFloat(totals.TicketsVoidTotal),
 		TICKETSFISCAL:    totals.TicketsFiscal,
 		TICKETSNONFISCAL: totals.TicketsNonFiscal,
 	}
@@ -305,49 +246,58 @@ func generateZReport(params *ReportParams, address Address, vats []VATTOTAL, pay
 		FWCHECKSUM: FWCHECKSUM,
 	}
 
-	// report.RoundOff()
-
-	return report
+	return report, nil
 }
 
-// ReportBytes returns the bytes of the report payload. It calls xml.Marshal on the report.
-// then replace all the occurrences of <PAYMENT>, </PAYMENT>, <VATTOTAL>, </VATTOTAL> with empty string ""
-// and then add the xml.Header to the beginning of the payload.
-func ReportBytes(privateKey *rsa.PrivateKey, params *ReportParams, address Address,
+// ReportBytes returns the signed EFDMS envelope of the report. The <ZREPORT>
+// element is written by encodeZReport, without the <PAYMENT> and <VATTOTAL>
+// wrappers and with every amount formatted with 2 decimals. VATTOTALS lists the
+// rates of the DefaultTaxTable.
+func ReportBytes(signer crypto.Signer, params *ReportParams, address Address,
 	vats []VATTOTAL, payments []Payment,
 	totals ReportTotals,
 ) ([]byte, error) {
-	zReport := generateZReport(params, address, vats, payments, totals)
-	payload, err := xml.Marshal(zReport)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal the report: %w", err)
+	return reportBytes(SignPayload, signer, nil, &ReportRequest{
+		Params: params, Address: &address, Totals: &totals, VATS: vats, Payment: payments,
+	})
+}
+
+// reportTable returns the table in effect at the end of the day reported and
+// the number of changes that took effect before. The day is only parsed when
+// the rates changed.
+func (s *TaxSchedule) reportTable(params *ReportParams) (*TaxTable, int, error) {
+	if s == nil || len(s.changes) == 0 {
+		table, changes := s.before(time.Time{})
+		return table, changes, nil
 	}
-	payloadString := formatReportXmlPayload(payload, totals, vats, payments)
-	signedPayload, err := SignPayload(privateKey, []byte(payloadString))
+	end, err := reportDayEnd(params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign the payload: %w", err)
+		return nil, 0, err
 	}
-	base64PayloadSignature := encodeBase64Bytes(signedPayload)
-	report := fmt.Sprintf("<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>", payloadString, base64PayloadSignature)
-	report = fmt.Sprintf("%s%s", xml.Header, report)
-
-	return []byte(report), nil
+	table, changes := s.before(end)
+	return table, changes, nil
 }
 
-func formatReportXmlPayload(payload []byte, totals ReportTotals, vats []VATTOTAL, payments []Payment) string {
-	replaceList := []string{"<PAYMENT>", "", "</PAYMENT>", "", "<VATTOTAL>", "", "</VATTOTAL>", ""}
-	replacer := strings.NewReplacer(replaceList...)
-	payloadString := replacer.Replace(string(payload))
-
-	var (
-		regexDailyAmount = regexp.MustCompile(`<DAILYTOTALAMOUNT>.*</DAILYTOTALAMOUNT>`)
-		regexGrossAmount = regexp.MustCompile(`<GROSS>.*</GROSS>`)
-		dailyAmountTag   = fmt.Sprintf("<DAILYTOTALAMOUNT>%.2f</DAILYTOTALAMOUNT>", totals.DailyTotalAmount)
-		grossAmountTag   = fmt.Sprintf("<GROSS>%.2f</GROSS>", totals.Gross)
-	)
+// reportDayEnd returns the end of the day of the ZNUMBER of params, or the time
+// of the report when ZNUMBER is not a date.
+func reportDayEnd(params *ReportParams) (time.Time, error) {
+	day, err := time.ParseInLocation(ZNumLayout, params.ZNumber, eastAfricaTime)
+	if err != nil {
+		return receiptTime(params.Date, params.Time)
+	}
+	return day.AddDate(0, 0, 1), nil
+}
 
-	payloadString = regexDailyAmount.ReplaceAllString(payloadString, dailyAmountTag)
-	payloadString = regexGrossAmount.ReplaceAllString(payloadString, grossAmountTag)
+func reportBytes(sign PayloadSigner, signer crypto.Signer, taxes *TaxSchedule, report *ReportRequest) ([]byte, error) {
+	zReport, err := generateZReport(taxes, report.Params, *report.Address, report.VATS, report.Payment, *report.Totals)
+	if err != nil {
+		return nil, err
+	}
+	payload := encodeZReport(zReport)
+	signedPayload, err := sign(signer, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign the payload: %w", err)
+	}
 
-	return payloadString
+	return envelope(payload, encodeBase64Bytes(signedPayload)), nil
 }
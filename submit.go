@@ -0,0 +1,142 @@
+package vfd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/vfdcloud/vfd/internal/models"
+)
+
+// submitPayload posts a signed receipt or Z report payload to the VFD server and
+// returns the raw response body. HTTP 5xx responses are returned as a retryable
+// *AckError carrying their error message, and HTTP 401/403 responses as
+// *AuthError so that callers can fetch a new token and replay the same payload.
+func submitPayload(ctx context.Context, client *http.Client, requestURL string, action Action,
+	headers *RequestHeaders, payload []byte,
+) ([]byte, error) {
+	var (
+		certSerial  = headers.CertSerial
+		bearerToken = headers.BearerToken
+	)
+
+	newContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(newContext, http.MethodPost, requestURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", ContentTypeXML)
+	req.Header.Set("Cert-Serial", encodeBase64String(certSerial))
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", bearerToken))
+
+	switch action {
+	case SubmitReceiptAction:
+		req.Header.Set("Routing-Key", SubmitReceiptRoutingKey)
+	case SubmitReportAction:
+		req.Header.Set("Routing-Key", SubmitReportRoutingKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, checkNetworkError(newContext, fmt.Sprintf("%s submit", action), err)
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: could not close response body %v", action, err)
+		}
+	}(resp.Body)
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &NetworkError{Err: err, Message: fmt.Sprintf("%s submit: could not read response", action)}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, &AuthError{
+			Action:     action,
+			StatusCode: resp.StatusCode,
+			Body:       out,
+		}
+
+	case resp.StatusCode >= http.StatusInternalServerError:
+		// Gateways in front of the VFD server answer with their own pages, the
+		// status text stands in for a message that can not be decoded.
+		errBody := models.Error{}
+		if err := xml.NewDecoder(bytes.NewBuffer(out)).Decode(&errBody); err != nil {
+			errBody.Message = http.StatusText(resp.StatusCode)
+		}
+
+		return nil, &AckError{
+			Action:     action,
+			Code:       UnknownAckCode,
+			Message:    errBody.Message,
+			StatusCode: resp.StatusCode,
+			Body:       out,
+		}
+	}
+
+	return out, nil
+}
+
+// decodeReceiptAck decodes the RCTACK returned after a receipt submission. If ackCert
+// is not nil the EFDMSSIGNATURE of the acknowledgement is verified with it and the
+// response is decoded from the verified bytes. An ACKCODE other than SuccessCode is
+// returned as an *AckError along with the response, an acknowledgement that can not
+// be decoded or verified as an *UnreadableAckError.
+func decodeReceiptAck(body []byte, ackCert *x509.Certificate) (*Response, error) {
+	ack := models.RCTACK{}
+	if err := decodeAck(ackCert, body, "RCTACK", &ack); err != nil {
+		return nil, &UnreadableAckError{Action: SubmitReceiptAction, Body: body, Err: err}
+	}
+
+	return checkAck(SubmitReceiptAction, body, &Response{
+		Number:  ack.RCTNUM,
+		Date:    ack.DATE,
+		Time:    ack.TIME,
+		Code:    ack.ACKCODE,
+		Message: ack.ACKMSG,
+	})
+}
+
+// decodeReportAck decodes the ZACK returned after a Z report submission, as
+// decodeReceiptAck does.
+func decodeReportAck(body []byte, ackCert *x509.Certificate) (*Response, error) {
+	ack := models.ZACK{}
+	if err := decodeAck(ackCert, body, "ZACK", &ack); err != nil {
+		return nil, &UnreadableAckError{Action: SubmitReportAction, Body: body, Err: err}
+	}
+
+	return checkAck(SubmitReportAction, body, &Response{
+		Number:  ack.ZNUMBER,
+		Date:    ack.DATE,
+		Time:    ack.TIME,
+		Code:    ack.ACKCODE,
+		Message: ack.ACKMSG,
+	})
+}
+
+// checkAck returns response together with an *AckError when its code is not
+// SuccessCode.
+func checkAck(action Action, body []byte, response *Response) (*Response, error) {
+	if IsSuccess(response.Code) {
+		return response, nil
+	}
+
+	return response, &AckError{
+		Action:     action,
+		Code:       response.Code,
+		Message:    response.Message,
+		StatusCode: http.StatusOK,
+		Body:       body,
+	}
+}
@@ -0,0 +1,302 @@
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInvalidTaxTable is returned when tax rates can not be turned into a
+// TaxTable.
+var ErrInvalidTaxTable = errors.New("invalid tax table")
+
+const (
+	// RoundPerLine rounds the VAT of every item to the cent, the VAT of a rate
+	// is the sum of the VAT of its items. It is the default.
+	RoundPerLine VATRounding = iota
+
+	// RoundPerRate rounds the VAT of each rate once, on the total of its items,
+	// and shares it out between the items so that they still add up to it.
+	RoundPerRate
+)
+
+type (
+	// TaxTable holds the percentage of each of the five VAT categories A to E. The
+	// rates A to D are configured by TRA for every device and returned in the
+	// TAXCODES of the registration response, E is always exempted at 0%.
+	//
+	// A nil *TaxTable is the default table, see DefaultTaxTable.
+	TaxTable struct {
+		// vats is indexed by the tax code minus one.
+		vats     [ExemptedVATCODE]ValueAddedTax
+		rounding VATRounding
+	}
+
+	// VATRounding is how the VAT of the items of a receipt is rounded to the
+	// cent. The rounding changes the amounts of the signed receipt, a device
+	// should keep the one it started with.
+	VATRounding int
+
+	// TaxSchedule is the history of the rates of a device: a table and the
+	// changes that replaced it, each effective from a point in time. Receipts
+	// are taxed at the rates in effect at their Date and Time in East Africa
+	// Time, so the receipts of the day before a change keep the old rates even
+	// when they are submitted after it.
+	//
+	// A nil *TaxSchedule is the DefaultTaxTable at all times.
+	TaxSchedule struct {
+		table   *TaxTable
+		changes []TaxChange
+	}
+
+	// TaxChange replaces the rates of a TaxSchedule from From on. A nil Table is
+	// the DefaultTaxTable.
+	TaxChange struct {
+		From  time.Time
+		Table *TaxTable
+	}
+)
+
+var (
+	builtinTaxTable = &TaxTable{vats: [ExemptedVATCODE]ValueAddedTax{
+		standardVAT, specialVAT, zeroVAT, specialReliefVAT, exemptedVAT,
+	}}
+
+	// defaultTaxTable holds the *TaxTable set with SetDefaultTaxTable.
+	defaultTaxTable atomic.Value
+)
+
+// DefaultTaxTable returns the table used by ParseTaxCode, ProcessItems,
+// ReceiptBytes, ReportBytes and the other functions that are not given one. It
+// is the table of the StandardVATRATE to ExemptedVATRATE constants unless
+// SetDefaultTaxTable replaced it.
+func DefaultTaxTable() *TaxTable {
+	if t, _ := defaultTaxTable.Load().(*TaxTable); t != nil {
+		return t
+	}
+	return builtinTaxTable
+}
+
+// SetDefaultTaxTable replaces the default table, nil restores the built in one.
+// Programs that serve a single device can set it once from the registration
+// response with TaxTableFromRegistration.
+func SetDefaultTaxTable(t *TaxTable) {
+	defaultTaxTable.Store(t)
+}
+
+// NewTaxTable returns a table with the percentages given by VAT ID, A to E.
+// Categories that are not given keep their default rate.
+func NewTaxTable(percentages map[string]float64) (*TaxTable, error) {
+	ids := make([]string, 0, len(percentages))
+	for id := range percentages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t := &TaxTable{vats: builtinTaxTable.vats}
+	for _, id := range ids {
+		percentage := percentages[id]
+		i := strings.Index("ABCDE", id)
+		if len(id) != 1 || i < 0 {
+			return nil, fmt.Errorf("%w: unknown VAT ID %q", ErrInvalidTaxTable, id)
+		}
+		if percentage < 0 || percentage >= 100 || math.IsNaN(percentage) {
+			return nil, fmt.Errorf("%w: rate %s must be at least 0 and less than 100, got %v",
+				ErrInvalidTaxTable, id, percentage)
+		}
+		t.vats[i].Percentage = percentage
+	}
+	return t, nil
+}
+
+// TaxTableFromRegistration returns the table of the TAXCODES of a registration
+// response. Codes are percentages such as "18" or "18.00", optionally preceded by
+// the VAT ID as in "A-18.00". Empty codes keep their default rate.
+func TaxTableFromRegistration(registration *RegistrationResponse) (*TaxTable, error) {
+	codes := registration.TAXCODES
+	percentages := make(map[string]float64)
+	for _, c := range []struct{ id, code string }{
+		{"A", codes.CODEA}, {"B", codes.CODEB}, {"C", codes.CODEC}, {"D", codes.CODED},
+	} {
+		id, code := c.id, c.code
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		code = strings.TrimPrefix(code, id+"-")
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(code, "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: CODE%s %q is not a percentage", ErrInvalidTaxTable, id, code)
+		}
+		percentages[id] = percentage
+	}
+	return NewTaxTable(percentages)
+}
+
+// registrationTaxTable returns the table of the TAXCODES of registration, or the
+// DefaultTaxTable when the registration has none.
+func registrationTaxTable(registration *RegistrationResponse) (*TaxTable, error) {
+	codes := registration.TAXCODES
+	if codes.CODEA == "" && codes.CODEB == "" && codes.CODEC == "" && codes.CODED == "" {
+		return DefaultTaxTable(), nil
+	}
+	return TaxTableFromRegistration(registration)
+}
+
+// NewTaxSchedule returns a schedule of the rates of table followed by changes,
+// given in any order. A nil table is the DefaultTaxTable. Every change must
+// have an effective time and no two changes may take effect at the same time.
+func NewTaxSchedule(table *TaxTable, changes ...TaxChange) (*TaxSchedule, error) {
+	s := &TaxSchedule{table: table, changes: append([]TaxChange(nil), changes...)}
+	sort.SliceStable(s.changes, func(i, j int) bool {
+		return s.changes[i].From.Before(s.changes[j].From)
+	})
+	for i, change := range s.changes {
+		if change.From.IsZero() {
+			return nil, fmt.Errorf("%w: tax change without an effective time", ErrInvalidTaxTable)
+		}
+		if i > 0 && change.From.Equal(s.changes[i-1].From) {
+			return nil, fmt.Errorf("%w: two tax changes effective from %s", ErrInvalidTaxTable, change.From)
+		}
+	}
+	return s, nil
+}
+
+// At returns the table in effect at t.
+func (s *TaxSchedule) At(t time.Time) *TaxTable {
+	if s == nil {
+		return DefaultTaxTable()
+	}
+	table := s.table
+	for _, change := range s.changes {
+		if change.From.After(t) {
+			break
+		}
+		table = change.Table
+	}
+	return table.table()
+}
+
+// ProcessItems is ProcessItems with the rates in effect at the Date and Time of
+// params. An error is returned when the rates changed and Date or Time can not
+// be parsed.
+func (s *TaxSchedule) ProcessItems(params ReceiptParams, items []Item, adjustments ...Adjustment,
+) (*ItemProcessResponse, error) {
+	table, err := s.tableAt(params.Date, params.Time)
+	if err != nil {
+		return nil, err
+	}
+	return table.ProcessItems(items, adjustments...), nil
+}
+
+// tableAt returns the table in effect at date and clock, formatted with
+// DateLayout and TimeLayout. They are only parsed when the rates changed.
+func (s *TaxSchedule) tableAt(date, clock string) (*TaxTable, error) {
+	if s == nil || len(s.changes) == 0 {
+		return s.At(time.Time{}), nil
+	}
+	t, err := receiptTime(date, clock)
+	if err != nil {
+		return nil, err
+	}
+	return s.At(t), nil
+}
+
+// before returns the table in effect just before t and the number of changes
+// that took effect before t.
+func (s *TaxSchedule) before(t time.Time) (*TaxTable, int) {
+	if s == nil {
+		return DefaultTaxTable(), 0
+	}
+	table, n := s.table, 0
+	for _, change := range s.changes {
+		if !change.From.Before(t) {
+			break
+		}
+		table = change.Table
+		n++
+	}
+	return table.table(), n
+}
+
+// receiptTime returns the time of a receipt or report from its date and time
+// in East Africa Time.
+func receiptTime(date, clock string) (time.Time, error) {
+	t, err := time.ParseInLocation(DateLayout+" "+TimeLayout, date+" "+clock, eastAfricaTime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("date %q and time %q must be formatted as YYYY-MM-DD and HH:MM:SS",
+			date, clock)
+	}
+	return t, nil
+}
+
+// WithRounding returns a copy of the table that rounds VAT with rounding.
+func (t *TaxTable) WithRounding(rounding VATRounding) *TaxTable {
+	c := *t.table()
+	c.rounding = rounding
+	return &c
+}
+
+// Rounding returns how the table rounds VAT.
+func (t *TaxTable) Rounding() VATRounding {
+	return t.table().rounding
+}
+
+// ParseTaxCode returns the ValueAddedTax of the tax code, 1 to 5. Unknown codes
+// are taxed at the standard rate.
+func (t *TaxTable) ParseTaxCode(code int64) ValueAddedTax {
+	t = t.table()
+	if code < StandardVATCODE || code > ExemptedVATCODE {
+		code = StandardVATCODE
+	}
+	return t.vats[code-1]
+}
+
+// ReportTaxRateID returns the VATRATE of the tax code in Z reports, "A-18.00"
+// for the standard rate of 18%.
+func (t *TaxTable) ReportTaxRateID(code int64) string {
+	return t.ParseTaxCode(code).reportRateID()
+}
+
+// VATs returns the five categories of the table, in the order A to E.
+func (t *TaxTable) VATs() []ValueAddedTax {
+	vats := t.table().vats
+	return vats[:]
+}
+
+// vat returns the ValueAddedTax identified by id, one of A, B, C, D or E.
+func (t *TaxTable) vat(id string) (ValueAddedTax, bool) {
+	for _, vat := range t.table().vats {
+		if vat.ID == id {
+			return vat, true
+		}
+	}
+	return ValueAddedTax{}, false
+}
+
+func (t *TaxTable) table() *TaxTable {
+	if t == nil {
+		return DefaultTaxTable()
+	}
+	return t
+}
+
+// reportRateID returns the VATRATE of v in Z reports.
+func (v ValueAddedTax) reportRateID() string {
+	return fmt.Sprintf("%s-%.2f", v.ID, v.Percentage)
+}
+
+// sortVATs sorts vats by ID and then by percentage.
+func sortVATs(vats []ValueAddedTax) {
+	sort.Slice(vats, func(i, j int) bool {
+		if vats[i].ID != vats[j].ID {
+			return vats[i].ID < vats[j].ID
+		}
+		return vats[i].Percentage < vats[j].Percentage
+	})
+}
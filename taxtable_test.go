@@ -0,0 +1,244 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+func testTaxTable(t *testing.T) *vfd.TaxTable {
+	t.Helper()
+	table, err := vfd.TaxTableFromRegistration(&vfd.RegistrationResponse{
+		TAXCODES: vfd.TAXCODES{CODEA: "16", CODEB: "B-10.00", CODEC: "0", CODED: "0%"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestTaxTableFromRegistration(t *testing.T) {
+	t.Parallel()
+	table := testTaxTable(t)
+
+	tests := []struct {
+		code int64
+		want string
+	}{
+		{vfd.StandardVATCODE, "A-16.00"},
+		{vfd.SpecialVATCODE, "B-10.00"},
+		{vfd.ZeroVATCODE, "C-0.00"},
+		{vfd.SpecialReliefVATCODE, "D-0.00"},
+		{vfd.ExemptedVATCODE, "E-0.00"},
+		{42, "A-16.00"},
+	}
+	for _, tt := range tests {
+		if got := table.ReportTaxRateID(tt.code); got != tt.want {
+			t.Errorf("ReportTaxRateID(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+
+	invalid := []vfd.TAXCODES{
+		{CODEA: "eighteen"},
+		{CODEB: "100"},
+		{CODEC: "-1"},
+	}
+	for _, codes := range invalid {
+		_, err := vfd.TaxTableFromRegistration(&vfd.RegistrationResponse{TAXCODES: codes})
+		if !errors.Is(err, vfd.ErrInvalidTaxTable) {
+			t.Errorf("TaxTableFromRegistration(%+v) error = %v, want %v", codes, err, vfd.ErrInvalidTaxTable)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		_, err := vfd.TaxTableFromRegistration(&vfd.RegistrationResponse{TAXCODES: vfd.TAXCODES{
+			CODEA: "eighteen", CODEB: "ten", CODEC: "zero", CODED: "none",
+		}})
+		if err == nil || !strings.Contains(err.Error(), "CODEA") {
+			t.Fatalf("TaxTableFromRegistration() with every code invalid error = %v, want CODEA first", err)
+		}
+	}
+	if _, err := vfd.NewTaxTable(map[string]float64{"F": 5}); !errors.Is(err, vfd.ErrInvalidTaxTable) {
+		t.Errorf("NewTaxTable(F) error = %v, want %v", err, vfd.ErrInvalidTaxTable)
+	}
+}
+
+func TestTaxTableProcessItems(t *testing.T) {
+	t.Parallel()
+	result := testTaxTable(t).ProcessItems([]vfd.Item{
+		{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1160},
+		{ID: "2", Description: "Maize", TaxCode: vfd.SpecialVATCODE, Quantity: 1, UnitPrice: 1100},
+	})
+
+	got := make(map[string][2]float64)
+	for _, v := range result.VATTOTALS {
+		got[v.VATRATE] = [2]float64{v.NETTAMOUNT.Float64(), v.TAXAMOUNT.Float64()}
+	}
+	want := map[string][2]float64{"A": {1000, 160}, "B": {1000, 100}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VATTOTALS = %v, want %v", got, want)
+	}
+}
+
+func TestZReportAggregatorTaxTable(t *testing.T) {
+	t.Parallel()
+	aggregator := vfd.NewZReportAggregator("20230101", 0, vfd.WithZReportTaxTable(testTaxTable(t)))
+	receipt := zReportReceipt(1,
+		[]vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1160}},
+		[]vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1160}},
+	)
+	if err := aggregator.Add(receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []vfd.VATTOTAL{{ID: "A", Rate: 16, NetAmount: 1000, TaxAmount: 160}}
+	if got := aggregator.VATTotals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("VATTotals() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetDefaultTaxTable(t *testing.T) {
+	vfd.SetDefaultTaxTable(testTaxTable(t))
+	defer vfd.SetDefaultTaxTable(nil)
+
+	if got := vfd.ReportTaxRateID(vfd.StandardVATCODE); got != "A-16.00" {
+		t.Errorf("ReportTaxRateID() = %q, want A-16.00", got)
+	}
+	if got := vfd.ParseTaxCode(vfd.StandardVATCODE).Percentage; got != 16 {
+		t.Errorf("ParseTaxCode().Percentage = %v, want 16", got)
+	}
+
+	vfd.SetDefaultTaxTable(nil)
+	if got := vfd.ReportTaxRateID(vfd.StandardVATCODE); got != "A-18.00" {
+		t.Errorf("ReportTaxRateID() after reset = %q, want A-18.00", got)
+	}
+}
+
+func TestTaxSchedule(t *testing.T) {
+	t.Parallel()
+	eat := time.FixedZone("EAT", 3*60*60)
+	midnight := time.Date(2024, 7, 1, 0, 0, 0, 0, eat)
+	schedule, err := vfd.NewTaxSchedule(nil, vfd.TaxChange{From: midnight, Table: testTaxTable(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := schedule.At(midnight.Add(-time.Second)).ReportTaxRateID(vfd.StandardVATCODE); got != "A-18.00" {
+		t.Errorf("At(before the change) = %q, want A-18.00", got)
+	}
+	if got := schedule.At(midnight).ReportTaxRateID(vfd.StandardVATCODE); got != "A-16.00" {
+		t.Errorf("At(the change) = %q, want A-16.00", got)
+	}
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1160}}
+	before, err := schedule.ProcessItems(vfd.ReceiptParams{Date: "2024-06-30", Time: "23:59:59"}, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := schedule.ProcessItems(vfd.ReceiptParams{Date: "2024-07-01", Time: "00:00:00"}, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := before.VATTOTALS[0].TAXAMOUNT.Float64(); got != 176.95 {
+		t.Errorf("ProcessItems() before the change tax = %v, want 176.95", got)
+	}
+	if got := after.VATTOTALS[0].TAXAMOUNT.Float64(); got != 160 {
+		t.Errorf("ProcessItems() after the change tax = %v, want 160", got)
+	}
+
+	if _, err := schedule.ProcessItems(vfd.ReceiptParams{Date: "2024-07-01", Time: "midnight"}, items); err == nil {
+		t.Error("ProcessItems() with an unparsable time succeeded")
+	}
+	aggregator := vfd.NewZReportAggregator("20240701", 0, vfd.WithZReportTaxSchedule(schedule))
+	if err := aggregator.Add(&vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{Date: "01/07/2024", Time: "00:00:00", ZNum: "20240701", GlobalCounter: 1},
+		Items:  items,
+	}); err == nil {
+		t.Error("Add() of a receipt with an unparsable date succeeded")
+	}
+
+	invalid := [][]vfd.TaxChange{
+		{{Table: testTaxTable(t)}},
+		{{From: midnight}, {From: midnight.UTC()}},
+	}
+	for _, changes := range invalid {
+		if _, err := vfd.NewTaxSchedule(nil, changes...); !errors.Is(err, vfd.ErrInvalidTaxTable) {
+			t.Errorf("NewTaxSchedule(%v) error = %v, want %v", changes, err, vfd.ErrInvalidTaxTable)
+		}
+	}
+}
+
+func TestDeviceTaxChangeAtMidnight(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := vfdtest.NewServer()
+	defer server.Close()
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{
+		TIN: "123456789", CertKey: "10TZ101234", CertSerial: "4bd3a9c1", Certificate: cert,
+	})
+
+	eat := time.FixedZone("EAT", 3*60*60)
+	midnight := time.Date(2024, 7, 1, 0, 0, 0, 0, eat)
+	schedule, err := vfd.NewTaxSchedule(nil, vfd.TaxChange{From: midnight, Table: testTaxTable(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := midnight.Add(-30 * time.Minute)
+	device := vfd.NewDevice(key, cert, env.PROD, &reg,
+		vfd.WithDeviceCertSerial("4bd3a9c1"),
+		vfd.WithDeviceRequestURL(server.RequestURL),
+		vfd.WithDeviceClientOptions(vfd.WithHttpClient(server.Client())),
+		vfd.WithDeviceClock(func() time.Time { return now }),
+		vfd.WithDeviceTaxSchedule(schedule),
+	)
+
+	items := []vfd.Item{{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1160}}
+	cash := []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1160}}
+	for _, at := range []time.Time{midnight.Add(-30 * time.Minute), midnight.Add(30 * time.Minute)} {
+		now = at
+		if _, err := device.Issue(ctx, vfd.Customer{Type: vfd.NonCustomerID}, items, cash); err != nil {
+			t.Fatalf("Issue() at %s error = %v", at, err)
+		}
+	}
+
+	// Both days are closed after the change, the first one is still reported
+	// at the old rate.
+	now = midnight.Add(time.Hour)
+	if _, err := device.CloseDay(ctx); err != nil {
+		t.Fatalf("CloseDay() error = %v", err)
+	}
+
+	reports := server.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("server received %d reports, want 2", len(reports))
+	}
+	want := []struct {
+		zNumber, changes, vat string
+	}{
+		{"20240630", "<VATCHANGENUM>0</VATCHANGENUM>", "<VATRATE>A-18.00</VATRATE><NETTAMOUNT>983.05</NETTAMOUNT><TAXAMOUNT>176.95</TAXAMOUNT>"},
+		{"20240701", "<VATCHANGENUM>1</VATCHANGENUM>", "<VATRATE>A-16.00</VATRATE><NETTAMOUNT>1000.00</NETTAMOUNT><TAXAMOUNT>160.00</TAXAMOUNT>"},
+	}
+	for i, w := range want {
+		r := reports[i]
+		if r.ZNumber != w.zNumber {
+			t.Errorf("report %d ZNUMBER = %s, want %s", i, r.ZNumber, w.zNumber)
+		}
+		for _, s := range []string{w.changes, w.vat} {
+			if !strings.Contains(string(r.Envelope), s) {
+				t.Errorf("report %s does not contain %s:\n%s", r.ZNumber, s, r.Envelope)
+			}
+		}
+	}
+}
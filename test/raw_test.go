@@ -2,7 +2,7 @@ package test
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -85,7 +85,7 @@ func NewTestServer(t *testing.T, envX env.Env, action vfd.Action) (*TestServer,
 	return s, nil
 }
 
-func (t *TestServer) Register(ctx context.Context, url string, privateKey *rsa.PrivateKey, request *vfd.RegistrationRequest) (*vfd.RegistrationResponse, error) {
+func (t *TestServer) Register(ctx context.Context, url string, signer crypto.Signer, request *vfd.RegistrationRequest) (*vfd.RegistrationResponse, error) {
 	// TODO implement me
 	panic("implement me")
 }
@@ -95,14 +95,14 @@ func (t *TestServer) FetchToken(ctx context.Context, url string, request *vfd.To
 	panic("implement me")
 }
 
-func (t *TestServer) SubmitReceipt(ctx context.Context, url string, headers *vfd.RequestHeaders, privateKey *rsa.PrivateKey, receipt *vfd.ReceiptRequest) (*vfd.Response, error) {
+func (t *TestServer) SubmitReceipt(ctx context.Context, url string, headers *vfd.RequestHeaders, signer crypto.Signer, receipt *vfd.ReceiptRequest) (*vfd.Response, error) {
 	// TODO implement me
 	panic("implement me")
 }
 
 func (t *TestServer) SubmitReport(
 	ctx context.Context, url string, headers *vfd.RequestHeaders,
-	privateKey *rsa.PrivateKey, report *vfd.ReportRequest,
+	signer crypto.Signer, report *vfd.ReportRequest,
 ) (*vfd.Response, error) {
 	// TODO implement me
 	panic("implement me")
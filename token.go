@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	xhttp "github.com/vfdcloud/vfd/internal/http"
@@ -76,8 +77,8 @@ func FetchTokenWithMw(ctx context.Context, url string, request *TokenRequest, ca
 	return response, nil
 }
 
-// FetchToken retrieves a token from the VFD server. If the status code is not 200, an error is
-// returned. Error Message will contain TokenResponse.Code and TokenResponse.Message
+// FetchToken retrieves a token from the VFD server. If the status code is not 200, an *AckError
+// carrying TokenResponse.Code and TokenResponse.Message is returned.
 // FetchToken wraps internally a *http.Client responsible for making http calls. It has a timeout
 // of 70 seconds. It is advised to call this only when the previous token has expired. It will still
 // work if called before the token expires.
@@ -121,22 +122,45 @@ func fetchToken(ctx2 context.Context, client *http.Client, path string, request
 	}
 
 	response := new(TokenResponse)
-
-	if err := json.NewDecoder(bytes.NewBuffer(out)).Decode(response); err != nil {
-		return nil, fmt.Errorf("response decode error: %w", err)
-	}
+	decodeErr := json.NewDecoder(bytes.NewBuffer(out)).Decode(response)
 
 	response.Code = resp.Header.Get("ACKCODE")
 	response.Message = resp.Header.Get("ACKMSG")
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: error code=[%s],message=[%s], error=[%s]",
-			ErrFetchToken, response.Code, response.Message, response.Error)
+		return nil, tokenAckError(resp.StatusCode, response, out)
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("response decode error: %w", decodeErr)
 	}
 
 	return response, nil
 }
 
+// tokenAckError builds the *AckError of a failed token request. The ACKCODE and
+// ACKMSG come from the response headers, the error field of the body is used as
+// the message when ACKMSG is missing.
+func tokenAckError(statusCode int, response *TokenResponse, body []byte) *AckError {
+	code, err := strconv.ParseInt(response.Code, 10, 64)
+	if err != nil {
+		code = UnknownAckCode
+	}
+
+	message := response.Message
+	if message == "" {
+		message = response.Error
+	}
+
+	return &AckError{
+		Action:     FetchTokenAction,
+		Code:       code,
+		Message:    message,
+		StatusCode: statusCode,
+		Body:       body,
+	}
+}
+
 func (tr *TokenResponse) String() string {
 	return fmt.Sprintf(
 		"FetchToken Response: [Code=%s,Message=%s,AccessToken=%s,TokenType=%s,ExpiresIn=%d seconds,Error=%s]",
@@ -0,0 +1,180 @@
+package vfd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultTokenRefreshWindow is how long before expiry a cached token is
+// considered stale and a new one is fetched.
+const DefaultTokenRefreshWindow = 5 * time.Minute
+
+// ErrEmptyToken is returned when the VFD server answers a token request
+// without an access token.
+var ErrEmptyToken = fmt.Errorf("%w: empty access token", ErrFetchToken)
+
+type (
+	// TokenSource caches the access token issued by the VFD server and refreshes it
+	// ahead of expiry. Concurrent callers that find the token stale share a single
+	// call to the token endpoint. A TokenSource is safe for concurrent use.
+	TokenSource struct {
+		fetch         FetchTokenFunc
+		url           string
+		request       *TokenRequest
+		refreshWindow time.Duration
+		now           func() time.Time
+
+		mu        sync.Mutex
+		token     *TokenResponse
+		refreshAt time.Time
+		inflight  *tokenCall
+	}
+
+	// TokenSourceOption configures a TokenSource.
+	TokenSourceOption func(*TokenSource)
+
+	tokenCall struct {
+		done  chan struct{}
+		token *TokenResponse
+		err   error
+	}
+)
+
+// WithTokenRefreshWindow sets how long before expiry the token is refreshed.
+// The default is DefaultTokenRefreshWindow.
+func WithTokenRefreshWindow(window time.Duration) TokenSourceOption {
+	return func(ts *TokenSource) {
+		if window >= 0 {
+			ts.refreshWindow = window
+		}
+	}
+}
+
+// WithTokenClock replaces time.Now, mostly useful in tests.
+func WithTokenClock(now func() time.Time) TokenSourceOption {
+	return func(ts *TokenSource) {
+		if now != nil {
+			ts.now = now
+		}
+	}
+}
+
+// NewTokenSource creates a TokenSource that uses fetch to obtain tokens from url
+// with the credentials in request.
+func NewTokenSource(fetch FetchTokenFunc, url string, request *TokenRequest, options ...TokenSourceOption) *TokenSource {
+	ts := &TokenSource{
+		fetch:         fetch,
+		url:           url,
+		request:       request,
+		refreshWindow: DefaultTokenRefreshWindow,
+		now:           time.Now,
+	}
+	for _, option := range options {
+		option(ts)
+	}
+	return ts
+}
+
+// Token returns a valid access token, fetching a new one if the cached token
+// is missing or about to expire.
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	response, err := ts.TokenResponse(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return response.AccessToken, nil
+}
+
+// TokenResponse is like Token but returns the whole TokenResponse.
+func (ts *TokenSource) TokenResponse(ctx context.Context) (*TokenResponse, error) {
+	ts.mu.Lock()
+	if ts.token != nil && ts.now().Before(ts.refreshAt) {
+		token := ts.token
+		ts.mu.Unlock()
+		return token, nil
+	}
+
+	call := ts.inflight
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		ts.inflight = call
+		go ts.refresh(ctx, call)
+	}
+	ts.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Invalidate drops the cached token so that the next call to Token fetches a
+// new one. It is used when the VFD server rejects a token before its expiry.
+func (ts *TokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = nil
+	ts.refreshAt = time.Time{}
+}
+
+// invalidate drops the cached token only if it is still token. Concurrent
+// submissions rejected with the same token therefore trigger a single refresh.
+func (ts *TokenSource) invalidate(token string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != nil && ts.token.AccessToken == token {
+		ts.token = nil
+		ts.refreshAt = time.Time{}
+	}
+}
+
+// refresh fetches a new token and publishes the result to everyone waiting on call.
+// The fetch is detached from the cancellation of the caller that triggered it so
+// that other waiters are not failed because the first caller gave up.
+func (ts *TokenSource) refresh(ctx context.Context, call *tokenCall) {
+	requested := ts.now()
+	token, err := ts.fetch(detachedContext{ctx}, ts.url, ts.request)
+	if err == nil && (token == nil || token.AccessToken == "") {
+		err = ErrEmptyToken
+	}
+
+	ts.mu.Lock()
+	if err == nil {
+		ts.token = token
+		ts.refreshAt = refreshTime(requested, time.Duration(token.ExpiresIn)*time.Second, ts.refreshWindow)
+	}
+	ts.inflight = nil
+	ts.mu.Unlock()
+
+	call.token, call.err = token, err
+	if err != nil {
+		call.token = nil
+	}
+	close(call.done)
+}
+
+// refreshTime returns when a token issued at issued and valid for lifetime should be
+// refreshed. Tokens that live shorter than the refresh window are refreshed halfway
+// through their lifetime instead of on every call.
+func refreshTime(issued time.Time, lifetime, window time.Duration) time.Time {
+	if window >= lifetime {
+		return issued.Add(lifetime / 2)
+	}
+	return issued.Add(lifetime - window)
+}
+
+// detachedContext keeps the values of the parent context but is never canceled.
+type detachedContext struct {
+	context.Context //nolint:containedctx
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
@@ -0,0 +1,164 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestTokenSourceCollapsesConcurrentRefreshes(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context, url string, request *vfd.TokenRequest) (*vfd.TokenResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &vfd.TokenResponse{AccessToken: "token-1", ExpiresIn: 3600}, nil
+	}
+
+	ts := vfd.NewTokenSource(fetch, "http://localhost/vfdtoken", &vfd.TokenRequest{})
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := ts.Token(context.Background())
+			if err != nil {
+				t.Errorf("Token() error = %v", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fetch called %d times, want 1", got)
+	}
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("tokens[%d] = %q, want %q", i, token, "token-1")
+		}
+	}
+}
+
+func TestTokenSourceRefreshesAheadOfExpiry(t *testing.T) {
+	t.Parallel()
+	var (
+		calls int32
+		now   = time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+		mu    sync.Mutex
+	)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	fetch := func(ctx context.Context, url string, request *vfd.TokenRequest) (*vfd.TokenResponse, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return &vfd.TokenResponse{AccessToken: fmt.Sprintf("token-%d", n), ExpiresIn: 3600}, nil
+	}
+
+	ts := vfd.NewTokenSource(fetch, "", &vfd.TokenRequest{},
+		vfd.WithTokenClock(clock), vfd.WithTokenRefreshWindow(10*time.Minute))
+
+	steps := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{0, "token-1"},
+		{40 * time.Minute, "token-1"},
+		{9 * time.Minute, "token-1"},
+		{2 * time.Minute, "token-2"},
+		{10 * time.Minute, "token-2"},
+	}
+	for _, step := range steps {
+		advance(step.advance)
+		got, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token() error = %v", err)
+		}
+		if got != step.want {
+			t.Errorf("after %v: Token() = %q, want %q", step.advance, got, step.want)
+		}
+	}
+
+	ts.Invalidate()
+	if got, _ := ts.Token(context.Background()); got != "token-3" {
+		t.Errorf("after Invalidate: Token() = %q, want %q", got, "token-3")
+	}
+}
+
+func TestTokenSourceError(t *testing.T) {
+	t.Parallel()
+	for _, response := range []*vfd.TokenResponse{{}, nil} {
+		response := response
+		fetch := func(ctx context.Context, url string, request *vfd.TokenRequest) (*vfd.TokenResponse, error) {
+			return response, nil
+		}
+		ts := vfd.NewTokenSource(fetch, "", &vfd.TokenRequest{})
+		if _, err := ts.Token(context.Background()); !errors.Is(err, vfd.ErrEmptyToken) {
+			t.Errorf("Token() with %v error = %v, want %v", response, err, vfd.ErrEmptyToken)
+		}
+	}
+}
+
+func TestClientUsesTokenSource(t *testing.T) {
+	t.Parallel()
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vfdtoken":
+			atomic.AddInt32(&tokenCalls, 1)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `{"access_token":"secret","token_type":"bearer","expires_in":3600}`)
+		case "/api/efdmsRctInfo":
+			if got := r.Header.Get("Authorization"); got != "bearer secret" {
+				t.Errorf("Authorization = %q, want %q", got, "bearer secret")
+			}
+			_, _ = fmt.Fprint(w, receiptAckBody)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := vfd.NewClient(
+		vfd.WithHttpClient(server.Client()),
+		vfd.WithTokenRequest(server.URL+"/vfdtoken", &vfd.TokenRequest{Username: "user", Password: "pass"}),
+	)
+
+	privateKey := testPrivateKey(t)
+	receipt := testReceipt()
+	for i := 0; i < 3; i++ {
+		resp, err := client.SubmitReceipt(context.Background(), server.URL+"/api/efdmsRctInfo",
+			&vfd.RequestHeaders{CertSerial: "serial"}, privateKey, receipt)
+		if err != nil {
+			t.Fatalf("SubmitReceipt() error = %v", err)
+		}
+		if !vfd.IsSuccess(resp.Code) {
+			t.Errorf("SubmitReceipt() code = %d", resp.Code)
+		}
+	}
+
+	if got := atomic.LoadInt32(&tokenCalls); got != 1 {
+		t.Errorf("token endpoint called %d times, want 1", got)
+	}
+}
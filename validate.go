@@ -0,0 +1,250 @@
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+const (
+	// DateLayout is the layout of ReceiptParams.Date and ReportParams.Date.
+	DateLayout = "2006-01-02"
+
+	// TimeLayout is the layout of ReceiptParams.Time and ReportParams.Time.
+	TimeLayout = "15:04:05"
+)
+
+// ErrInvalidReceipt is matched by errors.Is for every *ValidationError.
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+var tinPattern = regexp.MustCompile(`^[0-9]{9}$`)
+
+type (
+	// FieldError is a single problem found by Validate. Field is the path of the
+	// offending field, such as "Params.TIN" or "Items[2].Discount".
+	FieldError struct {
+		Field   string
+		Message string
+	}
+
+	// ValidationError lists every problem found in a ReceiptRequest.
+	ValidationError struct {
+		Problems []FieldError
+	}
+)
+
+func (e FieldError) String() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidReceipt, strings.Join(problems, "; "))
+}
+
+// Is reports whether target is ErrInvalidReceipt.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidReceipt
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Problems = append(e.Problems, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the receipt for the mistakes the VFD server would otherwise
+// reject with an ACKCODE, and returns a *ValidationError listing all of them, or
+// nil when there are none. It checks:
+//   - the TIN is 9 digits without dashes
+//   - Date and Time follow DateLayout and TimeLayout
+//   - the counters are positive, DC does not exceed GC, and ZNUM, RCTNUM and
+//     RCTVNUM, when set, agree with Date and GC
+//   - the customer ID type is between 1 and 7 and an ID is given unless the type
+//     is NonCustomerID, a TIN being 9 digits
+//   - there is at least one item, quantities and prices are not negative, the
+//     discount does not exceed the line amount and the tax code is known
+//   - adjustment types are known, amounts and percentages are not negative, a
+//     percentage is below 100 and discounts do not exceed the items total
+//   - payment types are known, amounts are not negative and they add up to the
+//     tax inclusive total of the items, at the rates of the DefaultTaxTable
+func (r *ReceiptRequest) Validate() error {
+	return r.validate(nil)
+}
+
+// validate is Validate with the rates of taxes in effect at the receipt time.
+func (r *ReceiptRequest) validate(taxes *TaxSchedule) error {
+	v := &ValidationError{}
+	r.validateParams(v)
+	r.validateCustomer(v)
+	r.validateItems(v)
+	// The rates are unknown when Date or Time, reported by validateParams, can
+	// not be parsed.
+	if table, err := taxes.tableAt(r.Params.Date, r.Params.Time); err == nil {
+		r.validateAdjustments(v, table)
+		r.validatePayments(v, table)
+	}
+
+	if len(v.Problems) == 0 {
+		return nil
+	}
+	return v
+}
+
+func (r *ReceiptRequest) validateParams(v *ValidationError) {
+	p := r.Params
+	if !tinPattern.MatchString(p.TIN) {
+		v.add("Params.TIN", "must be 9 digits without dashes, got %q", p.TIN)
+	}
+
+	date, dateErr := time.Parse(DateLayout, p.Date)
+	if dateErr != nil {
+		v.add("Params.Date", "must be formatted as YYYY-MM-DD, got %q", p.Date)
+	}
+	if _, err := time.Parse(TimeLayout, p.Time); err != nil {
+		v.add("Params.Time", "must be formatted as HH:MM:SS, got %q", p.Time)
+	}
+
+	if p.GlobalCounter < 1 {
+		v.add("Params.GlobalCounter", "must be at least 1, got %d", p.GlobalCounter)
+	}
+	if p.DailyCounter < 1 {
+		v.add("Params.DailyCounter", "must be at least 1, got %d", p.DailyCounter)
+	} else if p.DailyCounter > p.GlobalCounter {
+		v.add("Params.DailyCounter", "%d exceeds the global counter %d", p.DailyCounter, p.GlobalCounter)
+	}
+
+	if p.ZNum != "" && dateErr == nil && p.ZNum != date.Format(ZNumLayout) {
+		v.add("Params.ZNum", "must be the receipt date %s, got %q", date.Format(ZNumLayout), p.ZNum)
+	}
+
+	gc := strconv.FormatInt(p.GlobalCounter, 10)
+	if p.ReceiptNum != "" && p.ReceiptNum != gc {
+		v.add("Params.ReceiptNum", "must be the global counter %s, got %q", gc, p.ReceiptNum)
+	}
+	if p.ReceiptVNum != "" && !strings.HasSuffix(p.ReceiptVNum, gc) {
+		v.add("Params.ReceiptVNum", "must be the receipt code followed by the global counter %s, got %q",
+			gc, p.ReceiptVNum)
+	}
+}
+
+func (r *ReceiptRequest) validateCustomer(v *ValidationError) {
+	c := r.Customer
+	switch {
+	case c.Type < TINCustomerID || c.Type > MeterNumberCustomerID:
+		v.add("Customer.Type", "must be between %d and %d, got %d", TINCustomerID, MeterNumberCustomerID, c.Type)
+	case c.Type == NonCustomerID:
+	case strings.TrimSpace(c.ID) == "":
+		v.add("Customer.ID", "is required for customer ID type %d", c.Type)
+	case c.Type == TINCustomerID && !tinPattern.MatchString(c.ID):
+		v.add("Customer.ID", "must be a TIN of 9 digits without dashes, got %q", c.ID)
+	}
+}
+
+func (r *ReceiptRequest) validateItems(v *ValidationError) {
+	if len(r.Items) == 0 {
+		v.add("Items", "at least one item is required")
+	}
+
+	for i, item := range r.Items {
+		field := fmt.Sprintf("Items[%d]", i)
+		if item.Quantity < 0 {
+			v.add(field+".Quantity", "must not be negative, got %v", item.Quantity)
+		}
+		if item.UnitPrice < 0 {
+			v.add(field+".UnitPrice", "must not be negative, got %v", item.UnitPrice)
+		}
+
+		amount := money.FromFloat(item.UnitPrice).Mul(item.Quantity)
+		discount := money.FromFloat(item.Discount)
+		if discount < 0 {
+			v.add(field+".Discount", "must not be negative, got %s", discount)
+		} else if amount >= 0 && discount > amount {
+			v.add(field+".Discount", "%s exceeds the line amount %s", discount, amount)
+		}
+
+		if item.TaxCode < StandardVATCODE || item.TaxCode > ExemptedVATCODE {
+			v.add(field+".TaxCode", "must be between %d and %d, got %d", StandardVATCODE, ExemptedVATCODE, item.TaxCode)
+		}
+
+		switch item.Pricing {
+		case "", TaxInclusivePricing, TaxExclusivePricing:
+		default:
+			v.add(field+".Pricing", "unknown pricing %q", item.Pricing)
+		}
+	}
+}
+
+// validateAdjustments checks the adjustments against the total of the items at
+// the rates of table.
+func (r *ReceiptRequest) validateAdjustments(v *ValidationError, table *TaxTable) {
+	if len(r.Adjustments) == 0 {
+		return
+	}
+
+	var base money.Money
+	for _, line := range table.ProcessItems(r.Items).Lines {
+		base += line.Amount - line.Discount
+	}
+
+	var discounts money.Money
+	for i, adjustment := range r.Adjustments {
+		field := fmt.Sprintf("Adjustments[%d]", i)
+		switch adjustment.Type {
+		case DiscountAdjustment, SurchargeAdjustment:
+		default:
+			v.add(field+".Type", "unknown adjustment type %q", adjustment.Type)
+		}
+
+		switch {
+		case adjustment.Amount != 0 && adjustment.Percentage != 0:
+			v.add(field, "has both an amount and a percentage")
+		case adjustment.Amount < 0:
+			v.add(field+".Amount", "must not be negative, got %v", adjustment.Amount)
+		case adjustment.Percentage < 0 || adjustment.Percentage >= 100:
+			v.add(field+".Percentage", "must be at least 0 and less than 100, got %v", adjustment.Percentage)
+		}
+
+		if adjustment.Type == DiscountAdjustment {
+			discounts += adjustment.amount(base)
+		}
+	}
+
+	if discounts > base {
+		v.add("Adjustments", "discounts of %s exceed the items total %s", discounts, base)
+	}
+}
+
+// validatePayments checks the payments against the total of the items at the
+// rates of table.
+func (r *ReceiptRequest) validatePayments(v *ValidationError, table *TaxTable) {
+	if len(r.Payments) == 0 {
+		v.add("Payments", "at least one payment is required")
+	}
+
+	var paid money.Money
+	for i, payment := range r.Payments {
+		field := fmt.Sprintf("Payments[%d]", i)
+		switch payment.Type {
+		case CashPaymentType, ChequePaymentType, CreditCardPaymentType, ElectronicPaymentType, InvoicePaymentType:
+		default:
+			v.add(field+".Type", "unknown payment type %q", payment.Type)
+		}
+
+		amount := money.FromFloat(payment.Amount)
+		if amount < 0 {
+			v.add(field+".Amount", "must not be negative, got %s", amount)
+		}
+		paid += amount
+	}
+
+	if total := table.ProcessItems(r.Items, r.Adjustments...).TOTALS.TOTALTAXINCL; len(r.Payments) > 0 && paid != total {
+		v.add("Payments", "add up to %s but the receipt total is %s", paid, total)
+	}
+}
@@ -0,0 +1,132 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func TestReceiptRequestValidate(t *testing.T) {
+	if err := testReceipt().Validate(); err != nil {
+		t.Fatalf("Validate() of a valid receipt = %v", err)
+	}
+
+	receipt := &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date:          "01/01/2023",
+			Time:          "10:00",
+			TIN:           "123-456-789",
+			GlobalCounter: 5,
+			DailyCounter:  6,
+			ZNum:          "20230101",
+			ReceiptNum:    "4",
+			ReceiptVNum:   "ABC4",
+		},
+		Customer: vfd.Customer{Type: vfd.TINCustomerID, ID: "12345"},
+		Items: []vfd.Item{
+			{ID: "1", TaxCode: 9, Quantity: -1, UnitPrice: 100},
+			{ID: "2", TaxCode: vfd.TaxableItemCode, Quantity: 2, UnitPrice: 100, Discount: 250},
+			{ID: "3", TaxCode: vfd.TaxableItemCode, Quantity: 1, UnitPrice: -5, Discount: -1, Pricing: "GROSS"},
+		},
+		Payments: []vfd.Payment{{Type: "BITCOIN", Amount: -10}},
+	}
+
+	err := receipt.Validate()
+	if !errors.Is(err, vfd.ErrInvalidReceipt) {
+		t.Fatalf("Validate() error = %v, want %v", err, vfd.ErrInvalidReceipt)
+	}
+	validationErr := &vfd.ValidationError{}
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Validate() error = %T, want *ValidationError", err)
+	}
+
+	var fields []string
+	for _, p := range validationErr.Problems {
+		fields = append(fields, p.Field)
+	}
+	want := []string{
+		"Params.TIN", "Params.Date", "Params.Time", "Params.DailyCounter",
+		"Params.ReceiptNum", "Params.ReceiptVNum", "Customer.ID",
+		"Items[0].Quantity", "Items[0].TaxCode", "Items[1].Discount",
+		"Items[2].UnitPrice", "Items[2].Discount", "Items[2].Pricing",
+		"Payments[0].Type", "Payments[0].Amount", "Payments",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Validate() problems = %v\nwant %v", fields, want)
+	}
+}
+
+func TestReceiptRequestValidateAdjustments(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Adjustments = []vfd.Adjustment{
+		{Type: "COUPON", Amount: 1},
+		{Type: vfd.DiscountAdjustment, Amount: -1},
+		{Type: vfd.SurchargeAdjustment, Percentage: 100},
+		{Type: vfd.DiscountAdjustment, Amount: 1, Percentage: 1},
+		{Type: vfd.DiscountAdjustment, Amount: 1e6},
+	}
+
+	validationErr := &vfd.ValidationError{}
+	if err := receipt.Validate(); !errors.As(err, &validationErr) {
+		t.Fatalf("Validate() error = %v, want *ValidationError", err)
+	}
+	var fields []string
+	for _, p := range validationErr.Problems {
+		fields = append(fields, p.Field)
+	}
+	want := []string{
+		"Adjustments[0].Type", "Adjustments[1].Amount", "Adjustments[2].Percentage",
+		"Adjustments[3]", "Adjustments", "Payments",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Validate() problems = %v\nwant %v", fields, want)
+	}
+}
+
+func TestReceiptRequestValidateCounters(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Params.ZNum = "20230102"
+	receipt.Customer = vfd.Customer{Type: vfd.PassportCustomerID}
+	receipt.Payments[0].Amount = 999.99
+
+	err := receipt.Validate()
+	validationErr := &vfd.ValidationError{}
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("Validate() = %v, want 3 problems", err)
+	}
+}
+
+func TestSubmitReceiptValidates(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(receiptAckBody))
+	}))
+	defer server.Close()
+
+	receipt := testReceipt()
+	receipt.Params.TIN = "123-456-789"
+	headers := &vfd.RequestHeaders{CertSerial: "serial", BearerToken: "token"}
+	privateKey := testPrivateKey(t)
+
+	client := vfd.NewClient(vfd.WithHttpClient(server.Client()))
+	if _, err := client.SubmitReceipt(context.Background(), server.URL, headers, privateKey, receipt); !errors.Is(err, vfd.ErrInvalidReceipt) {
+		t.Errorf("SubmitReceipt() error = %v, want %v", err, vfd.ErrInvalidReceipt)
+	}
+	if requests != 0 {
+		t.Errorf("an invalid receipt was sent to the server")
+	}
+
+	client = vfd.NewClient(vfd.WithHttpClient(server.Client()), vfd.WithoutReceiptValidation())
+	if _, err := client.SubmitReceipt(context.Background(), server.URL, headers, privateKey, receipt); err != nil {
+		t.Errorf("SubmitReceipt() without validation error = %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("server received %d requests, want 1", requests)
+	}
+}
@@ -1,10 +1,14 @@
 package vfd
 
 import (
-	"fmt"
 	"math"
+
+	"github.com/vfdcloud/vfd/pkg/money"
 )
 
+// basisPointsBase is 100% in basis points.
+const basisPointsBase = 10000
+
 const (
 	StandardVATID        = "A"
 	StandardVATRATE      = 18.00
@@ -70,34 +74,42 @@ var (
 )
 
 func (v *ValueAddedTax) NetAmount(totalAmount float64) float64 {
-	rate := 1.00 + (v.Percentage / 100)
-	netAmount := totalAmount / rate
-	return math.Round(netAmount*100) / 100
+	return v.Net(money.FromFloat(totalAmount)).Float64()
 }
 
 // Amount calculates the amount of ValueAddedTax that is charged to the buyer.
 // The answer is rounded to 2 decimal places.
 func (v *ValueAddedTax) Amount(totalAmount float64) float64 {
-	netAmount := v.NetAmount(totalAmount)
-	amount := totalAmount - netAmount
-	return math.Round(amount*100) / 100
+	return v.Tax(money.FromFloat(totalAmount)).Float64()
+}
+
+// Net returns the part of the tax inclusive amount total that is not tax,
+// rounded to the nearest cent.
+func (v *ValueAddedTax) Net(total money.Money) money.Money {
+	rate := v.basisPoints()
+	return total.MulDiv(basisPointsBase, basisPointsBase+rate)
+}
+
+// Tax returns the tax included in the tax inclusive amount total. Net and Tax
+// always add up to total.
+func (v *ValueAddedTax) Tax(total money.Money) money.Money {
+	return total - v.Net(total)
 }
 
+// TaxOn returns the tax charged on top of the tax exclusive amount net, rounded
+// to the nearest cent.
+func (v *ValueAddedTax) TaxOn(net money.Money) money.Money {
+	return net.MulDiv(v.basisPoints(), basisPointsBase)
+}
+
+// basisPoints returns the percentage in hundredths of a percent, 18.00% is 1800.
+func (v *ValueAddedTax) basisPoints() int64 {
+	return int64(math.Round(v.Percentage * 100))
+}
+
+// ParseTaxCode returns the ValueAddedTax of the tax code in the DefaultTaxTable.
 func ParseTaxCode(code int64) ValueAddedTax {
-	switch code {
-	case 1:
-		return standardVAT
-	case 2:
-		return specialVAT
-	case 3:
-		return zeroVAT
-	case 4:
-		return specialReliefVAT
-	case 5:
-		return exemptedVAT
-	default:
-		return standardVAT
-	}
+	return DefaultTaxTable().ParseTaxCode(code)
 }
 
 // ValueAddedTaxRate returns the ValueAddedTax rate of a certain ValueAddedTax category
@@ -129,16 +141,14 @@ func NetAmount(taxCode int64, price float64) float64 {
 // The answer is rounded to 2 decimal places.
 func ValueAddedTaxAmount(taxCode int64, price float64) float64 {
 	vat := ParseTaxCode(taxCode)
-	netAmount := vat.NetAmount(price)
-	amount := price - netAmount
-	return math.Round(amount*100) / 100
+	return vat.Amount(price)
 }
 
 // ReportTaxRateID creates a string that contains the ValueAddedTax rate and the ValueAddedTax id
 // of a certain ValueAddedTax category. It returns "A-18.00" for standard ValueAddedTax,
 // "B-10.00" for special ValueAddedTax, "C-0.00" for zero ValueAddedTax and so on. The ID is then
 // used in Z Report to indicate the ValueAddedTax rate and the ValueAddedTax id.
+// The rates are those of the DefaultTaxTable.
 func ReportTaxRateID(taxCode int64) string {
-	vat := ParseTaxCode(taxCode)
-	return fmt.Sprintf("%s-%.2f", vat.ID, vat.Percentage)
+	return DefaultTaxTable().ReportTaxRateID(taxCode)
 }
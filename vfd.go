@@ -2,7 +2,8 @@ package vfd
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
+	"fmt"
 	"strings"
 
 	"github.com/vfdcloud/vfd/pkg/env"
@@ -111,7 +112,7 @@ type (
 		// Registering a VFD is a one-time operation. The subsequent calls to Register will
 		// yield the same response.VFD should store the registration response to
 		// avoid calling Register again.
-		Register(ctx context.Context, url string, privateKey *rsa.PrivateKey, request *RegistrationRequest,
+		Register(ctx context.Context, url string, signer crypto.Signer, request *RegistrationRequest,
 		) (*RegistrationResponse, error)
 
 		// FetchToken is used to fetch a token from the VFD Service. The token is used
@@ -124,17 +125,39 @@ type (
 		// issued by the Revenue Authority during integration.
 		SubmitReceipt(
 			ctx context.Context, url string, headers *RequestHeaders,
-			privateKey *rsa.PrivateKey, receipt *ReceiptRequest) (*Response, error)
+			signer crypto.Signer, receipt *ReceiptRequest) (*Response, error)
 
 		// SubmitReport is used to submit a Z report to the VFD Service. The Z report
 		// is signed using the private key. The private key is obtained from the certificate
 		// issued by the Revenue Authority during integration.
 		SubmitReport(
 			ctx context.Context, url string, headers *RequestHeaders,
-			privateKey *rsa.PrivateKey, report *ReportRequest) (*Response, error)
+			signer crypto.Signer, report *ReportRequest) (*Response, error)
 	}
 )
 
+// String returns the name of the ID type as printed on receipts.
+func (c CustomerID) String() string {
+	switch c {
+	case TINCustomerID:
+		return "TIN"
+	case LicenceCustomerID:
+		return "DRIVING LICENCE"
+	case VoterIDCustomerID:
+		return "VOTERS NUMBER"
+	case PassportCustomerID:
+		return "PASSPORT"
+	case NIDACustomerID:
+		return "NATIONAL ID"
+	case NonCustomerID:
+		return "NIL"
+	case MeterNumberCustomerID:
+		return "METER NUMBER"
+	default:
+		return fmt.Sprintf("CustomerID(%d)", int(c))
+	}
+}
+
 // IsSuccess checks the response ack code and return true if the code
 // means success and false if otherwise
 func IsSuccess(code int64) bool {
@@ -0,0 +1,193 @@
+package vfdtest
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+)
+
+const (
+	faultAckCode faultKind = iota + 1
+	faultInternalError
+	faultMalformedXML
+	faultDelay
+	faultConnectionReset
+	faultExpiredToken
+)
+
+// InvalidGCCode is the ACKCODE of the acknowledgement of a receipt whose GC does
+// not follow the GC of the last receipt of the device, leaving a gap or going
+// back to a GC already used by another receipt. A receipt sent again unchanged
+// gets its first acknowledgement back instead.
+const InvalidGCCode int64 = 9
+
+const invalidGCMessage = "Invalid GC"
+
+type (
+	faultKind int
+
+	// Fault is a failure the server produces instead of, or before, its normal
+	// response. Faults are created with AckCode, InvalidGC, InternalError,
+	// MalformedXML, Delay, ConnectionReset and ExpiredToken and scheduled with Server.Inject or
+	// Server.InjectAlways.
+	Fault struct {
+		kind    faultKind
+		code    int64
+		message string
+		delay   time.Duration
+	}
+
+	scenario struct {
+		queue  []Fault
+		always *Fault
+	}
+)
+
+// AckCode makes the server answer with a signed acknowledgement carrying code, one
+// of the ACKCODEs such as vfd.InvalidSignatureCode or vfd.InvalidTaxID. For token
+// requests the code is sent in the ACKCODE header of an HTTP 400 response.
+func AckCode(code int64) Fault {
+	message := vfd.ParseErrorCode(code)
+	if code == vfd.InvalidSignatureCode {
+		message = "Invalid Signature"
+	}
+	return Fault{kind: faultAckCode, code: code, message: message}
+}
+
+// InvalidGC makes the server reject a receipt as if its GC were out of
+// sequence, with an acknowledgement carrying InvalidGCCode.
+func InvalidGC() Fault {
+	return Fault{kind: faultAckCode, code: InvalidGCCode, message: invalidGCMessage}
+}
+
+// InternalError makes the server answer with HTTP 500 and a models.Error body
+// carrying message.
+func InternalError(message string) Fault {
+	return Fault{kind: faultInternalError, message: message}
+}
+
+// MalformedXML makes the server answer with HTTP 200 and a body that is not valid XML.
+func MalformedXML() Fault {
+	return Fault{kind: faultMalformedXML}
+}
+
+// Delay makes the server wait for d, or until the client gives up, before handling
+// the request normally. It is used to exceed context deadlines.
+func Delay(d time.Duration) Fault {
+	return Fault{kind: faultDelay, delay: d}
+}
+
+// ConnectionReset makes the server reset the TCP connection without answering.
+func ConnectionReset() Fault {
+	return Fault{kind: faultConnectionReset}
+}
+
+// ExpiredToken makes the server answer with HTTP 401 as if the bearer token had expired.
+func ExpiredToken() Fault {
+	return Fault{kind: faultExpiredToken}
+}
+
+// Inject schedules faults for the next requests of action, one fault per request
+// in the given order. Requests that find the queue empty are handled normally or
+// with the fault set by InjectAlways.
+func (s *Server) Inject(action vfd.Action, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.scenario(action)
+	sc.queue = append(sc.queue, faults...)
+}
+
+// InjectAlways makes every request of action fail with fault once the queue of
+// faults scheduled with Inject is exhausted, until ClearFaults is called.
+func (s *Server) InjectAlways(action vfd.Action, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenario(action).always = &fault
+}
+
+// ClearFaults removes every scheduled fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenarios = make(map[vfd.Action]*scenario)
+}
+
+// PendingFaults returns how many faults scheduled with Inject have not been used yet.
+func (s *Server) PendingFaults(action vfd.Action) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.scenario(action).queue)
+}
+
+func (s *Server) scenario(action vfd.Action) *scenario {
+	sc, ok := s.scenarios[action]
+	if !ok {
+		sc = &scenario{}
+		s.scenarios[action] = sc
+	}
+	return sc
+}
+
+// nextFault pops the fault to apply to the current request of action, if any.
+func (s *Server) nextFault(action vfd.Action) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.scenario(action)
+	if len(sc.queue) > 0 {
+		fault := sc.queue[0]
+		sc.queue = sc.queue[1:]
+		return &fault
+	}
+	return sc.always
+}
+
+// applyFault produces the transport level faults. It returns the fault left for the
+// handler to apply, which is only ever an AckCode fault, and whether the request has
+// already been answered.
+func applyFault(w http.ResponseWriter, r *http.Request, fault *Fault) (*Fault, bool) {
+	if fault == nil {
+		return nil, false
+	}
+
+	switch fault.kind {
+	case faultAckCode:
+		return fault, false
+
+	case faultInternalError:
+		writeError(w, fault.message)
+
+	case faultMalformedXML:
+		w.Header().Set("Content-Type", vfd.ContentTypeXML)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><EFDMS><RCTACK><RCTNUM>`))
+
+	case faultDelay:
+		timer := time.NewTimer(fault.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil, false
+		case <-r.Context().Done():
+		}
+
+	case faultConnectionReset:
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			panic("vfdtest: response writer does not support hijacking")
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			panic("vfdtest: " + err.Error())
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			_ = tcp.SetLinger(0)
+		}
+		_ = conn.Close()
+
+	case faultExpiredToken:
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	return nil, true
+}
@@ -0,0 +1,156 @@
+package vfdtest_test
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+type fixture struct {
+	server  *vfdtest.Server
+	key     *rsa.PrivateKey
+	reg     vfd.RegistrationResponse
+	headers *vfd.RequestHeaders
+	receipt *vfd.ReceiptRequest
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	server := vfdtest.NewServer()
+	t.Cleanup(server.Close)
+
+	key, cert, err := vfdtest.GenerateCertificate("merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := server.AddDevice(vfdtest.Device{TIN: "123456789", CertKey: "KEY", CertSerial: "serial", Certificate: cert})
+
+	return &fixture{
+		server:  server,
+		key:     key,
+		reg:     reg,
+		headers: &vfd.RequestHeaders{CertSerial: "serial"},
+		receipt: &vfd.ReceiptRequest{
+			Params: vfd.ReceiptParams{
+				Date: "2023-01-01", Time: "10:00:00", TIN: "123456789", GlobalCounter: 1, DailyCounter: 1,
+			},
+			Customer: vfd.Customer{Type: vfd.NonCustomerID},
+			Items:    []vfd.Item{{ID: "1", Description: "Soap", TaxCode: 1, Quantity: 1, UnitPrice: 1000}},
+			Payments: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1000}},
+		},
+	}
+}
+
+func (f *fixture) client(options ...vfd.Option) *vfd.Client {
+	options = append([]vfd.Option{
+		vfd.WithHttpClient(f.server.Client()),
+		vfd.WithTokenRequest(f.server.RequestURL(env.PROD, vfd.FetchTokenAction), &vfd.TokenRequest{
+			Username: f.reg.USERNAME, Password: f.reg.PASSWORD, GrantType: "password",
+		}),
+	}, options...)
+	return vfd.NewClient(options...)
+}
+
+func (f *fixture) submit(ctx context.Context, client *vfd.Client) (*vfd.Response, error) {
+	return client.SubmitReceipt(ctx, f.server.RequestURL(env.PROD, vfd.SubmitReceiptAction), f.headers, f.key, f.receipt)
+}
+
+func TestInjectAckCodes(t *testing.T) {
+	t.Parallel()
+	f := newFixture(t)
+	client := f.client(vfd.WithAckCertificate(f.server.Certificate()))
+
+	codes := []int64{
+		vfd.InvalidSignatureCode, vfd.InvalidTaxID, vfd.ApprovalRequired, vfd.UnhandledException,
+		vfd.InvalidSerial, vfd.InvalidClientHeader, vfd.InvalidCertificate,
+	}
+	for _, code := range codes {
+		f.server.Inject(vfd.SubmitReceiptAction, vfdtest.AckCode(code))
+	}
+
+	for _, code := range codes {
+		resp, err := f.submit(context.Background(), client)
+		if resp == nil || resp.Code != code {
+			t.Errorf("SubmitReceipt() = %+v, want ack code %d", resp, code)
+		}
+		ackErr := &vfd.AckError{}
+		if !errors.As(err, &ackErr) || ackErr.Code != code || ackErr.Action != vfd.SubmitReceiptAction {
+			t.Errorf("SubmitReceipt() error = %v, want an AckError with code %d", err, code)
+		}
+	}
+
+	resp, err := f.submit(context.Background(), client)
+	if err != nil || !vfd.IsSuccess(resp.Code) {
+		t.Errorf("SubmitReceipt() after the scenario = %+v, %v, want success", resp, err)
+	}
+}
+
+func TestInjectTransportFaults(t *testing.T) {
+	t.Parallel()
+	f := newFixture(t)
+	client := f.client()
+
+	f.server.Inject(vfd.SubmitReceiptAction, vfdtest.InternalError("database is down"))
+	if _, err := f.submit(context.Background(), client); err == nil || !strings.Contains(err.Error(), "database is down") ||
+		!vfd.IsRetryable(err) {
+		t.Errorf("InternalError: SubmitReceipt() error = %v, want a retryable error", err)
+	}
+
+	f.server.Inject(vfd.SubmitReceiptAction, vfdtest.MalformedXML())
+	if _, err := f.submit(context.Background(), client); err == nil || !strings.Contains(err.Error(), "XML syntax error") {
+		t.Errorf("MalformedXML: SubmitReceipt() error = %v, want a decode error", err)
+	}
+
+	f.server.Inject(vfd.SubmitReceiptAction, vfdtest.Delay(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.submit(ctx, client); !vfd.IsNetworkError(err) {
+		t.Errorf("Delay: SubmitReceipt() error = %v, want a network error", err)
+	}
+
+	f.server.Inject(vfd.SubmitReceiptAction, vfdtest.ConnectionReset())
+	if _, err := f.submit(context.Background(), client); !vfd.IsNetworkError(err) {
+		t.Errorf("ConnectionReset: SubmitReceipt() error = %v, want a network error", err)
+	}
+
+	if n := f.server.PendingFaults(vfd.SubmitReceiptAction); n != 0 {
+		t.Errorf("PendingFaults() = %d, want 0", n)
+	}
+}
+
+func TestInjectExpiredToken(t *testing.T) {
+	t.Parallel()
+	f := newFixture(t)
+
+	var reauths int32
+	client := f.client(vfd.WithReauthenticateHook(func(context.Context, *vfd.AuthError) {
+		atomic.AddInt32(&reauths, 1)
+	}))
+
+	f.server.Inject(vfd.SubmitReceiptAction, vfdtest.ExpiredToken())
+	resp, err := f.submit(context.Background(), client)
+	if err != nil || !vfd.IsSuccess(resp.Code) {
+		t.Fatalf("SubmitReceipt() = %+v, %v, want success after re-authentication", resp, err)
+	}
+	if reauths != 1 {
+		t.Errorf("re-authenticated %d times, want 1", reauths)
+	}
+
+	f.server.InjectAlways(vfd.SubmitReceiptAction, vfdtest.ExpiredToken())
+	if _, err := f.submit(context.Background(), client); !errors.Is(err, vfd.ErrUnauthorized) {
+		t.Errorf("SubmitReceipt() error = %v, want %v", err, vfd.ErrUnauthorized)
+	}
+
+	f.server.ClearFaults()
+	if _, err := f.submit(context.Background(), client); err != nil {
+		t.Errorf("SubmitReceipt() after ClearFaults error = %v", err)
+	}
+}
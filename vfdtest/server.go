@@ -0,0 +1,704 @@
+// Package vfdtest provides an in-process simulator of the TRA EFDMS VFD API for
+// use in tests. It serves registration, token, receipt and Z report endpoints on
+// both the production and the testing path layouts, verifies request signatures
+// with the certificates of the registered devices and signs its acknowledgements.
+package vfdtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/internal/element"
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/env"
+)
+
+const (
+	RegisterProductionPath      = "/api/vfdRegReq"
+	FetchTokenProductionPath    = "/vfdtoken"
+	SubmitReceiptProductionPath = "/api/efdmsRctInfo"
+	SubmitReportProductionPath  = "/api/efdmszreport"
+	RegisterTestingPath         = "/efdmsRctApi/api/vfdRegReq"
+	FetchTokenTestingPath       = "/efdmsRctApi/vfdtoken"
+	SubmitReceiptTestingPath    = "/efdmsRctApi/api/efdmsRctInfo"
+	SubmitReportTestingPath     = "/efdmsRctApi/api/efdmszreport"
+	DefaultTokenTTL             = time.Hour
+)
+
+type (
+	// Device is a VFD known to the simulator. Requests are matched to a device by the
+	// Cert-Serial header and their signatures are verified with Certificate.
+	// Registration is returned on registration; empty fields are filled with
+	// generated values.
+	Device struct {
+		TIN          string
+		CertKey      string
+		CertSerial   string
+		Certificate  *x509.Certificate
+		Registration vfd.RegistrationResponse
+	}
+
+	// Receipt is a receipt accepted by the simulator.
+	Receipt struct {
+		EFDSerial string
+		TIN       string
+		GC        int64
+		DC        int64
+		ZNum      string
+		Date      string
+		Time      string
+		Envelope  []byte
+	}
+
+	// Report is a Z report accepted by the simulator.
+	Report struct {
+		EFDSerial string
+		TIN       string
+		ZNumber   string
+		Date      string
+		Time      string
+		Envelope  []byte
+	}
+
+	// Option configures a Server.
+	Option func(*Server)
+
+	// Server is a running EFDMS simulator.
+	Server struct {
+		http     *httptest.Server
+		key      *rsa.PrivateKey
+		cert     *x509.Certificate
+		tokenTTL time.Duration
+		now      func() time.Time
+
+		mu        sync.Mutex
+		devices   map[string]*device
+		tokens    map[string]*token
+		receipts  []Receipt
+		reports   []Report
+		scenarios map[vfd.Action]*scenario
+	}
+
+	device struct {
+		Device
+		lastGC int64
+		acks   map[int64]acceptedReceipt
+	}
+
+	// acceptedReceipt is the signed RCT of an accepted receipt and the
+	// acknowledgement it was answered with.
+	acceptedReceipt struct {
+		payload []byte
+		ack     []byte
+	}
+
+	token struct {
+		serial  string
+		expires time.Time
+	}
+)
+
+// WithTokenTTL sets the lifetime of the tokens issued by the server.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.tokenTTL = ttl
+	}
+}
+
+// WithClock replaces time.Now, which is used for token expiry and ack timestamps.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// NewServer starts a simulator. It panics if the signing certificate of the
+// server cannot be generated. Callers should Close it when done.
+func NewServer(options ...Option) *Server {
+	key, cert, err := GenerateCertificate("EFDMS Simulator")
+	if err != nil {
+		panic(fmt.Sprintf("vfdtest: %v", err))
+	}
+
+	s := &Server{
+		key:       key,
+		cert:      cert,
+		tokenTTL:  DefaultTokenTTL,
+		now:       time.Now,
+		devices:   make(map[string]*device),
+		tokens:    make(map[string]*token),
+		scenarios: make(map[vfd.Action]*scenario),
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	mux := http.NewServeMux()
+	for _, path := range []string{RegisterProductionPath, RegisterTestingPath} {
+		mux.HandleFunc(path, s.handleRegister)
+	}
+	for _, path := range []string{FetchTokenProductionPath, FetchTokenTestingPath} {
+		mux.HandleFunc(path, s.handleToken)
+	}
+	for _, path := range []string{SubmitReceiptProductionPath, SubmitReceiptTestingPath} {
+		mux.HandleFunc(path, s.handleReceipt)
+	}
+	for _, path := range []string{SubmitReportProductionPath, SubmitReportTestingPath} {
+		mux.HandleFunc(path, s.handleReport)
+	}
+	s.http = httptest.NewServer(mux)
+
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.http.URL
+}
+
+// Client returns an http.Client configured for the server.
+func (s *Server) Client() *http.Client {
+	return s.http.Client()
+}
+
+// Certificate returns the certificate the server signs acknowledgements with.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// RequestURL is the counterpart of vfd.RequestURL that points to the simulator.
+// The production path layout is used for env.PROD and the testing layout otherwise.
+func (s *Server) RequestURL(e env.Env, action vfd.Action) string {
+	production := e == env.PROD
+	var path string
+	switch action {
+	case vfd.RegisterClientAction:
+		path = choose(production, RegisterProductionPath, RegisterTestingPath)
+	case vfd.FetchTokenAction:
+		path = choose(production, FetchTokenProductionPath, FetchTokenTestingPath)
+	case vfd.SubmitReceiptAction:
+		path = choose(production, SubmitReceiptProductionPath, SubmitReceiptTestingPath)
+	case vfd.SubmitReportAction:
+		path = choose(production, SubmitReportProductionPath, SubmitReportTestingPath)
+	default:
+		return ""
+	}
+	return s.http.URL + path
+}
+
+// AddDevice makes the server accept requests from d and returns the registration
+// response the server will answer d's registration request with.
+func (s *Server) AddDevice(d Device) vfd.RegistrationResponse {
+	reg := &d.Registration
+	reg.ACKCODE = "0"
+	reg.ACKMSG = "Registration Successful"
+	reg.TIN = d.TIN
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&reg.REGID, "TZ0100" + randomString(4)},
+		{&reg.SERIAL, d.CertKey},
+		{&reg.UIN, "09VFDWEBAPI-" + randomString(8)},
+		{&reg.VRN, "NOT REGISTERED"},
+		{&reg.NAME, "VFDTEST MERCHANT"},
+		{&reg.STREET, "MOROGORO ROAD"},
+		{&reg.CITY, "DAR ES SALAAM"},
+		{&reg.COUNTRY, "TANZANIA"},
+		{&reg.MOBILE, "0700000000"},
+		{&reg.ADDRESS, "P.O BOX 1"},
+		{&reg.REGION, "Dar es Salaam"},
+		{&reg.RECEIPTCODE, strings.ToUpper(randomString(3))},
+		{&reg.ROUTINGKEY, vfd.SubmitReceiptRoutingKey},
+		{&reg.TAXOFFICE, "Tax Office Ilala"},
+		{&reg.USERNAME, "user" + randomString(4)},
+		{&reg.PASSWORD, randomString(8)},
+		{&reg.TOKENPATH, FetchTokenProductionPath},
+		{&reg.TAXCODES.CODEA, "18"},
+		{&reg.TAXCODES.CODEB, "0"},
+		{&reg.TAXCODES.CODEC, "0"},
+		{&reg.TAXCODES.CODED, "0"},
+	}
+	for _, def := range defaults {
+		if *def.field == "" {
+			*def.field = def.value
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[d.CertSerial] = &device{
+		Device: d,
+		lastGC: reg.GC,
+		acks:   make(map[int64]acceptedReceipt),
+	}
+
+	return *reg
+}
+
+// Receipts returns the receipts accepted so far in the order they were received.
+func (s *Server) Receipts() []Receipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Receipt(nil), s.receipts...)
+}
+
+// Reports returns the Z reports accepted so far in the order they were received.
+func (s *Server) Reports() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Report(nil), s.reports...)
+}
+
+// LastGC returns the global counter of the last receipt accepted from the device
+// with the given certificate serial.
+func (s *Server) LastGC(certSerial string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[certSerial]; ok {
+		return d.lastGC
+	}
+	return 0
+}
+
+// ExpireTokens invalidates every token issued so far.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]*token)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	fault, done := applyFault(w, r, s.nextFault(vfd.RegisterClientAction))
+	if done {
+		return
+	}
+
+	body, d, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	reg := d.Registration
+	respond := func(code, message string) {
+		resp := models.REGDATARESP{ACKCODE: code, ACKMSG: message}
+		if code == "0" {
+			resp = registrationResponse(reg)
+		}
+		s.writeAck(w, &resp)
+	}
+
+	if fault != nil {
+		respond(strconv.FormatInt(fault.code, 10), fault.message)
+		return
+	}
+
+	if r.Header.Get("Client") != vfd.RegistrationRequestClient {
+		respond(strconv.FormatInt(vfd.InvalidClientHeader, 10), vfd.ParseErrorCode(vfd.InvalidClientHeader))
+		return
+	}
+
+	request := models.REGDATA{}
+	payload, signature, err := decodeEnvelope(body, "REGDATA", &request)
+	if err != nil {
+		writeError(w, fmt.Sprintf("could not decode registration: %v", err))
+		return
+	}
+	if !verify(d.Certificate, payload, signature) {
+		respond(strconv.FormatInt(vfd.InvalidSignatureCode, 10), "Invalid Signature")
+		return
+	}
+	if request.TIN != d.TIN {
+		respond(strconv.FormatInt(vfd.InvalidTaxID, 10), vfd.ParseErrorCode(vfd.InvalidTaxID))
+		return
+	}
+	if request.CERTKEY != d.CertKey {
+		respond(strconv.FormatInt(vfd.InvalidSerial, 10), vfd.ParseErrorCode(vfd.InvalidSerial))
+		return
+	}
+
+	respond("0", reg.ACKMSG)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	fault, done := applyFault(w, r, s.nextFault(vfd.FetchTokenAction))
+	if done {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		username = r.PostForm.Get("username")
+		password = r.PostForm.Get("password")
+		serial   string
+	)
+	s.mu.Lock()
+	for certSerial, d := range s.devices {
+		if d.Registration.USERNAME == username && d.Registration.PASSWORD == password {
+			serial = certSerial
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if fault != nil {
+		w.Header().Set("ACKCODE", strconv.FormatInt(fault.code, 10))
+		w.Header().Set("ACKMSG", fault.message)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fault.message})
+		return
+	}
+	if serial == "" || r.PostForm.Get("grant_type") != "password" {
+		w.Header().Set("ACKCODE", "1")
+		w.Header().Set("ACKMSG", "Invalid credentials")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	accessToken := randomString(32)
+	s.mu.Lock()
+	s.tokens[accessToken] = &token{serial: serial, expires: s.now().Add(s.tokenTTL)}
+	s.mu.Unlock()
+
+	w.Header().Set("ACKCODE", "0")
+	w.Header().Set("ACKMSG", "Success")
+	_ = json.NewEncoder(w).Encode(&vfd.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   int64(s.tokenTTL / time.Second),
+	})
+}
+
+func (s *Server) handleReceipt(w http.ResponseWriter, r *http.Request) {
+	fault, done := applyFault(w, r, s.nextFault(vfd.SubmitReceiptAction))
+	if done {
+		return
+	}
+
+	body, d, ok := s.readAuthorizedRequest(w, r, vfd.SubmitReceiptRoutingKey)
+	if !ok {
+		return
+	}
+
+	rct := models.RCT{}
+	payload, signature, err := decodeEnvelope(body, "RCT", &rct)
+	if err != nil {
+		writeError(w, fmt.Sprintf("could not decode receipt: %v", err))
+		return
+	}
+
+	now := s.now()
+	ack := func(code int64, message string) []byte {
+		return s.signedAck(&models.RCTACK{
+			RCTNUM:  rct.GC,
+			DATE:    now.Format("2006-01-02"),
+			TIME:    now.Format("15:04:05"),
+			ACKCODE: code,
+			ACKMSG:  message,
+		})
+	}
+
+	if fault != nil {
+		writeXML(w, ack(fault.code, fault.message))
+		return
+	}
+	if !verify(d.Certificate, payload, signature) {
+		writeXML(w, ack(vfd.InvalidSignatureCode, "Invalid Signature"))
+		return
+	}
+	if rct.TIN != d.TIN {
+		writeXML(w, ack(vfd.InvalidTaxID, vfd.ParseErrorCode(vfd.InvalidTaxID)))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := d.acks[rct.GC]; ok {
+		if bytes.Equal(previous.payload, payload) {
+			writeXML(w, previous.ack)
+		} else {
+			writeXML(w, ack(InvalidGCCode, fmt.Sprintf("%s %d already used", invalidGCMessage, rct.GC)))
+		}
+		return
+	}
+	if want := d.lastGC + 1; rct.GC != want {
+		writeXML(w, ack(InvalidGCCode, fmt.Sprintf("%s %d, expected %d", invalidGCMessage, rct.GC, want)))
+		return
+	}
+
+	response := ack(vfd.SuccessCode, "Success")
+	d.acks[rct.GC] = acceptedReceipt{payload: payload, ack: response}
+	d.lastGC = rct.GC
+	s.receipts = append(s.receipts, Receipt{
+		EFDSerial: rct.EFDSERIAL,
+		TIN:       rct.TIN,
+		GC:        rct.GC,
+		DC:        rct.DC,
+		ZNum:      rct.ZNUM,
+		Date:      rct.DATE,
+		Time:      rct.TIME,
+		Envelope:  body,
+	})
+	writeXML(w, response)
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	fault, done := applyFault(w, r, s.nextFault(vfd.SubmitReportAction))
+	if done {
+		return
+	}
+
+	body, d, ok := s.readAuthorizedRequest(w, r, vfd.SubmitReportRoutingKey)
+	if !ok {
+		return
+	}
+
+	report := models.ZREPORT{}
+	payload, signature, err := decodeEnvelope(body, "ZREPORT", &report)
+	if err != nil {
+		writeError(w, fmt.Sprintf("could not decode report: %v", err))
+		return
+	}
+
+	now := s.now()
+	zNumber, _ := strconv.ParseInt(report.ZNUMBER, 10, 64)
+	ack := func(code int64, message string) []byte {
+		return s.signedAck(&models.ZACK{
+			ZNUMBER: zNumber,
+			DATE:    now.Format("2006-01-02"),
+			TIME:    now.Format("15:04:05"),
+			ACKCODE: code,
+			ACKMSG:  message,
+		})
+	}
+
+	if fault != nil {
+		writeXML(w, ack(fault.code, fault.message))
+		return
+	}
+	if !verify(d.Certificate, payload, signature) {
+		writeXML(w, ack(vfd.InvalidSignatureCode, "Invalid Signature"))
+		return
+	}
+	if report.TIN != d.TIN {
+		writeXML(w, ack(vfd.InvalidTaxID, vfd.ParseErrorCode(vfd.InvalidTaxID)))
+		return
+	}
+
+	s.mu.Lock()
+	s.reports = append(s.reports, Report{
+		EFDSerial: report.EFDSERIAL,
+		TIN:       report.TIN,
+		ZNumber:   report.ZNUMBER,
+		Date:      report.DATE,
+		Time:      report.TIME,
+		Envelope:  body,
+	})
+	s.mu.Unlock()
+
+	writeXML(w, ack(vfd.SuccessCode, "Success"))
+}
+
+// readRequest reads the body of a POST request and finds the device it came from.
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request) ([]byte, *device, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err.Error())
+		return nil, nil, false
+	}
+
+	serial, err := base64.StdEncoding.DecodeString(r.Header.Get("Cert-Serial"))
+	if err != nil {
+		writeError(w, "invalid Cert-Serial header")
+		return nil, nil, false
+	}
+
+	s.mu.Lock()
+	d, ok := s.devices[string(serial)]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, fmt.Sprintf("unknown certificate serial %q", serial))
+		return nil, nil, false
+	}
+
+	return body, d, true
+}
+
+// readAuthorizedRequest is like readRequest but also checks the bearer token and the
+// routing key. Missing, unknown and expired tokens are answered with HTTP 401.
+func (s *Server) readAuthorizedRequest(w http.ResponseWriter, r *http.Request, routingKey string,
+) ([]byte, *device, bool) {
+	accessToken := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(accessToken) > 7 && strings.EqualFold(accessToken[:7], "bearer ") {
+		accessToken = accessToken[7:]
+	}
+
+	s.mu.Lock()
+	t, ok := s.tokens[accessToken]
+	valid := ok && s.now().Before(t.expires)
+	s.mu.Unlock()
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	if r.Header.Get("Routing-Key") != routingKey {
+		writeError(w, fmt.Sprintf("invalid Routing-Key %q", r.Header.Get("Routing-Key")))
+		return nil, nil, false
+	}
+
+	body, d, ok := s.readRequest(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if t.serial != d.CertSerial {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	return body, d, true
+}
+
+// signedAck marshals ack and wraps it in an EFDMS envelope signed by the server.
+func (s *Server) signedAck(ack any) []byte {
+	payload, err := xml.Marshal(ack)
+	if err != nil {
+		panic(fmt.Sprintf("vfdtest: could not marshal ack: %v", err))
+	}
+
+	signature, err := vfd.Sign(s.key, payload)
+	if err != nil {
+		panic(fmt.Sprintf("vfdtest: could not sign ack: %v", err))
+	}
+
+	return []byte(fmt.Sprintf("%s<EFDMS>%s<EFDMSSIGNATURE>%s</EFDMSSIGNATURE></EFDMS>",
+		xml.Header, payload, base64.StdEncoding.EncodeToString(signature)))
+}
+
+func (s *Server) writeAck(w http.ResponseWriter, ack any) {
+	writeXML(w, s.signedAck(ack))
+}
+
+// decodeEnvelope decodes the signed element called name of an EFDMS envelope into
+// v and returns its bytes and the signature. The element is found with the
+// element package, as the vfd package does, so envelopes with more than one
+// signed element or signature are rejected and v is decoded from the bytes that
+// are verified.
+func decodeEnvelope(body []byte, name string, v any) ([]byte, string, error) {
+	payload, err := element.Bytes(body, name)
+	if err != nil {
+		return nil, "", err
+	}
+	signatureElement, err := element.Bytes(body, "EFDMSSIGNATURE")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var signature string
+	if err := xml.Unmarshal(signatureElement, &signature); err != nil {
+		return nil, "", err
+	}
+	if err := xml.Unmarshal(payload, v); err != nil {
+		return nil, "", err
+	}
+
+	return payload, strings.TrimSpace(signature), nil
+}
+
+// verify checks signature over payload, the exact bytes of the signed element.
+func verify(cert *x509.Certificate, payload []byte, signature string) bool {
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	return vfd.VerifySignature(publicKey, payload, signature) == nil
+}
+
+func registrationResponse(reg vfd.RegistrationResponse) models.REGDATARESP {
+	return models.REGDATARESP{
+		ACKCODE:     reg.ACKCODE,
+		ACKMSG:      reg.ACKMSG,
+		REGID:       reg.REGID,
+		SERIAL:      reg.SERIAL,
+		UIN:         reg.UIN,
+		TIN:         reg.TIN,
+		VRN:         reg.VRN,
+		MOBILE:      reg.MOBILE,
+		ADDRESS:     reg.ADDRESS,
+		STREET:      reg.STREET,
+		CITY:        reg.CITY,
+		COUNTRY:     reg.COUNTRY,
+		NAME:        reg.NAME,
+		RECEIPTCODE: reg.RECEIPTCODE,
+		REGION:      reg.REGION,
+		ROUTINGKEY:  reg.ROUTINGKEY,
+		GC:          reg.GC,
+		TAXOFFICE:   reg.TAXOFFICE,
+		USERNAME:    reg.USERNAME,
+		PASSWORD:    reg.PASSWORD,
+		TOKENPATH:   reg.TOKENPATH,
+		TAXCODES: models.TAXCODES{
+			CODEA: reg.TAXCODES.CODEA,
+			CODEB: reg.TAXCODES.CODEB,
+			CODEC: reg.TAXCODES.CODEC,
+			CODED: reg.TAXCODES.CODED,
+		},
+	}
+}
+
+func writeXML(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", vfd.ContentTypeXML)
+	_, _ = w.Write(body)
+}
+
+// writeError answers with HTTP 500 and a models.Error body like the VFD server does.
+func writeError(w http.ResponseWriter, message string) {
+	out, _ := xml.Marshal(&models.Error{Message: message})
+	w.Header().Set("Content-Type", vfd.ContentTypeXML)
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = w.Write(out)
+}
+
+func choose(production bool, productionPath, testingPath string) string {
+	if production {
+		return productionPath
+	}
+	return testingPath
+}
+
+func randomString(n int) string {
+	buf := make([]byte, (n+1)/2)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)[:n]
+}
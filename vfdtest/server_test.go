@@ -0,0 +1,234 @@
+package vfdtest_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vfdcloud/vfd"
+	"github.com/vfdcloud/vfd/pkg/env"
+	"github.com/vfdcloud/vfd/vfdtest"
+)
+
+func TestServerLifecycle(t *testing.T) {
+	t.Parallel()
+	for _, e := range []env.Env{env.PROD, env.STAGING} {
+		e := e
+		t.Run(e.String(), func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			server := vfdtest.NewServer()
+			defer server.Close()
+
+			key, cert, err := vfdtest.GenerateCertificate("merchant")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.AddDevice(vfdtest.Device{
+				TIN:         "123456789",
+				CertKey:     "10TZ101234",
+				CertSerial:  "4bd3a9c1",
+				Certificate: cert,
+			})
+
+			client := vfd.NewClient(
+				vfd.WithHttpClient(server.Client()),
+				vfd.WithAckCertificate(server.Certificate()),
+			)
+			reg, err := client.Register(ctx, server.RequestURL(e, vfd.RegisterClientAction), key, &vfd.RegistrationRequest{
+				ContentType: vfd.ContentTypeXML,
+				CertSerial:  "4bd3a9c1",
+				Tin:         "123456789",
+				CertKey:     "10TZ101234",
+			})
+			if err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			if reg.TIN != "123456789" || reg.USERNAME == "" || reg.RECEIPTCODE == "" {
+				t.Errorf("Register() = %+v", reg)
+			}
+
+			vfd.WithTokenRequest(server.RequestURL(e, vfd.FetchTokenAction), &vfd.TokenRequest{
+				Username:  reg.USERNAME,
+				Password:  reg.PASSWORD,
+				GrantType: "password",
+			})(client)
+
+			headers := &vfd.RequestHeaders{CertSerial: "4bd3a9c1"}
+			receipt := &vfd.ReceiptRequest{
+				Params: vfd.ReceiptParams{
+					Date: "2023-01-01", Time: "10:00:00", TIN: reg.TIN, RegistrationID: reg.REGID,
+					EFDSerial: reg.SERIAL, ReceiptNum: "1", DailyCounter: 1, GlobalCounter: 1,
+					ZNum: "20230101", ReceiptVNum: reg.RECEIPTCODE + "1",
+				},
+				Customer: vfd.Customer{Type: vfd.NonCustomerID},
+				Items:    []vfd.Item{{ID: "1", Description: "Soap", TaxCode: 1, Quantity: 2, UnitPrice: 1500}},
+				Payments: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 3000}},
+			}
+			resp, err := client.SubmitReceipt(ctx, server.RequestURL(e, vfd.SubmitReceiptAction), headers, key, receipt)
+			if err != nil {
+				t.Fatalf("SubmitReceipt() error = %v", err)
+			}
+			if !vfd.IsSuccess(resp.Code) || resp.Number != 1 {
+				t.Errorf("SubmitReceipt() = %+v", resp)
+			}
+			if got := server.LastGC("4bd3a9c1"); got != 1 {
+				t.Errorf("LastGC() = %d, want 1", got)
+			}
+
+			report := &vfd.ReportRequest{
+				Params: &vfd.ReportParams{
+					Date: "2023-01-01", Time: "23:59:59", TIN: reg.TIN, VRN: reg.VRN, UIN: reg.UIN,
+					TaxOffice: reg.TAXOFFICE, RegistrationID: reg.REGID, ZNumber: "20230101",
+					EFDSerial: reg.SERIAL, RegistrationDate: "2023-01-01",
+				},
+				Address: &vfd.Address{Name: reg.NAME, Street: reg.STREET, City: reg.CITY, Country: reg.COUNTRY},
+				Totals:  &vfd.ReportTotals{DailyTotalAmount: 3000, Gross: 3000, TicketsFiscal: 1},
+			}
+			resp, err = client.SubmitReport(ctx, server.RequestURL(e, vfd.SubmitReportAction), headers, key, report)
+			if err != nil {
+				t.Fatalf("SubmitReport() error = %v", err)
+			}
+			if !vfd.IsSuccess(resp.Code) || resp.Number != 20230101 {
+				t.Errorf("SubmitReport() = %+v", resp)
+			}
+			if len(server.Receipts()) != 1 || len(server.Reports()) != 1 {
+				t.Errorf("server recorded %d receipts and %d reports", len(server.Receipts()), len(server.Reports()))
+			}
+		})
+	}
+}
+
+func TestServerRejections(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	now := time.Now()
+	server := vfdtest.NewServer(
+		vfdtest.WithTokenTTL(time.Minute),
+		vfdtest.WithClock(func() time.Time { return now }),
+	)
+	defer server.Close()
+
+	key, cert, _ := vfdtest.GenerateCertificate("merchant")
+	otherKey, _, _ := vfdtest.GenerateCertificate("someone else")
+	reg := server.AddDevice(vfdtest.Device{TIN: "123456789", CertKey: "KEY", CertSerial: "serial", Certificate: cert})
+
+	token, err := vfd.NewClient(vfd.WithHttpClient(server.Client())).FetchToken(ctx,
+		server.RequestURL(env.PROD, vfd.FetchTokenAction),
+		&vfd.TokenRequest{Username: reg.USERNAME, Password: reg.PASSWORD, GrantType: "password"})
+	if err != nil {
+		t.Fatalf("FetchToken() error = %v", err)
+	}
+
+	client := vfd.NewClient(vfd.WithHttpClient(server.Client()))
+	headers := &vfd.RequestHeaders{CertSerial: "serial", BearerToken: token.AccessToken}
+	receipt := &vfd.ReceiptRequest{
+		Params: vfd.ReceiptParams{
+			Date: "2023-01-01", Time: "10:00:00", TIN: "123456789", GlobalCounter: 1, DailyCounter: 1,
+		},
+		Customer: vfd.Customer{Type: vfd.NonCustomerID},
+		Items:    []vfd.Item{{ID: "1", Description: "Soap", TaxCode: 1, Quantity: 1, UnitPrice: 1000}},
+		Payments: []vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1000}},
+	}
+	url := server.RequestURL(env.PROD, vfd.SubmitReceiptAction)
+
+	resp, err := client.SubmitReceipt(ctx, url, headers, otherKey, receipt)
+	if !errors.Is(err, vfd.ErrInvalidSignature) || resp.Code != vfd.InvalidSignatureCode {
+		t.Errorf("SubmitReceipt() with wrong key = %+v, %v, want ack code %d", resp, err, vfd.InvalidSignatureCode)
+	}
+
+	receipt.Params.TIN = "987654321"
+	resp, err = client.SubmitReceipt(ctx, url, headers, key, receipt)
+	if !errors.Is(err, vfd.ErrInvalidTaxID) || resp.Code != vfd.InvalidTaxID {
+		t.Errorf("SubmitReceipt() with wrong TIN = %+v, %v, want ack code %d", resp, err, vfd.InvalidTaxID)
+	}
+
+	now = now.Add(2 * time.Minute)
+	_, err = client.SubmitReceipt(ctx, url, headers, key, receipt)
+	if !errors.Is(err, vfd.ErrUnauthorized) {
+		t.Errorf("SubmitReceipt() with expired token error = %v, want %v", err, vfd.ErrUnauthorized)
+	}
+}
+
+func TestServerCounterSequence(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	f := newFixture(t)
+	client := f.client()
+
+	steps := []struct {
+		name  string
+		gc    int64
+		time  string
+		fault bool
+		code  int64
+	}{
+		{"gap before the first receipt", 2, "10:00:00", false, vfdtest.InvalidGCCode},
+		{"first receipt", 1, "10:00:00", false, vfd.SuccessCode},
+		{"same receipt again", 1, "10:00:00", false, vfd.SuccessCode},
+		{"gap", 3, "10:01:00", false, vfdtest.InvalidGCCode},
+		{"next receipt", 2, "10:01:00", false, vfd.SuccessCode},
+		{"going back", 1, "10:02:00", false, vfdtest.InvalidGCCode},
+		{"injected fault", 3, "10:02:00", true, vfdtest.InvalidGCCode},
+		{"after the fault", 3, "10:02:00", false, vfd.SuccessCode},
+	}
+	for _, step := range steps {
+		if step.fault {
+			f.server.Inject(vfd.SubmitReceiptAction, vfdtest.InvalidGC())
+		}
+		f.receipt.Params.GlobalCounter = step.gc
+		f.receipt.Params.Time = step.time
+		resp, err := f.submit(ctx, client)
+		if resp == nil || resp.Code != step.code {
+			t.Errorf("%s: SubmitReceipt() with GC %d = %+v, %v, want ack code %d", step.name, step.gc, resp, err, step.code)
+		}
+	}
+
+	if got := f.server.LastGC("serial"); got != 3 {
+		t.Errorf("LastGC() = %d, want 3", got)
+	}
+	if got := len(f.server.Receipts()); got != 3 {
+		t.Errorf("server recorded %d receipts, want 3", got)
+	}
+}
+
+func TestServerRejectsDuplicateSignedElements(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	f := newFixture(t)
+
+	token, err := f.client().FetchToken(ctx, f.server.RequestURL(env.PROD, vfd.FetchTokenAction),
+		&vfd.TokenRequest{Username: f.reg.USERNAME, Password: f.reg.PASSWORD, GrantType: "password"})
+	if err != nil {
+		t.Fatalf("FetchToken() error = %v", err)
+	}
+	envelope, err := vfd.NewClient().ReceiptBytes(f.key, f.receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := vfd.DecodeReceipt(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed receipt is kept and a forged one is appended after it.
+	forged := strings.Replace(string(signed.Payload), "<TIN>123456789<", "<TIN>987654321<", 1)
+	path := filepath.Join(t.TempDir(), "receipt.xml")
+	if err := os.WriteFile(path, []byte(strings.Replace(string(envelope), "</EFDMS>", forged+"</EFDMS>", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfd.SubmitRawRequest(ctx, &vfd.RequestHeaders{CertSerial: "serial", BearerToken: token.AccessToken},
+		&vfd.RawRequest{Action: vfd.SubmitReceiptAction, FilePath: path,
+			URL: f.server.RequestURL(env.PROD, vfd.SubmitReceiptAction)})
+	if err == nil || !strings.Contains(err.Error(), "more than one element RCT") {
+		t.Errorf("SubmitRawRequest() of two RCT elements error = %v, want it rejected", err)
+	}
+	if got := len(f.server.Receipts()); got != 0 {
+		t.Errorf("server recorded %d receipts, want 0", got)
+	}
+}
@@ -0,0 +1,259 @@
+package vfd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vfdcloud/vfd/internal/models"
+	"github.com/vfdcloud/vfd/pkg/money"
+)
+
+var (
+	// ErrZNumMismatch is returned when a receipt is added to the aggregator of
+	// another Z report.
+	ErrZNumMismatch = errors.New("receipt belongs to a different Z report")
+
+	// ErrDuplicateReceipt is returned when a receipt with the same global
+	// counter has already been added to the aggregator.
+	ErrDuplicateReceipt = errors.New("receipt already added to the Z report")
+)
+
+type (
+	// ZReportAggregator builds a Z report from the receipts fiscalised under a
+	// single ZNUM. Every receipt is processed exactly as generateReceipt does
+	// when the receipt is signed, so the report totals match what was sent to
+	// TRA to the cent. Amounts are accumulated as money.Money to avoid float drift.
+	//
+	// A ZReportAggregator is safe for concurrent use.
+	ZReportAggregator struct {
+		mu           sync.Mutex
+		zNum         string
+		taxes        *TaxSchedule
+		openingGross money.Money
+		seen         map[int64]struct{}
+		daily        money.Money
+		discounts    money.Money
+		surcharges   money.Money
+		vats         map[string]*vatAccumulator
+		payments     map[PaymentType]money.Money
+	}
+
+	// ZReportOption configures a ZReportAggregator.
+	ZReportOption func(*ZReportAggregator)
+
+	vatAccumulator struct {
+		vat ValueAddedTax
+		net money.Money
+		tax money.Money
+	}
+)
+
+// NewZReportAggregator creates a ZReportAggregator for the receipts whose
+// ZNUM is zNum. openingGross is the GROSS of the previous Z report, the
+// cumulative sales of the device before this day, or 0 for the first report.
+func NewZReportAggregator(zNum string, openingGross float64, options ...ZReportOption) *ZReportAggregator {
+	a := &ZReportAggregator{
+		zNum:         zNum,
+		openingGross: money.FromFloat(openingGross),
+		seen:         make(map[int64]struct{}),
+		vats:         make(map[string]*vatAccumulator),
+		payments:     make(map[PaymentType]money.Money),
+	}
+	for _, option := range options {
+		option(a)
+	}
+	return a
+}
+
+// WithZReportTaxTable sets the rates the receipts were computed with. The
+// default is the DefaultTaxTable.
+func WithZReportTaxTable(table *TaxTable) ZReportOption {
+	return func(a *ZReportAggregator) {
+		a.taxes = &TaxSchedule{table: table}
+	}
+}
+
+// WithZReportTaxSchedule sets the history of the rates the receipts were
+// computed with. Every receipt is totalled at the rates in effect at its Date
+// and Time, a day with a rate change reports both rates.
+func WithZReportTaxSchedule(taxes *TaxSchedule) ZReportOption {
+	return func(a *ZReportAggregator) {
+		a.taxes = taxes
+	}
+}
+
+// ZNum returns the ZNUM of the receipts accepted by the aggregator.
+func (a *ZReportAggregator) ZNum() string {
+	return a.zNum
+}
+
+// Add adds a receipt as it is passed to ReceiptBytes or SubmitReceipt.
+func (a *ZReportAggregator) Add(receipt *ReceiptRequest) error {
+	result, err := a.taxes.ProcessItems(receipt.Params, receipt.Items, receipt.Adjustments...)
+	if err != nil {
+		return fmt.Errorf("receipt %d: %w", receipt.Params.GlobalCounter, err)
+	}
+	return a.add(receiptFromItems(receipt, result), result.surcharges())
+}
+
+// AddEnvelope adds a signed receipt as produced by ReceiptBytes, for example
+// the Payload of an OutboxEntry. The signature is not verified. The payload does
+// not tell surcharges apart from the item amounts, so AddEnvelope is only right
+// for receipts without a SurchargeAdjustment, use AddEnvelopeWithSurcharges for
+// the others.
+func (a *ZReportAggregator) AddEnvelope(payload []byte) error {
+	return a.AddEnvelopeWithSurcharges(payload, 0)
+}
+
+// AddEnvelopeWithSurcharges adds a signed receipt like AddEnvelope, with
+// surcharges the total of its SurchargeAdjustment shares, as kept in the
+// Surcharges of an OutboxEntry, counted in the Surcharges of the report.
+func (a *ZReportAggregator) AddEnvelopeWithSurcharges(payload []byte, surcharges float64) error {
+	if surcharges < 0 {
+		return fmt.Errorf("surcharges must not be negative, got %v", surcharges)
+	}
+	rct, err := decodeReceiptEnvelope(payload)
+	if err != nil {
+		return err
+	}
+	return a.add(rct, money.FromFloat(surcharges))
+}
+
+func (a *ZReportAggregator) add(rct *models.RCT, surcharges money.Money) error {
+	if rct.ZNUM != a.zNum {
+		return fmt.Errorf("%w: receipt %d has ZNUM %q, want %q", ErrZNumMismatch, rct.GC, rct.ZNUM, a.zNum)
+	}
+
+	payments := make(map[PaymentType]money.Money, len(rct.PAYMENTS.PAYMENT))
+	for _, p := range rct.PAYMENTS.PAYMENT {
+		payments[PaymentType(p.PMTTYPE)] += p.PMTAMOUNT
+	}
+
+	table, err := a.taxes.tableAt(rct.DATE, rct.TIME)
+	if err != nil {
+		return fmt.Errorf("receipt %d: %w", rct.GC, err)
+	}
+	vats := make(map[string]*vatAccumulator, len(rct.VATTOTALS.VATTOTAL))
+	for _, v := range rct.VATTOTALS.VATTOTAL {
+		vat, ok := table.vat(v.VATRATE)
+		if !ok {
+			return fmt.Errorf("receipt %d: unknown vat rate %q", rct.GC, v.VATRATE)
+		}
+		id := vat.reportRateID()
+		if vats[id] == nil {
+			vats[id] = &vatAccumulator{vat: vat}
+		}
+		vats[id].net += v.NETTAMOUNT
+		vats[id].tax += v.TAXAMOUNT
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.seen[rct.GC]; ok {
+		return fmt.Errorf("%w: global counter %d", ErrDuplicateReceipt, rct.GC)
+	}
+	a.seen[rct.GC] = struct{}{}
+
+	a.daily += rct.TOTALS.TOTALTAXINCL
+	a.discounts += rct.TOTALS.DISCOUNT
+	a.surcharges += surcharges
+	for t, amount := range payments {
+		a.payments[t] += amount
+	}
+	for id, v := range vats {
+		if a.vats[id] == nil {
+			a.vats[id] = &vatAccumulator{vat: v.vat}
+		}
+		a.vats[id].net += v.net
+		a.vats[id].tax += v.tax
+	}
+
+	return nil
+}
+
+// Receipts returns the number of receipts added so far.
+func (a *ZReportAggregator) Receipts() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.seen)
+}
+
+// Totals returns the report totals of the receipts added so far. Every
+// receipt counts as a fiscal ticket, voids and corrections are left at 0.
+func (a *ZReportAggregator) Totals() ReportTotals {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return ReportTotals{
+		DailyTotalAmount: a.daily.Float64(),
+		Gross:            (a.openingGross + a.daily).Float64(),
+		Discounts:        a.discounts.Float64(),
+		Surcharges:       a.surcharges.Float64(),
+		TicketsFiscal:    int64(len(a.seen)),
+	}
+}
+
+// VATTotals returns the net and tax amounts per VAT rate, in the order A to E.
+// Rates without sales are omitted, sumVatTotals reports them as zero.
+func (a *ZReportAggregator) VATTotals() []VATTOTAL {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	vats := make([]ValueAddedTax, 0, len(a.vats))
+	for _, v := range a.vats {
+		vats = append(vats, v.vat)
+	}
+	sortVATs(vats)
+
+	var totals []VATTOTAL
+	for _, vat := range vats {
+		v := a.vats[vat.reportRateID()]
+		totals = append(totals, VATTOTAL{
+			ID:        v.vat.ID,
+			Rate:      v.vat.Percentage,
+			NetAmount: v.net.Float64(),
+			TaxAmount: v.tax.Float64(),
+		})
+	}
+
+	return totals
+}
+
+// Payments returns the amount collected per PaymentType, in the order the
+// Z report lists them. Payment types without receipts are omitted.
+func (a *ZReportAggregator) Payments() []Payment {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var payments []Payment
+	for _, t := range []PaymentType{
+		CashPaymentType, ChequePaymentType, CreditCardPaymentType,
+		ElectronicPaymentType, InvoicePaymentType,
+	} {
+		if amount, ok := a.payments[t]; ok {
+			payments = append(payments, Payment{Type: t, Amount: amount.Float64()})
+		}
+	}
+
+	return payments
+}
+
+// Report returns a ReportRequest with the totals, VAT totals and payments
+// of the receipts added so far. params is copied and its ZNumber is set to
+// the ZNUM of the aggregator when it is empty.
+func (a *ZReportAggregator) Report(params ReportParams, address Address) *ReportRequest {
+	if params.ZNumber == "" {
+		params.ZNumber = a.zNum
+	}
+	totals := a.Totals()
+
+	return &ReportRequest{
+		Params:  &params,
+		Address: &address,
+		Totals:  &totals,
+		VATS:    a.VATTotals(),
+		Payment: a.Payments(),
+	}
+}
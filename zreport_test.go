@@ -0,0 +1,176 @@
+package vfd_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vfdcloud/vfd"
+)
+
+func zReportReceipt(gc int64, items []vfd.Item, payments []vfd.Payment) *vfd.ReceiptRequest {
+	receipt := testReceipt()
+	receipt.Params.GlobalCounter = gc
+	receipt.Params.ZNum = "20230101"
+	receipt.Items = items
+	receipt.Payments = payments
+	return receipt
+}
+
+func TestZReportAggregator(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	receipts := []*vfd.ReceiptRequest{
+		zReportReceipt(10,
+			[]vfd.Item{
+				{ID: "1", Description: "Soap", TaxCode: vfd.TaxableItemCode, Quantity: 2, UnitPrice: 1500, Discount: 100},
+				{ID: "2", Description: "Maize", TaxCode: vfd.NonTaxableItemCode, Quantity: 1, UnitPrice: 2000},
+			},
+			[]vfd.Payment{{Type: vfd.CashPaymentType, Amount: 4900}},
+		),
+		zReportReceipt(11,
+			[]vfd.Item{{ID: "3", Description: "Oil", TaxCode: vfd.TaxableItemCode, Quantity: 3, UnitPrice: 0.1}},
+			[]vfd.Payment{{Type: vfd.ElectronicPaymentType, Amount: 0.3}},
+		),
+		zReportReceipt(12,
+			[]vfd.Item{{ID: "4", Description: "Rice", TaxCode: vfd.TaxableItemCode, Quantity: 1, UnitPrice: 1180}},
+			[]vfd.Payment{{Type: vfd.CashPaymentType, Amount: 1000}, {Type: vfd.CreditCardPaymentType, Amount: 180}},
+		),
+	}
+
+	aggregator := vfd.NewZReportAggregator("20230101", 100000)
+	for i, receipt := range receipts {
+		var err error
+		if i%2 == 0 {
+			err = aggregator.Add(receipt)
+		} else {
+			payload, perr := vfd.ReceiptBytes(privateKey, receipt.Params, receipt.Customer, receipt.Items, receipt.Payments)
+			if perr != nil {
+				t.Fatal(perr)
+			}
+			err = aggregator.AddEnvelope(payload)
+		}
+		if err != nil {
+			t.Fatalf("adding receipt %d: %v", receipt.Params.GlobalCounter, err)
+		}
+	}
+
+	report := aggregator.Report(vfd.ReportParams{TIN: "123456789"}, vfd.Address{Name: "Shop"})
+	if report.Params.ZNumber != "20230101" {
+		t.Errorf("ZNumber = %q, want 20230101", report.Params.ZNumber)
+	}
+
+	wantTotals := vfd.ReportTotals{
+		DailyTotalAmount: 6080.3,
+		Gross:            106080.3,
+		Discounts:        100,
+		TicketsFiscal:    3,
+	}
+	if *report.Totals != wantTotals {
+		t.Errorf("Totals = %+v, want %+v", *report.Totals, wantTotals)
+	}
+
+	wantVATs := []vfd.VATTOTAL{
+		{ID: "A", Rate: 18, NetAmount: 3457.88, TaxAmount: 622.42},
+		{ID: "C", Rate: 0, NetAmount: 2000, TaxAmount: 0},
+	}
+	if !reflect.DeepEqual(report.VATS, wantVATs) {
+		t.Errorf("VATS = %+v, want %+v", report.VATS, wantVATs)
+	}
+
+	wantPayments := []vfd.Payment{
+		{Type: vfd.CashPaymentType, Amount: 5900},
+		{Type: vfd.CreditCardPaymentType, Amount: 180},
+		{Type: vfd.ElectronicPaymentType, Amount: 0.3},
+	}
+	if !reflect.DeepEqual(report.Payment, wantPayments) {
+		t.Errorf("Payment = %+v, want %+v", report.Payment, wantPayments)
+	}
+
+	if _, err := vfd.ReportBytes(privateKey, report.Params, *report.Address, report.VATS,
+		report.Payment, *report.Totals); err != nil {
+		t.Errorf("ReportBytes() error = %v", err)
+	}
+}
+
+func TestZReportAggregatorRejects(t *testing.T) {
+	aggregator := vfd.NewZReportAggregator("20230101", 0)
+	receipt := zReportReceipt(1, testReceipt().Items, testReceipt().Payments)
+	if err := aggregator.Add(receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aggregator.Add(receipt); !errors.Is(err, vfd.ErrDuplicateReceipt) {
+		t.Errorf("Add() duplicate error = %v, want %v", err, vfd.ErrDuplicateReceipt)
+	}
+
+	other := zReportReceipt(2, testReceipt().Items, testReceipt().Payments)
+	other.Params.ZNum = "20230102"
+	if err := aggregator.Add(other); !errors.Is(err, vfd.ErrZNumMismatch) {
+		t.Errorf("Add() other day error = %v, want %v", err, vfd.ErrZNumMismatch)
+	}
+
+	if err := aggregator.AddEnvelope([]byte("<EFDMS><RCT>")); err == nil {
+		t.Error("AddEnvelope() of a truncated envelope returned no error")
+	}
+
+	if got := aggregator.Receipts(); got != 1 {
+		t.Errorf("Receipts() = %d, want 1", got)
+	}
+}
+
+func TestZReportAggregatorAdjustments(t *testing.T) {
+	receipt := zReportReceipt(1,
+		[]vfd.Item{
+			{ID: "1", Description: "Soap", TaxCode: vfd.StandardVATCODE, Quantity: 1, UnitPrice: 1180},
+			{ID: "2", Description: "Maize", TaxCode: vfd.ZeroVATCODE, Quantity: 1, UnitPrice: 1000},
+		},
+		[]vfd.Payment{{Type: vfd.CashPaymentType, Amount: 2071}},
+	)
+	receipt.Adjustments = []vfd.Adjustment{
+		{Type: vfd.DiscountAdjustment, Percentage: 10},
+		{Type: vfd.SurchargeAdjustment, Description: "Service charge", Percentage: 5},
+	}
+	if err := receipt.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	aggregator := vfd.NewZReportAggregator("20230101", 0)
+	if err := aggregator.Add(receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTotals := vfd.ReportTotals{
+		DailyTotalAmount: 2071,
+		Gross:            2071,
+		Discounts:        218,
+		Surcharges:       109,
+		TicketsFiscal:    1,
+	}
+	if got := aggregator.Totals(); got != wantTotals {
+		t.Errorf("Totals() = %+v, want %+v", got, wantTotals)
+	}
+
+	entry, err := vfd.NewOutbox(vfd.NewMemoryOutboxStore(), nil).Add(context.Background(), testPrivateKey(t), receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Surcharges != 109 {
+		t.Errorf("outbox entry Surcharges = %v, want 109", entry.Surcharges)
+	}
+	enveloped := vfd.NewZReportAggregator("20230101", 0)
+	if err := enveloped.AddEnvelopeWithSurcharges(entry.Payload, entry.Surcharges); err != nil {
+		t.Fatal(err)
+	}
+	if got := enveloped.Totals(); got != wantTotals {
+		t.Errorf("Totals() of AddEnvelopeWithSurcharges = %+v, want %+v", got, wantTotals)
+	}
+
+	wantVATs := []vfd.VATTOTAL{
+		{ID: "A", Rate: 18, NetAmount: 950, TaxAmount: 171},
+		{ID: "C", Rate: 0, NetAmount: 950, TaxAmount: 0},
+	}
+	if got := aggregator.VATTotals(); !reflect.DeepEqual(got, wantVATs) {
+		t.Errorf("VATTotals() = %+v, want %+v", got, wantVATs)
+	}
+}